@@ -0,0 +1,277 @@
+/*
+Package crawling provides discovery of the files linked from HTML directory listings.
+*/
+package crawling
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// File is a file found by Crawler.
+type File struct {
+	URL *url.URL
+	// Path is the slash-separated path of the file relative to the root listing.
+	Path string
+}
+
+// Crawler follows the links of HTML directory listings such as nginx and Apache autoindex.
+//
+// A link whose path ends with "/" is followed as a subdirectory, and any other link is regarded as a file.
+// Only the links under the directory of the root listing on the same host are followed,
+// so the parent directory and the sorting links with a query are skipped.
+type Crawler struct {
+	outStream io.Writer
+	client    *http.Client
+	includes  []string
+	excludes  []string
+	maxDepth  int
+}
+
+// NewCrawler generates Crawler.
+// The files whose paths match any of includes and none of excludes are reported, and the subdirectories
+// which match any of excludes are not followed. The patterns are interpreted by path.Match against the path
+// relative to the root listing, or against the base name if the pattern has no "/".
+// The subdirectories deeper than maxDepth are not followed. A negative maxDepth means no limit.
+// The listings are requested by client, or http.DefaultClient if it is nil.
+func NewCrawler(w io.Writer, client *http.Client, includes []string, excludes []string, maxDepth int) *Crawler {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Crawler{
+		outStream: w,
+		client:    client,
+		includes:  includes,
+		excludes:  excludes,
+		maxDepth:  maxDepth,
+	}
+}
+
+// listing is a directory listing to be crawled.
+type listing struct {
+	url   *url.URL
+	depth int
+}
+
+// Crawl crawls the listings from root breadth-first and returns the files in the order they are found.
+func (c *Crawler) Crawl(ctx context.Context, root *url.URL) ([]*File, error) {
+	base, links, err := c.fetch(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	visited := map[string]bool{base.String(): true}
+	found := map[string]bool{}
+
+	var files []*File
+	var queue []*listing
+
+	collect := func(l *listing, links []*url.URL) error {
+		for _, u := range links {
+			rel, ok := relativePath(base, u)
+			if !ok || visited[u.String()] || found[u.String()] {
+				continue
+			}
+
+			if strings.HasSuffix(u.Path, "/") {
+				visited[u.String()] = true
+
+				excluded, err := matchAny(c.excludes, strings.TrimSuffix(rel, "/"))
+				if err != nil {
+					return err
+				}
+				if excluded || (c.maxDepth >= 0 && l.depth+1 > c.maxDepth) {
+					continue
+				}
+
+				queue = append(queue, &listing{url: u, depth: l.depth + 1})
+				continue
+			}
+
+			found[u.String()] = true
+
+			ok, err := c.match(rel)
+			if err != nil {
+				return err
+			}
+			if ok {
+				files = append(files, &File{URL: u, Path: rel})
+			}
+		}
+		return nil
+	}
+
+	err = collect(&listing{url: base}, links)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+
+		_, links, err := c.fetch(ctx, l.url)
+		if err != nil {
+			return nil, err
+		}
+
+		err = collect(l, links)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// match reports whether the file at rel matches any of the includes and none of the excludes.
+func (c *Crawler) match(rel string) (bool, error) {
+	if len(c.includes) > 0 {
+		included, err := matchAny(c.includes, rel)
+		if err != nil || !included {
+			return false, err
+		}
+	}
+
+	excluded, err := matchAny(c.excludes, rel)
+	if err != nil {
+		return false, err
+	}
+
+	return !excluded, nil
+}
+
+// fetch requests the listing at u and returns the URL after redirects and the links in the listing.
+func (c *Crawler) fetch(ctx context.Context, u *url.URL) (*url.URL, []*url.URL, error) {
+	fmt.Fprintf(c.outStream, "crawl: %s\n", u)
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s: unexpected status: %s", u, resp.Status)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" {
+		return nil, nil, fmt.Errorf("%s: not an HTML listing: %q", u, mediaType)
+	}
+
+	base := resp.Request.URL
+
+	links, err := extractLinks(base, resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", u, err)
+	}
+
+	return base, links, nil
+}
+
+// extractLinks returns the URLs of the links in the HTML read from r, resolved against base.
+// The URLs with a query are skipped, and the fragments are removed.
+func extractLinks(base *url.URL, r io.Reader) ([]*url.URL, error) {
+	var links []*url.URL
+
+	z := html.NewTokenizer(r)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return links, nil
+			}
+			return nil, z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" {
+				continue
+			}
+
+			for hasAttr {
+				var key, val []byte
+				key, val, hasAttr = z.TagAttr()
+				if string(key) != "href" {
+					continue
+				}
+
+				ref, err := url.Parse(strings.TrimSpace(string(val)))
+				if err != nil || ref.RawQuery != "" || ref.ForceQuery {
+					continue
+				}
+
+				u := base.ResolveReference(ref)
+				u.Fragment = ""
+
+				links = append(links, u)
+			}
+		}
+	}
+}
+
+// relativePath returns the path of u relative to the directory of base.
+// It reports false if u is on another host or outside the directory, including the path traversal with encoded slashes.
+func relativePath(base *url.URL, u *url.URL) (string, bool) {
+	if u.Scheme != base.Scheme || u.Host != base.Host {
+		return "", false
+	}
+
+	// Redirects such as the one adding the trailing slash are reflected in base.
+	prefix := base.Path[:strings.LastIndex(base.Path, "/")+1]
+	if u.Path == prefix {
+		return "", false
+	}
+
+	if !strings.HasPrefix(u.Path, prefix) {
+		return "", false
+	}
+
+	rel := strings.TrimPrefix(u.Path, prefix)
+
+	cleaned := path.Clean(rel)
+	if strings.HasSuffix(rel, "/") {
+		cleaned += "/"
+	}
+	if cleaned != rel || strings.HasPrefix(cleaned, "../") || cleaned == ".." {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// matchAny reports whether name matches any of patterns.
+// A pattern without "/" is matched against the base name.
+func matchAny(patterns []string, name string) (bool, error) {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+
+		matched, err := path.Match(pattern, target)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
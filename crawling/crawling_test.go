@@ -0,0 +1,143 @@
+package crawling
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// listings is an autoindex-like tree served by newListingServer. A key ending with "/" is a listing.
+var listings = map[string]string{
+	"/pub/": `<a href="../">../</a>
+<a href="?C=N;O=D">Name</a>
+<a href="a.txt">a.txt</a>
+<a href="b.log">b.log</a>
+<a href="sub/">sub/</a>
+<a href="old/">old/</a>
+<a href="http://other.example.com/pub/c.txt">c.txt</a>
+<a href="a.txt#top">a.txt</a>`,
+	"/pub/sub/":      `<a href="../">../</a><a href="c.txt">c.txt</a><a href="deep/">deep/</a><a href="/pub/sub/">self</a>`,
+	"/pub/sub/deep/": `<a href="d.txt">d.txt</a><a href="..%2F..%2F..%2Fsecret.txt">secret.txt</a>`,
+	"/pub/old/":      `<a href="e.txt">e.txt</a>`,
+}
+
+func newListingServer(t *testing.T) (*httptest.Server, func()) {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pub" {
+			http.Redirect(w, r, "/pub/", http.StatusMovedPermanently)
+			return
+		}
+
+		body, ok := listings[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}))
+
+	return ts, ts.Close
+}
+
+func crawl(t *testing.T, c *Crawler, root string) []string {
+	t.Helper()
+
+	u, err := url.Parse(root)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	files, err := c.Crawl(context.Background(), u)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var paths []string
+	for _, f := range files {
+		if f.URL.Path != "/pub/"+f.Path {
+			t.Errorf("unexpected URL of %s: %s", f.Path, f.URL)
+		}
+		paths = append(paths, f.Path)
+	}
+
+	return paths
+}
+
+func TestCrawling_Crawl(t *testing.T) {
+	ts, clean := newListingServer(t)
+	defer clean()
+
+	cases := map[string]struct {
+		includes []string
+		excludes []string
+		maxDepth int
+		expected []string
+	}{
+		"all":               {maxDepth: -1, expected: []string{"a.txt", "b.log", "sub/c.txt", "old/e.txt", "sub/deep/d.txt"}},
+		"depth 0":           {maxDepth: 0, expected: []string{"a.txt", "b.log"}},
+		"depth 1":           {maxDepth: 1, expected: []string{"a.txt", "b.log", "sub/c.txt", "old/e.txt"}},
+		"include base name": {includes: []string{"*.txt"}, maxDepth: -1, expected: []string{"a.txt", "sub/c.txt", "old/e.txt", "sub/deep/d.txt"}},
+		"include path":      {includes: []string{"sub/*"}, maxDepth: -1, expected: []string{"sub/c.txt"}},
+		"exclude directory": {excludes: []string{"old", "deep"}, maxDepth: -1, expected: []string{"a.txt", "b.log", "sub/c.txt"}},
+		"exclude file":      {excludes: []string{"*.log"}, maxDepth: 0, expected: []string{"a.txt"}},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			actual := crawl(t, NewCrawler(ioutil.Discard, nil, c.includes, c.excludes, c.maxDepth), ts.URL+"/pub")
+
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("unexpected files: expected: %q actual: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCrawling_Crawl_NotHTML(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		fmt.Fprint(w, "binary")
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/a.bin")
+
+	_, err := NewCrawler(ioutil.Discard, nil, nil, nil, -1).Crawl(context.Background(), u)
+
+	expected := fmt.Sprintf(`%s: not an HTML listing: "application/octet-stream"`, u)
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
+
+func TestCrawling_Crawl_Client(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere/", http.StatusFound)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/pub/")
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return errors.New("redirect is not followed")
+	}}
+
+	_, err := NewCrawler(ioutil.Discard, client, nil, nil, -1).Crawl(context.Background(), u)
+
+	expected := "redirect is not followed"
+	if err == nil || !strings.HasSuffix(err.Error(), expected) {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
@@ -0,0 +1,752 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// aria2Version is the version of aria2 whose JSON-RPC interface is implemented, which the tools for aria2 may check.
+const aria2Version = "1.37.0"
+
+// The error codes of JSON-RPC. The errors of the methods are 1 like aria2.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcFailure        = 1
+)
+
+// rpcMethods are the implemented methods, which are listed by system.listMethods.
+var rpcMethods = []string{
+	"aria2.addUri",
+	"aria2.remove",
+	"aria2.forceRemove",
+	"aria2.pause",
+	"aria2.forcePause",
+	"aria2.pauseAll",
+	"aria2.forcePauseAll",
+	"aria2.unpause",
+	"aria2.unpauseAll",
+	"aria2.tellStatus",
+	"aria2.getUris",
+	"aria2.getFiles",
+	"aria2.tellActive",
+	"aria2.tellWaiting",
+	"aria2.tellStopped",
+	"aria2.getGlobalStat",
+	"aria2.purgeDownloadResult",
+	"aria2.removeDownloadResult",
+	"aria2.getVersion",
+	"aria2.saveSession",
+	"system.multicall",
+	"system.listMethods",
+	"system.listNotifications",
+}
+
+// rpcNotifications are the notifications sent to the WebSocket clients by the state which the download changes to.
+var rpcNotifications = map[State]string{
+	Running:   "aria2.onDownloadStart",
+	Paused:    "aria2.onDownloadPause",
+	Removed:   "aria2.onDownloadStop",
+	Completed: "aria2.onDownloadComplete",
+	Failed:    "aria2.onDownloadError",
+}
+
+// aria2Statuses are the statuses of aria2 by the state of the download.
+var aria2Statuses = map[State]string{
+	Queued:    "waiting",
+	Running:   "active",
+	Paused:    "paused",
+	Completed: "complete",
+	Failed:    "error",
+	Removed:   "removed",
+}
+
+// rpcRequest is a request of JSON-RPC 2.0.
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+// rpcResponse is a response of JSON-RPC 2.0. ID is null if the request could not be parsed.
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcNotification is a notification of JSON-RPC 2.0 sent to the WebSocket clients.
+type rpcNotification struct {
+	JSONRPC string        `json:"jsonrpc"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+// rpcError is the error of JSON-RPC 2.0.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcServer serves the JSON-RPC interface of aria2 on the queue.
+type rpcServer struct {
+	q      *Queue
+	secret string
+}
+
+// NewRPCHandler returns the handler of the commonly used subset of the JSON-RPC interface of aria2 to control q,
+// so that the tools for aria2 can use the daemon instead. The IDs of the downloads are the GIDs in hex.
+//
+//	POST /jsonrpc  calls the method, or the methods of a batch request.
+//	GET  /jsonrpc  calls the methods over WebSocket, which notifies the changes of the downloads.
+//
+// Unless secret is empty, the methods of aria2 require it as "token:secret" in the first parameter like --rpc-secret of aria2.
+// Without secret, the requests from the pages of other sites are refused.
+func NewRPCHandler(q *Queue, secret string) http.Handler {
+	s := &rpcServer{q: q, secret: secret}
+
+	ws := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if !s.allowed(r) {
+				return errCrossOrigin
+			}
+			return nil
+		},
+		Handler: s.serveWebSocket,
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/jsonrpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			ws.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+			return
+		}
+
+		if !s.allowed(r) {
+			writeError(w, http.StatusForbidden, errCrossOrigin)
+			return
+		}
+
+		var body json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "Parse error."}})
+			return
+		}
+
+		resp := s.handle(body)
+
+		// A failed call is 400 like aria2, and a batch request is 200 whatever its calls result in.
+		code := http.StatusOK
+		if r, ok := resp.(*rpcResponse); ok && r.Error != nil {
+			code = http.StatusBadRequest
+		}
+
+		writeJSON(w, code, resp)
+	})
+
+	return mux
+}
+
+// allowed reports whether the request is allowed to control the daemon.
+// The secret is required from the pages of other sites since the browser sends them to localhost.
+func (s *rpcServer) allowed(r *http.Request) bool {
+	return s.secret != "" || isLocalRequest(r)
+}
+
+// serveWebSocket calls the methods received over ws, and notifies the changes of the downloads until ws is closed.
+func (s *rpcServer) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+
+	events, unsubscribe := s.q.Subscribe()
+	defer unsubscribe()
+
+	var mu sync.Mutex
+	send := func(v interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return websocket.JSON.Send(ws, v)
+	}
+
+	go func() {
+		for j := range events {
+			method, ok := rpcNotifications[j.State]
+			if !ok {
+				continue
+			}
+			err := send(&rpcNotification{JSONRPC: "2.0", Method: method, Params: []interface{}{map[string]string{"gid": gid(j.ID)}}})
+			if err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			return
+		}
+
+		err = send(s.handle(msg))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle calls the method of the request in body, or the methods of the batch request, and returns the response.
+func (s *rpcServer) handle(body []byte) interface{} {
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var batch []json.RawMessage
+		err := json.Unmarshal(body, &batch)
+		if err != nil {
+			return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcParseError, Message: "Parse error."}}
+		}
+
+		resps := []*rpcResponse{}
+		for _, b := range batch {
+			resps = append(resps, s.handleRequest(b))
+		}
+		return resps
+	}
+
+	return s.handleRequest(body)
+}
+
+// handleRequest calls the method of the request in body, and returns the response.
+func (s *rpcServer) handleRequest(body []byte) *rpcResponse {
+	var req rpcRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return &rpcResponse{JSONRPC: "2.0", Error: &rpcError{Code: rpcInvalidRequest, Message: "Invalid Request."}}
+	}
+
+	resp := &rpcResponse{JSONRPC: "2.0", ID: req.ID}
+
+	result, err := s.call(req.Method, req.Params)
+	if err != nil {
+		e, ok := err.(*rpcError)
+		if !ok {
+			e = &rpcError{Code: rpcFailure, Message: err.Error()}
+		}
+		resp.Error = e
+		return resp
+	}
+
+	resp.Result = result
+	return resp
+}
+
+// call calls the method with params, and returns its result.
+func (s *rpcServer) call(method string, params []json.RawMessage) (interface{}, error) {
+	if strings.HasPrefix(method, "aria2.") {
+		var err error
+		params, err = s.authorize(params)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch method {
+	case "aria2.addUri":
+		return s.addURI(params)
+	case "aria2.remove", "aria2.forceRemove":
+		return s.remove(params)
+	case "aria2.pause", "aria2.forcePause":
+		return s.withGID(params, func(id int) error { _, err := s.q.Pause(id); return err })
+	case "aria2.pauseAll", "aria2.forcePauseAll":
+		return s.all(func(j *Job) bool { return j.State == Queued || j.State == Running }, func(id int) error { _, err := s.q.Pause(id); return err })
+	case "aria2.unpause":
+		return s.withGID(params, func(id int) error { _, err := s.q.Resume(id); return err })
+	case "aria2.unpauseAll":
+		return s.all(func(j *Job) bool { return j.State == Paused }, func(id int) error { _, err := s.q.Resume(id); return err })
+	case "aria2.tellStatus":
+		return s.tellStatus(params)
+	case "aria2.getUris":
+		return s.withJob(params, func(j *Job) interface{} { return uris(j) })
+	case "aria2.getFiles":
+		return s.withJob(params, func(j *Job) interface{} { return s.files(j) })
+	case "aria2.tellActive":
+		return s.tell(params, -1, func(j *Job) bool { return j.State == Running })
+	case "aria2.tellWaiting":
+		return s.tell(params, 0, func(j *Job) bool { return j.State == Queued || j.State == Paused })
+	case "aria2.tellStopped":
+		return s.tell(params, 0, func(j *Job) bool { return j.State == Completed || j.State == Failed || j.State == Removed })
+	case "aria2.getGlobalStat":
+		return s.globalStat(), nil
+	case "aria2.purgeDownloadResult":
+		return s.purge(func(j *Job) bool { return true })
+	case "aria2.removeDownloadResult":
+		return s.removeDownloadResult(params)
+	case "aria2.getVersion":
+		return map[string]interface{}{"version": aria2Version, "enabledFeatures": []string{}}, nil
+	case "aria2.saveSession":
+		// The queue is saved whenever it changes.
+		return "OK", nil
+	case "system.multicall":
+		return s.multicall(params)
+	case "system.listMethods":
+		return rpcMethods, nil
+	case "system.listNotifications":
+		var notifications []string
+		for _, n := range rpcNotifications {
+			notifications = append(notifications, n)
+		}
+		sort.Strings(notifications)
+		return notifications, nil
+	default:
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "Method not found."}
+	}
+}
+
+// authorize checks the secret token in the first parameter, and returns the parameters without it.
+// The token is removed even if no secret is required, as aria2 does.
+func (s *rpcServer) authorize(params []json.RawMessage) ([]json.RawMessage, error) {
+	var token string
+	if len(params) > 0 && json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+		params = params[1:]
+	} else {
+		token = ""
+	}
+
+	if s.secret == "" {
+		return params, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte("token:"+s.secret)) != 1 {
+		return nil, &rpcError{Code: rpcFailure, Message: "Unauthorized"}
+	}
+
+	return params, nil
+}
+
+// param decodes the i-th parameter into v, and reports whether it is present.
+func param(params []json.RawMessage, i int, v interface{}) (bool, error) {
+	if i >= len(params) {
+		return false, nil
+	}
+
+	err := json.Unmarshal(params[i], v)
+	if err != nil {
+		return false, &rpcError{Code: rpcInvalidParams, Message: fmt.Sprintf("Invalid params: %d: %s", i, err)}
+	}
+
+	return true, nil
+}
+
+// gid returns the GID of the download of id.
+func gid(id int) string {
+	return fmt.Sprintf("%016x", id)
+}
+
+// parseGID returns the ID of the download of the GID in the first parameter.
+func parseGID(params []json.RawMessage) (int, string, error) {
+	var g string
+	ok, err := param(params, 0, &g)
+	if err != nil {
+		return 0, "", err
+	}
+	if !ok {
+		return 0, "", &rpcError{Code: rpcInvalidParams, Message: "GID is not given"}
+	}
+
+	id, err := strconv.ParseInt(g, 16, 64)
+	if err != nil || id < 1 {
+		return 0, g, fmt.Errorf("GID %s is not found", g)
+	}
+
+	return int(id), g, nil
+}
+
+// addURI adds the download of the URIs, which are the mirrors of the same file.
+// The options dir, out, split and max-connection-per-server are supported, and the others are ignored.
+func (s *rpcServer) addURI(params []json.RawMessage) (interface{}, error) {
+	var urls []string
+	_, err := param(params, 0, &urls)
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "URI is not given"}
+	}
+
+	// The values are strings in aria2, but some tools send numbers.
+	var options map[string]interface{}
+	_, err = param(params, 1, &options)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Job{URL: urls[0], Mirrors: urls[1:]}
+
+	for k, v := range options {
+		value := fmt.Sprint(v)
+		switch k {
+		case "dir":
+			j.Dir = value
+		case "out":
+			j.Output = value
+		case "split", "max-connection-per-server":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number: %q", k, value)
+			}
+			// The number of the connections is split limited by max-connection-per-server, so the smaller one is taken.
+			if n > 0 && (j.Parallelism == 0 || n < j.Parallelism) {
+				j.Parallelism = n
+			}
+		}
+	}
+
+	added, err := s.q.Add(j)
+	if err != nil {
+		return nil, err
+	}
+
+	return gid(added.ID), nil
+}
+
+// remove removes the download of the GID, which the queue keeps as removed for aria2.tellStatus.
+func (s *rpcServer) remove(params []json.RawMessage) (interface{}, error) {
+	return s.withGID(params, s.q.Remove)
+}
+
+// withGID calls fn with the ID of the download of the GID, and returns the GID.
+func (s *rpcServer) withGID(params []json.RawMessage, fn func(id int) error) (interface{}, error) {
+	id, g, err := parseGID(params)
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(id)
+	if err == errJobNotFound {
+		return nil, fmt.Errorf("GID %s is not found", g)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// all calls fn with the IDs of the downloads which match, and returns "OK".
+func (s *rpcServer) all(match func(j *Job) bool, fn func(id int) error) (interface{}, error) {
+	for _, j := range s.q.List() {
+		if match(j) {
+			// The download may have finished after it was listed.
+			fn(j.ID)
+		}
+	}
+	return "OK", nil
+}
+
+// job returns the download of the GID in the first parameter, including the removed ones.
+func (s *rpcServer) job(params []json.RawMessage) (*Job, error) {
+	id, g, err := parseGID(params)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := s.q.Get(id)
+	if err == nil {
+		return j, nil
+	}
+
+	for _, j := range s.q.Removed() {
+		if j.ID == id {
+			return j, nil
+		}
+	}
+
+	return nil, fmt.Errorf("GID %s is not found", g)
+}
+
+// withJob returns what fn returns for the download of the GID.
+func (s *rpcServer) withJob(params []json.RawMessage, fn func(j *Job) interface{}) (interface{}, error) {
+	j, err := s.job(params)
+	if err != nil {
+		return nil, err
+	}
+	return fn(j), nil
+}
+
+// tellStatus returns the status of the download of the GID, with only the keys in the second parameter if they are given.
+func (s *rpcServer) tellStatus(params []json.RawMessage) (interface{}, error) {
+	j, err := s.job(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	_, err = param(params, 1, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterKeys(s.status(j), keys), nil
+}
+
+// tell returns the statuses of the downloads which match.
+// The parameters are the offset, the number of the downloads and the keys, which start at first.
+// If first is negative, there is no offset nor number, as for aria2.tellActive.
+// A negative offset is from the last download, and the downloads are in reverse order like aria2.
+func (s *rpcServer) tell(params []json.RawMessage, first int, match func(j *Job) bool) (interface{}, error) {
+	offset, num, keysIndex := 0, -1, 0
+	if first >= 0 {
+		_, err := param(params, first, &offset)
+		if err != nil {
+			return nil, err
+		}
+		num = 0
+		_, err = param(params, first+1, &num)
+		if err != nil {
+			return nil, err
+		}
+		keysIndex = first + 2
+	}
+
+	var keys []string
+	_, err := param(params, keysIndex, &keys)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := append(s.q.List(), s.q.Removed()...)
+
+	var matched []*Job
+	for _, j := range jobs {
+		if match(j) {
+			matched = append(matched, j)
+		}
+	}
+
+	if offset < 0 {
+		for a, b := 0, len(matched)-1; a < b; a, b = a+1, b-1 {
+			matched[a], matched[b] = matched[b], matched[a]
+		}
+		offset = -offset - 1
+	}
+
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	matched = matched[offset:]
+
+	if num >= 0 && num < len(matched) {
+		matched = matched[:num]
+	}
+
+	statuses := []map[string]interface{}{}
+	for _, j := range matched {
+		statuses = append(statuses, filterKeys(s.status(j), keys))
+	}
+
+	return statuses, nil
+}
+
+// status returns the status of j in the format of aria2, whose numbers are strings.
+func (s *rpcServer) status(j *Job) map[string]interface{} {
+	status := map[string]interface{}{
+		"gid":             gid(j.ID),
+		"status":          aria2Statuses[j.State],
+		"totalLength":     strconv.FormatInt(j.Length, 10),
+		"completedLength": strconv.FormatInt(j.Received, 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatInt(j.Speed, 10),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(len(j.Ranges)),
+		"dir":             s.dir(j),
+		"files":           s.files(j),
+	}
+
+	switch j.State {
+	case Completed:
+		status["errorCode"] = "0"
+		status["errorMessage"] = ""
+	case Failed:
+		status["errorCode"] = "1"
+		status["errorMessage"] = j.Error
+	}
+
+	return status
+}
+
+// filterKeys returns status with only the keys, or status itself if no keys are given.
+func filterKeys(status map[string]interface{}, keys []string) map[string]interface{} {
+	if len(keys) == 0 {
+		return status
+	}
+
+	filtered := map[string]interface{}{}
+	for _, k := range keys {
+		if v, ok := status[k]; ok {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// dir returns the directory to save the file of j.
+func (s *rpcServer) dir(j *Job) string {
+	if j.Dir != "" {
+		return j.Dir
+	}
+	return s.q.defaults.Dir
+}
+
+// files returns the file of j in the format of aria2.
+// The path is empty until it is decided, unless the output is given.
+func (s *rpcServer) files(j *Job) []map[string]interface{} {
+	path := j.Path
+	if path == "" && j.Output != "" {
+		path = j.Output
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(s.dir(j), path)
+		}
+	}
+
+	return []map[string]interface{}{{
+		"index":           "1",
+		"path":            path,
+		"length":          strconv.FormatInt(j.Length, 10),
+		"completedLength": strconv.FormatInt(j.Received, 10),
+		"selected":        "true",
+		"uris":            uris(j),
+	}}
+}
+
+// uris returns the URL and the mirrors of j in the format of aria2.
+func uris(j *Job) []map[string]string {
+	status := "waiting"
+	if j.State == Running {
+		status = "used"
+	}
+
+	var uris []map[string]string
+	for _, u := range append([]string{j.URL}, j.Mirrors...) {
+		uris = append(uris, map[string]string{"uri": u, "status": status})
+	}
+	return uris
+}
+
+// globalStat returns the overall download speed and the numbers of the downloads by status.
+func (s *rpcServer) globalStat() map[string]string {
+	var speed int64
+	var active, waiting, stopped int
+	for _, j := range append(s.q.List(), s.q.Removed()...) {
+		switch j.State {
+		case Running:
+			active++
+			speed += j.Speed
+		case Queued, Paused:
+			waiting++
+		default:
+			stopped++
+		}
+	}
+
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}
+}
+
+// removeDownloadResult forgets the completed, failed or removed download of the GID.
+func (s *rpcServer) removeDownloadResult(params []json.RawMessage) (interface{}, error) {
+	id, g, err := parseGID(params)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+	_, err = s.purge(func(j *Job) bool {
+		if j.ID == id {
+			found = true
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("could not remove download result of GID %s", g)
+	}
+
+	return "OK", nil
+}
+
+// purge forgets the completed, failed or removed downloads which match, and returns "OK".
+func (s *rpcServer) purge(match func(j *Job) bool) (interface{}, error) {
+	for _, j := range append(s.q.List(), s.q.Removed()...) {
+		if (j.State == Completed || j.State == Failed || j.State == Removed) && match(j) {
+			// The download may have been resumed or forgotten after it was listed.
+			s.q.Forget(j.ID)
+		}
+	}
+
+	return "OK", nil
+}
+
+// multicall calls the methods in the first parameter, and returns their results each wrapped in an array, or their errors.
+func (s *rpcServer) multicall(params []json.RawMessage) (interface{}, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	_, err := param(params, 0, &calls)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []interface{}{}
+	for _, c := range calls {
+		if c.MethodName == "system.multicall" {
+			results = append(results, &rpcError{Code: rpcFailure, Message: "Recursive system.multicall forbidden."})
+			continue
+		}
+
+		result, err := s.call(c.MethodName, c.Params)
+		if err != nil {
+			e, ok := err.(*rpcError)
+			if !ok {
+				e = &rpcError{Code: rpcFailure, Message: err.Error()}
+			}
+			results = append(results, e)
+			continue
+		}
+
+		results = append(results, []interface{}{result})
+	}
+
+	return results, nil
+}
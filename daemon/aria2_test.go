@@ -0,0 +1,446 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+	"golang.org/x/net/websocket"
+)
+
+func TestDaemon_RPC_Download(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "foo.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	ts := httptest.NewServer(NewRPCHandler(q, "secret"))
+	defer ts.Close()
+
+	var g string
+	callRPC(t, ts.URL, "aria2.addUri", &g, "token:secret", []string{origin.URL + "/foo.txt"}, map[string]interface{}{"out": "foo.txt", "split": "3"})
+	if g != "0000000000000001" {
+		t.Errorf("unexpected GID: expected: %q actual: %q", "0000000000000001", g)
+	}
+
+	waitState(t, q, 1, Completed)
+
+	var status map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellStatus", &status, "token:secret", g)
+
+	expected := map[string]interface{}{
+		"gid":             g,
+		"status":          "complete",
+		"totalLength":     "36",
+		"completedLength": "36",
+		"dir":             q.defaults.Dir,
+		"errorCode":       "0",
+	}
+	for k, v := range expected {
+		if status[k] != v {
+			t.Errorf("unexpected %s: expected: %v actual: %v", k, v, status[k])
+		}
+	}
+
+	files := status["files"].([]interface{})
+	if path := files[0].(map[string]interface{})["path"]; path != q.defaults.Dir+"/foo.txt" {
+		t.Errorf("unexpected path: expected: %q actual: %v", q.defaults.Dir+"/foo.txt", path)
+	}
+
+	status = nil
+	callRPC(t, ts.URL, "aria2.tellStatus", &status, "token:secret", g, []string{"gid", "status"})
+	if expected := map[string]interface{}{"gid": g, "status": "complete"}; !reflect.DeepEqual(status, expected) {
+		t.Errorf("unexpected status: expected: %v actual: %v", expected, status)
+	}
+
+	var stopped []map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellStopped", &stopped, "token:secret", 0, 10, []string{"gid"})
+	if expected := []map[string]interface{}{{"gid": g}}; !reflect.DeepEqual(stopped, expected) {
+		t.Errorf("unexpected stopped downloads: expected: %v actual: %v", expected, stopped)
+	}
+
+	var ok string
+	callRPC(t, ts.URL, "aria2.removeDownloadResult", &ok, "token:secret", g)
+
+	err := rpcCall(ts.URL, "aria2.tellStatus", nil, "token:secret", g)
+	if expected := "GID 0000000000000001 is not found"; err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
+
+func TestDaemon_RPC_AddURIParallelism(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewRPCHandler(q, ""))
+	defer ts.Close()
+
+	cases := map[string]struct {
+		options  map[string]interface{}
+		expected int
+	}{
+		"none":                      {options: map[string]interface{}{}, expected: 0},
+		"split":                     {options: map[string]interface{}{"split": "5"}, expected: 5},
+		"max-connection-per-server": {options: map[string]interface{}{"max-connection-per-server": 3}, expected: 3},
+		"split is smaller":          {options: map[string]interface{}{"split": "2", "max-connection-per-server": "16"}, expected: 2},
+		"max-connection is smaller": {options: map[string]interface{}{"split": "16", "max-connection-per-server": "4"}, expected: 4},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			var g string
+			callRPC(t, ts.URL, "aria2.addUri", &g, []string{"http://example.com/foo.png"}, c.options)
+
+			id, err := strconv.ParseInt(g, 16, 64)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			j, err := q.Get(int(id))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if j.Parallelism != c.expected {
+				t.Errorf("unexpected parallelism: expected: %d actual: %d", c.expected, j.Parallelism)
+			}
+		})
+	}
+}
+
+func TestDaemon_RPC_PauseRemove(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	ts := httptest.NewServer(NewRPCHandler(q, ""))
+	defer ts.Close()
+
+	var running, waiting string
+	callRPC(t, ts.URL, "aria2.addUri", &running, []string{"http://example.com/foo.png", "http://mirror.example.com/foo.png"})
+	waitState(t, q, 1, Running)
+	callRPC(t, ts.URL, "aria2.addUri", &waiting, []string{"http://example.com/bar.png"})
+
+	var active []map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellActive", &active, []string{"gid", "status"})
+	if expected := []map[string]interface{}{{"gid": running, "status": "active"}}; !reflect.DeepEqual(active, expected) {
+		t.Errorf("unexpected active downloads: expected: %v actual: %v", expected, active)
+	}
+
+	var uris []map[string]string
+	callRPC(t, ts.URL, "aria2.getUris", &uris, running)
+	expectedURIs := []map[string]string{
+		{"uri": "http://example.com/foo.png", "status": "used"},
+		{"uri": "http://mirror.example.com/foo.png", "status": "used"},
+	}
+	if !reflect.DeepEqual(uris, expectedURIs) {
+		t.Errorf("unexpected URIs: expected: %v actual: %v", expectedURIs, uris)
+	}
+
+	var waitings []map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellWaiting", &waitings, 0, 10, []string{"gid", "status"})
+	if expected := []map[string]interface{}{{"gid": waiting, "status": "waiting"}}; !reflect.DeepEqual(waitings, expected) {
+		t.Errorf("unexpected waiting downloads: expected: %v actual: %v", expected, waitings)
+	}
+
+	var g string
+	callRPC(t, ts.URL, "aria2.pause", &g, running)
+	waitState(t, q, 1, Paused)
+
+	callRPC(t, ts.URL, "aria2.remove", &g, running)
+
+	var status map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellStatus", &status, running, []string{"status"})
+	if status["status"] != "removed" {
+		t.Errorf("unexpected status: expected: removed actual: %v", status["status"])
+	}
+
+	cases := map[string]struct {
+		method   string
+		params   []interface{}
+		expected string
+	}{
+		"missing GID":       {method: "aria2.pause", params: []interface{}{"00000000000000ff"}, expected: "GID 00000000000000ff is not found"},
+		"invalid GID":       {method: "aria2.tellStatus", params: []interface{}{"foo"}, expected: "GID foo is not found"},
+		"unsupported URL":   {method: "aria2.addUri", params: []interface{}{[]string{"ftp2://example.com/foo"}}, expected: "unsupported URL: ftp2://example.com/foo"},
+		"no URI":            {method: "aria2.addUri", params: []interface{}{[]string{}}, expected: "URI is not given"},
+		"unknown method":    {method: "aria2.addTorrent", params: []interface{}{"foo"}, expected: "Method not found."},
+		"not paused":        {method: "aria2.unpause", params: []interface{}{waiting}, expected: "download 2 is running"},
+		"invalid parameter": {method: "aria2.tellWaiting", params: []interface{}{"foo", 1}, expected: "Invalid params: 0: json: cannot unmarshal string into Go value of type int"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			if c.method == "aria2.unpause" {
+				waitState(t, q, 2, Running)
+			}
+			err := rpcCall(ts.URL, c.method, nil, c.params...)
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestDaemon_RPC_RemovedByAPI(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewRPCHandler(q, ""))
+	defer ts.Close()
+
+	j, err := q.Add(&Job{URL: "http://example.com/foo.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	err = q.Remove(j.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var stopped []map[string]interface{}
+	callRPC(t, ts.URL, "aria2.tellStopped", &stopped, 0, 10, []string{"gid", "status"})
+	if expected := []map[string]interface{}{{"gid": "0000000000000001", "status": "removed"}}; !reflect.DeepEqual(stopped, expected) {
+		t.Errorf("unexpected stopped downloads: expected: %v actual: %v", expected, stopped)
+	}
+
+	var stat map[string]string
+	callRPC(t, ts.URL, "aria2.getGlobalStat", &stat)
+	if stat["numStopped"] != "1" {
+		t.Errorf("unexpected numStopped: expected: 1 actual: %s", stat["numStopped"])
+	}
+
+	// The removed downloads are restored from the state file.
+	restored, err := NewQueue(ioutil.Discard, &opt.DaemonOptions{State: q.state})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if removed := restored.Removed(); len(removed) != 1 || removed[0].ID != j.ID {
+		t.Errorf("unexpected removed downloads: expected: [%d] actual: %v", j.ID, removed)
+	}
+
+	var ok string
+	callRPC(t, ts.URL, "aria2.purgeDownloadResult", &ok)
+
+	stopped = nil
+	callRPC(t, ts.URL, "aria2.tellStopped", &stopped, 0, 10)
+	if len(stopped) != 0 {
+		t.Errorf("unexpected stopped downloads: expected: [] actual: %v", stopped)
+	}
+}
+
+func TestDaemon_RPC_Secret(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewRPCHandler(q, "secret"))
+	defer ts.Close()
+
+	cases := map[string]struct {
+		params   []interface{}
+		expected string
+	}{
+		"no token":    {params: []interface{}{}, expected: "Unauthorized"},
+		"wrong token": {params: []interface{}{"token:wrong"}, expected: "Unauthorized"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			err := rpcCall(ts.URL, "aria2.getGlobalStat", nil, c.params...)
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+
+	// The methods of the system do not require the token.
+	var methods []string
+	callRPC(t, ts.URL, "system.listMethods", &methods)
+	if !reflect.DeepEqual(methods, rpcMethods) {
+		t.Errorf("unexpected methods: expected: %v actual: %v", rpcMethods, methods)
+	}
+
+	var results []interface{}
+	callRPC(t, ts.URL, "system.multicall", &results, []map[string]interface{}{
+		{"methodName": "aria2.getVersion", "params": []string{"token:secret"}},
+		{"methodName": "aria2.getVersion", "params": []string{}},
+	})
+	version := results[0].([]interface{})[0].(map[string]interface{})["version"]
+	if version != aria2Version {
+		t.Errorf("unexpected version: expected: %s actual: %v", aria2Version, version)
+	}
+	if message := results[1].(map[string]interface{})["message"]; message != "Unauthorized" {
+		t.Errorf("unexpected error: expected: Unauthorized actual: %v", message)
+	}
+}
+
+func TestDaemon_RPC_Batch(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewRPCHandler(q, ""))
+	defer ts.Close()
+
+	body := `[{"jsonrpc":"2.0","id":"a","method":"aria2.getGlobalStat"},{"jsonrpc":"2.0","id":"b","method":"aria2.unknown"}]`
+	resp, err := http.Post(ts.URL+"/jsonrpc", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer resp.Body.Close()
+
+	var resps []rpcResponse
+	err = json.NewDecoder(resp.Body).Decode(&resps)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if len(resps) != 2 || string(resps[0].ID) != `"a"` || resps[0].Error != nil || string(resps[1].ID) != `"b"` || resps[1].Error.Code != rpcMethodNotFound {
+		t.Errorf("unexpected responses: %+v", resps)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/jsonrpc", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"aria2.getGlobalStat"}`))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	req.Header.Set("Origin", "http://example.com")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status code: expected: %d actual: %d", http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestDaemon_RPC_WebSocket(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		return nil
+	})
+
+	ts := httptest.NewServer(NewRPCHandler(q, ""))
+	defer ts.Close()
+
+	ws, err := websocket.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/jsonrpc", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer ws.Close()
+
+	err = websocket.JSON.Send(ws, map[string]interface{}{"jsonrpc": "2.0", "id": "1", "method": "aria2.addUri", "params": []interface{}{[]string{"http://example.com/foo.png"}}})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var resp rpcResponse
+	err = websocket.JSON.Receive(ws, &resp)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if resp.Result != "0000000000000001" {
+		t.Errorf("unexpected result: expected: %q actual: %v", "0000000000000001", resp.Result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	var actual []string
+	for len(actual) < 2 {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var n rpcNotification
+		err := websocket.JSON.Receive(ws, &n)
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		actual = append(actual, n.Method+" "+n.Params[0].(map[string]interface{})["gid"].(string))
+	}
+
+	expected := []string{"aria2.onDownloadStart 0000000000000001", "aria2.onDownloadComplete 0000000000000001"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected notifications: expected: %v actual: %v", expected, actual)
+	}
+
+	_, err = websocket.Dial(strings.Replace(ts.URL, "http", "ws", 1)+"/jsonrpc", "", "http://example.com/")
+	if err == nil {
+		t.Errorf("unexpected connection from another site")
+	}
+}
+
+// callRPC calls the method of the JSON-RPC at baseURL, and decodes its result into out.
+func callRPC(t *testing.T, baseURL string, method string, out interface{}, params ...interface{}) {
+	t.Helper()
+
+	err := rpcCall(baseURL, method, out, params...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+}
+
+// rpcCall calls the method of the JSON-RPC at baseURL, and decodes its result into out unless it is nil.
+func rpcCall(baseURL string, method string, out interface{}, params ...interface{}) error {
+	b, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": "1", "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(baseURL+"/jsonrpc", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return err
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.Unmarshal(r.Result, out)
+}
@@ -0,0 +1,130 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Client calls the JSON API of the daemon.
+type Client struct {
+	baseURL string
+	secret  string
+	client  *http.Client
+}
+
+// NewClient returns Client of the daemon at addr, which is an address of localhost or a Unix domain socket prefixed by "unix:".
+// The requests have secret as the bearer token unless it is empty.
+func NewClient(addr string, secret string) *Client {
+	if strings.HasPrefix(addr, unixPrefix) {
+		socket := strings.TrimPrefix(addr, unixPrefix)
+
+		t := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+
+		return &Client{baseURL: "http://localhost", secret: secret, client: &http.Client{Transport: t}}
+	}
+
+	return &Client{baseURL: "http://" + addr, secret: secret, client: &http.Client{}}
+}
+
+// Add adds the download of j, and returns it with its ID.
+func (c *Client) Add(ctx context.Context, j *Job) (*Job, error) {
+	var added Job
+	err := c.call(ctx, http.MethodPost, "/api/downloads", j, &added)
+	if err != nil {
+		return nil, err
+	}
+	return &added, nil
+}
+
+// List returns the downloads in order of priority.
+func (c *Client) List(ctx context.Context) ([]*Job, error) {
+	var jobs []*Job
+	err := c.call(ctx, http.MethodGet, "/api/downloads", nil, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Pause pauses the download of id.
+func (c *Client) Pause(ctx context.Context, id int) (*Job, error) {
+	var j Job
+	err := c.call(ctx, http.MethodPost, fmt.Sprintf("/api/downloads/%d/pause", id), nil, &j)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Resume resumes the download of id.
+func (c *Client) Resume(ctx context.Context, id int) (*Job, error) {
+	var j Job
+	err := c.call(ctx, http.MethodPost, fmt.Sprintf("/api/downloads/%d/resume", id), nil, &j)
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// Remove removes the download of id.
+func (c *Client) Remove(ctx context.Context, id int) error {
+	return c.call(ctx, http.MethodDelete, fmt.Sprintf("/api/downloads/%d", id), nil, nil)
+}
+
+// call sends in as the JSON body of the request to the path, and decodes the JSON response into out unless it is nil.
+// The error of the response is returned as error.
+func (c *Client) call(ctx context.Context, method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.secret)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e apiError
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		return errors.New(e.Error)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errNoStreaming = errors.New("streaming is not supported")
+
+// dashboardInterval is the interval to send the downloads to the dashboard, which is overridden in tests.
+var dashboardInterval = time.Second
+
+// serveDashboard serves the web dashboard, which shows the downloads sent by serveEvents and controls them by the JSON API.
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	// The buttons are not clicked through a frame of another site.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+// serveEvents sends the downloads as the server-sent event "downloads" every dashboardInterval,
+// and immediately whenever a download changes its state, until the client disconnects.
+func serveEvents(q *Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, errNoStreaming)
+			return
+		}
+
+		events, unsubscribe := q.Subscribe()
+		defer unsubscribe()
+
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		for {
+			b, err := json.Marshal(q.List())
+			if err != nil {
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "event: downloads\ndata: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-events:
+			case <-ticker.C:
+			}
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package daemon
+
+// dashboardHTML is the page of the web dashboard, which is embedded in the binary.
+// It receives the downloads from /api/events, keeps their speeds for the throughput graphs,
+// and pauses, resumes and cancels them by the JSON API, sending the secret token in the query of the page.
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>parallel-download</title>
+<style>
+  body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; margin: 0; background: #f6f8fa; color: #24292e; }
+  header { background: #24292e; color: #fff; padding: 12px 24px; display: flex; justify-content: space-between; align-items: center; }
+  header h1 { font-size: 18px; margin: 0; }
+  #status { font-size: 13px; }
+  main { padding: 16px 24px; }
+  .empty { color: #586069; }
+  .download { background: #fff; border: 1px solid #e1e4e8; border-radius: 6px; padding: 12px 16px; margin-bottom: 12px; }
+  .head { display: flex; justify-content: space-between; align-items: baseline; gap: 12px; }
+  .url { font-weight: 600; word-break: break-all; }
+  .state { font-size: 12px; padding: 2px 8px; border-radius: 10px; background: #e1e4e8; white-space: nowrap; }
+  .state.running { background: #dbedff; }
+  .state.completed { background: #dcffe4; }
+  .state.failed { background: #ffdce0; }
+  .state.paused { background: #fff5b1; }
+  .meta { font-size: 13px; color: #586069; margin: 6px 0; }
+  .bar { background: #e1e4e8; border-radius: 3px; height: 8px; overflow: hidden; }
+  .bar > div { background: #2188ff; height: 100%; }
+  .ranges { display: grid; grid-template-columns: max-content 1fr max-content; gap: 2px 8px; font-size: 12px; margin: 8px 0; align-items: center; }
+  .ranges .bar { height: 6px; }
+  svg { width: 100%; height: 48px; background: #fafbfc; border: 1px solid #e1e4e8; border-radius: 3px; }
+  svg polyline { fill: none; stroke: #2188ff; stroke-width: 1.5; }
+  .errors { font-size: 12px; color: #cb2431; margin: 6px 0 0; padding-left: 18px; }
+  .actions { margin-top: 8px; }
+  button { font-size: 12px; margin-right: 6px; padding: 3px 10px; border: 1px solid #d1d5da; border-radius: 4px; background: #fafbfc; cursor: pointer; }
+  button.cancel { color: #cb2431; }
+</style>
+</head>
+<body>
+<header><h1>parallel-download</h1><span id="status">connecting</span></header>
+<main id="downloads"><p class="empty">No downloads.</p></main>
+<script>
+(function () {
+  "use strict";
+
+  // The number of the speeds kept for the throughput graph of each download.
+  var samples = 120;
+  var speedHistory = {};
+
+  // The secret token of the daemon in the URL of the page, such as /?token=secret, is sent with the requests.
+  var token = new URLSearchParams(window.location.search).get("token");
+
+  function withToken(path) {
+    return token ? path + "?token=" + encodeURIComponent(token) : path;
+  }
+
+  function bytes(n) {
+    var units = ["B", "KiB", "MiB", "GiB", "TiB"];
+    var i = 0;
+    while (n >= 1024 && i < units.length - 1) {
+      n /= 1024;
+      i++;
+    }
+    return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+  }
+
+  function percent(received, length) {
+    return length > 0 ? Math.min(100, received * 100 / length) : 0;
+  }
+
+  function element(tag, className, text) {
+    var e = document.createElement(tag);
+    if (className) {
+      e.className = className;
+    }
+    if (text !== undefined) {
+      e.textContent = text;
+    }
+    return e;
+  }
+
+  function bar(received, length) {
+    var b = element("div", "bar");
+    var fill = element("div");
+    fill.style.width = percent(received, length) + "%";
+    b.appendChild(fill);
+    return b;
+  }
+
+  function graph(speeds) {
+    var ns = "http://www.w3.org/2000/svg";
+    var svg = document.createElementNS(ns, "svg");
+    svg.setAttribute("viewBox", "0 0 " + samples + " 100");
+    svg.setAttribute("preserveAspectRatio", "none");
+    var max = Math.max.apply(null, speeds.concat([1]));
+    var points = speeds.map(function (s, i) {
+      return (samples - speeds.length + i) + "," + (100 - s * 95 / max);
+    });
+    var line = document.createElementNS(ns, "polyline");
+    line.setAttribute("points", points.join(" "));
+    line.setAttribute("vector-effect", "non-scaling-stroke");
+    svg.appendChild(line);
+    var title = document.createElementNS(ns, "title");
+    title.textContent = "max " + bytes(max) + "/s";
+    svg.appendChild(title);
+    return svg;
+  }
+
+  function action(label, className, method, path, confirmation) {
+    var b = element("button", className, label);
+    b.onclick = function () {
+      if (confirmation && !window.confirm(confirmation)) {
+        return;
+      }
+      fetch(withToken(path), { method: method }).then(function (resp) {
+        if (!resp.ok) {
+          return resp.json().then(function (e) { window.alert(e.error); });
+        }
+      });
+    };
+    return b;
+  }
+
+  function render(download) {
+    var d = element("section", "download");
+
+    var head = element("div", "head");
+    head.appendChild(element("span", "url", download.url));
+    head.appendChild(element("span", "state " + download.state, download.state));
+    d.appendChild(head);
+
+    var meta = "#" + download.id + " priority " + download.priority;
+    if (download.path) {
+      meta += " → " + download.path;
+    }
+    if (download.length) {
+      meta += " · " + bytes(download.received || 0) + " / " + bytes(download.length) + " (" + percent(download.received || 0, download.length).toFixed(1) + "%)";
+    }
+    if (download.state === "running") {
+      meta += " · " + bytes(download.speed || 0) + "/s";
+    }
+    if (download.retries) {
+      meta += " · " + download.retries + " retries";
+    }
+    d.appendChild(element("div", "meta", meta));
+    d.appendChild(bar(download.received || 0, download.length || 0));
+
+    if (download.ranges && download.ranges.length) {
+      var ranges = element("div", "ranges");
+      download.ranges.forEach(function (r) {
+        ranges.appendChild(element("span", "", (r.range || "whole") + " " + r.host));
+        ranges.appendChild(bar(r.received, r.length));
+        ranges.appendChild(element("span", "", bytes(r.received) + (r.length ? " / " + bytes(r.length) : "")));
+      });
+      d.appendChild(ranges);
+    }
+
+    var speeds = speedHistory[download.id];
+    if (speeds && speeds.length > 1) {
+      d.appendChild(graph(speeds));
+    }
+
+    var errors = (download.errors || []).map(function (e) {
+      return new Date(e.time).toLocaleTimeString() + " " + e.error;
+    });
+    if (download.error) {
+      errors.push(download.error);
+    }
+    if (errors.length) {
+      var list = element("ul", "errors");
+      errors.forEach(function (e) {
+        list.appendChild(element("li", "", e));
+      });
+      d.appendChild(list);
+    }
+
+    var actions = element("div", "actions");
+    var path = "/api/downloads/" + download.id;
+    if (download.state === "queued" || download.state === "running") {
+      actions.appendChild(action("Pause", "", "POST", path + "/pause"));
+    }
+    if (download.state === "paused" || download.state === "failed") {
+      actions.appendChild(action("Resume", "", "POST", path + "/resume"));
+    }
+    actions.appendChild(action("Cancel", "cancel", "DELETE", path, "Cancel and remove " + download.url + "?"));
+    d.appendChild(actions);
+
+    return d;
+  }
+
+  function update(downloads) {
+    var seen = {};
+    downloads.forEach(function (download) {
+      seen[download.id] = true;
+      if (download.state !== "running") {
+        return;
+      }
+      var speeds = speedHistory[download.id] || (speedHistory[download.id] = []);
+      speeds.push(download.speed || 0);
+      if (speeds.length > samples) {
+        speeds.shift();
+      }
+    });
+    Object.keys(speedHistory).forEach(function (id) {
+      if (!seen[id]) {
+        delete speedHistory[id];
+      }
+    });
+
+    var main = document.getElementById("downloads");
+    while (main.firstChild) {
+      main.removeChild(main.firstChild);
+    }
+    if (downloads.length === 0) {
+      main.appendChild(element("p", "empty", "No downloads."));
+    }
+    downloads.forEach(function (download) {
+      main.appendChild(render(download));
+    });
+  }
+
+  var statusLine = document.getElementById("status");
+  var events = new EventSource(withToken("/api/events"));
+  events.addEventListener("downloads", function (e) {
+    statusLine.textContent = "updated " + new Date().toLocaleTimeString();
+    update(JSON.parse(e.data));
+  });
+  events.onerror = function () {
+    statusLine.textContent = "disconnected, reconnecting";
+  };
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,159 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDaemon_Dashboard(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewHandler(q, ""))
+	defer ts.Close()
+
+	cases := map[string]struct {
+		path     string
+		code     int
+		contains string
+	}{
+		"dashboard": {path: "/", code: http.StatusOK, contains: `new EventSource(withToken("/api/events"))`},
+		"missing":   {path: "/foo", code: http.StatusNotFound, contains: "not found: /foo"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + c.path)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != c.code {
+				t.Errorf("unexpected status code: expected: %d actual: %d", c.code, resp.StatusCode)
+			}
+
+			b, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if !strings.Contains(string(b), c.contains) {
+				t.Errorf("unexpected body: expected to contain: %q actual: %q", c.contains, b)
+			}
+		})
+	}
+}
+
+func TestDaemon_Events(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	ts := httptest.NewServer(NewHandler(q, ""))
+	defer ts.Close()
+
+	// The downloads are sent only when they change within the test.
+	dashboardInterval = time.Hour
+	defer func() { dashboardInterval = time.Second }()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/events", nil)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected Content-Type: expected: text/event-stream actual: %s", ct)
+	}
+
+	r := bufio.NewReader(resp.Body)
+
+	if jobs := readEvent(t, r); len(jobs) != 0 {
+		t.Errorf("unexpected downloads: expected: none actual: %+v", jobs)
+	}
+
+	j, err := q.Add(&Job{URL: "http://example.com/foo.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var states []State
+	for len(states) == 0 || states[len(states)-1] != Running {
+		jobs := readEvent(t, r)
+		if len(jobs) != 1 || jobs[0].ID != j.ID {
+			t.Fatalf("unexpected downloads: %+v", jobs)
+		}
+		states = append(states, jobs[0].State)
+	}
+
+	_, err = q.Pause(j.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	for {
+		jobs := readEvent(t, r)
+		if jobs[0].State == Paused {
+			break
+		}
+	}
+}
+
+// readEvent reads the downloads sent as a server-sent event from r.
+func readEvent(t *testing.T, r *bufio.Reader) []*Job {
+	t.Helper()
+
+	var event, data string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "event: ") {
+			event = strings.TrimPrefix(line, "event: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	if event != "downloads" {
+		t.Fatalf("unexpected event: expected: downloads actual: %q", event)
+	}
+
+	var jobs []*Job
+	err := json.Unmarshal([]byte(data), &jobs)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	return jobs
+}
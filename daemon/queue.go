@@ -0,0 +1,768 @@
+/*
+Package daemon provides the queue of downloads run by a long-lived process, and the JSON API and the JSON-RPC interface of aria2 to control it.
+*/
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/downloading"
+	"github.com/hioki-daichi/parallel-download/opt"
+	"github.com/hioki-daichi/parallel-download/persisting"
+)
+
+var (
+	errJobNotFound = errors.New("download not found")
+	errLocalFile   = errors.New("file URLs are not allowed without --allow-local-files")
+	errOutsideDir  = errors.New("the paths outside the directory of the daemon are not allowed without --allow-local-files")
+)
+
+// maxRemoved is the number of the removed downloads kept in the queue, like --max-download-result of aria2.
+const maxRemoved = 1000
+
+// State is the state of a download in the queue.
+type State string
+
+const (
+	// Queued is the state of the download waiting to be started.
+	Queued State = "queued"
+	// Running is the state of the download in progress.
+	Running State = "running"
+	// Paused is the state of the download which is not started until it is resumed.
+	Paused State = "paused"
+	// Completed is the state of the download which succeeded.
+	Completed State = "completed"
+	// Failed is the state of the download which failed, which can be resumed to retry it.
+	Failed State = "failed"
+	// Removed is the state of the download removed from the queue, which only the subscribers receive.
+	Removed State = "removed"
+)
+
+// Job is a download in the queue.
+// Output, Dir and Parallelism override the defaults of the daemon unless they are empty.
+// Path, Length, Received, Speed, Ranges, Retries and Errors are the progress of the last run, which the queue updates.
+type Job struct {
+	ID          int       `json:"id"`
+	URL         string    `json:"url"`
+	Mirrors     []string  `json:"mirrors,omitempty"`
+	Output      string    `json:"output,omitempty"`
+	Dir         string    `json:"dir,omitempty"`
+	Parallelism int       `json:"parallelism,omitempty"`
+	Priority    int       `json:"priority"`
+	State       State     `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Created     time.Time `json:"created"`
+
+	// Path is the path of the downloaded file, and Speed is the bytes received per second while running.
+	Path     string `json:"path,omitempty"`
+	Length   int64  `json:"length,omitempty"`
+	Received int64  `json:"received,omitempty"`
+	Speed    int64  `json:"speed,omitempty"`
+
+	// Ranges are the requests in flight, and Errors are the latest errors which the download retried on.
+	Ranges  []downloading.RangeProgress `json:"ranges,omitempty"`
+	Retries int64                       `json:"retries,omitempty"`
+	Errors  []downloading.RetryError    `json:"errors,omitempty"`
+}
+
+// stateError is the error of the operation which the download in the state does not allow.
+type stateError struct {
+	id    int
+	state State
+}
+
+func (e *stateError) Error() string {
+	return fmt.Sprintf("download %d is %s", e.id, e.state)
+}
+
+// Queue runs the downloads in order of priority, up to the specified number at the same time.
+// The queue is saved in the state file whenever it changes, and restored from it by NewQueue.
+// The ranges of each download are kept in its work dir next to the state file until it is completed or removed,
+// so that the download paused, failed or interrupted by the exit of the daemon only requests the missing ranges when it runs again.
+type Queue struct {
+	outStream  io.Writer
+	defaults   opt.Options
+	jobs       int
+	state      string
+	allowLocal bool
+
+	mu          sync.Mutex
+	entries     []*Job
+	removed     []*Job
+	nextID      int
+	runs        map[int]*run
+	running     sync.WaitGroup
+	subscribers map[chan *Job]struct{}
+
+	// changed wakes up the scheduler when a download is added, resumed or finished.
+	changed chan struct{}
+
+	// for testing
+	newTask func(w io.Writer, opts *opt.Options) task
+}
+
+// NewQueue returns Queue with the options of the daemon, restoring the downloads from the state file.
+func NewQueue(w io.Writer, opts *opt.DaemonOptions) (*Queue, error) {
+	q := &Queue{
+		outStream:   w,
+		defaults:    opts.Options,
+		jobs:        opts.Jobs,
+		state:       opts.State,
+		allowLocal:  opts.AllowLocalFiles,
+		nextID:      1,
+		runs:        map[int]*run{},
+		subscribers: map[chan *Job]struct{}{},
+		changed:     make(chan struct{}, 1),
+		newTask:     newDownloadTask,
+	}
+
+	err := q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// task is a run of a download, which reports its progress while running.
+type task interface {
+	Run(ctx context.Context) error
+	// Progress returns the length of the content and the bytes received so far.
+	Progress() (int64, int64)
+	// Output returns the path of the downloaded file, or empty until it is decided.
+	Output() string
+	// Ranges returns the requests in flight.
+	Ranges() []downloading.RangeProgress
+	// Retries returns the number of the retries, and Errors returns the latest errors retried on.
+	Retries() int64
+	Errors() []downloading.RetryError
+}
+
+// downloadTask saves the file at the URL, or the media if it is a playlist or a manifest.
+type downloadTask struct {
+	*downloading.Downloader
+	media bool
+}
+
+// newDownloadTask returns task which downloads according to opts.
+func newDownloadTask(w io.Writer, opts *opt.Options) task {
+	return &downloadTask{Downloader: downloading.NewDownloader(w, opts), media: downloading.IsMedia(opts.URL)}
+}
+
+func (t *downloadTask) Run(ctx context.Context) error {
+	if t.media {
+		return t.DownloadMedia(ctx)
+	}
+	return t.Download(ctx)
+}
+
+// Run starts the queued downloads until ctx is done.
+// Then it waits for the running downloads to be canceled, and saves them as queued.
+func (q *Queue) Run(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		for len(q.runs) < q.jobs {
+			j := q.next()
+			if j == nil {
+				break
+			}
+			q.start(ctx, j)
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			q.running.Wait()
+			return ctx.Err()
+		case <-q.changed:
+		}
+	}
+}
+
+// next returns the queued download of the highest priority, or the oldest of them.
+// A download resumed before its canceled run finishes waits for it.
+func (q *Queue) next() *Job {
+	var next *Job
+	for _, j := range q.entries {
+		if _, ok := q.runs[j.ID]; ok {
+			continue
+		}
+		if j.State == Queued && (next == nil || j.Priority > next.Priority) {
+			next = j
+		}
+	}
+	return next
+}
+
+// run is a run of a download, which is canceled when the download is paused or removed.
+type run struct {
+	cancel context.CancelFunc
+	task   task
+
+	// sampled and sampledBytes are the time and the received bytes when the speed was last calculated.
+	sampled      time.Time
+	sampledBytes int64
+	speed        int64
+}
+
+// progress sets the progress of the run in j.
+// The speed is calculated from the bytes received since the last calculation at least a second ago.
+func (r *run) progress(j *Job, now time.Time) {
+	j.Length, j.Received = r.task.Progress()
+	if output := r.task.Output(); output != "" {
+		j.Path = output
+	}
+	j.Ranges = r.task.Ranges()
+	j.Retries = r.task.Retries()
+	j.Errors = r.task.Errors()
+
+	if elapsed := now.Sub(r.sampled); elapsed >= time.Second {
+		r.speed = int64(float64(j.Received-r.sampledBytes) / elapsed.Seconds())
+		r.sampled = now
+		r.sampledBytes = j.Received
+	}
+	j.Speed = r.speed
+}
+
+// start starts j in a goroutine.
+func (q *Queue) start(ctx context.Context, j *Job) {
+	opts, err := q.options(j)
+	if err != nil {
+		j.State = Failed
+		j.Error = err.Error()
+		q.save()
+		q.publish(j)
+		return
+	}
+
+	w := &prefixWriter{w: q.outStream, mu: &q.mu, prefix: fmt.Sprintf("[%d] ", j.ID)}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	r := &run{cancel: cancel, task: q.newTask(w, opts), sampled: time.Now()}
+	q.runs[j.ID] = r
+
+	j.State = Running
+	j.Error = ""
+	j.Length = 0
+	j.Received = 0
+	j.Retries = 0
+	j.Errors = nil
+	q.save()
+	q.publish(j)
+
+	fmt.Fprintf(q.outStream, "start: %d: %s\n", j.ID, j.URL)
+
+	q.running.Add(1)
+	go func(id int) {
+		defer q.running.Done()
+
+		err := r.task.Run(jobCtx)
+		cancel()
+
+		q.finish(ctx, id, err)
+	}(j.ID)
+}
+
+// finish records the result of the download of id, unless it was paused or removed while running.
+// ctx is that of Run, which tells whether the download was canceled by the exit of the daemon.
+func (q *Queue) finish(ctx context.Context, id int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r := q.runs[id]
+	delete(q.runs, id)
+	defer q.notify()
+
+	i := q.index(id)
+	if i < 0 {
+		// The download was removed while running, so its ranges are no longer resumed.
+		q.removeWorkDir(id)
+		return
+	}
+	if q.entries[i].State != Running {
+		return
+	}
+	j := q.entries[i]
+
+	r.progress(j, time.Now())
+	j.Speed = 0
+
+	switch {
+	case err == nil:
+		j.State = Completed
+		fmt.Fprintf(q.outStream, "completed: %d: %s\n", j.ID, j.URL)
+	case ctx.Err() != nil:
+		// The daemon is exiting, so the download is started over next time.
+		j.State = Queued
+	default:
+		j.State = Failed
+		j.Error = err.Error()
+		fmt.Fprintf(q.outStream, "failed: %d: %s\n", j.ID, err)
+	}
+
+	q.save()
+	q.publish(j)
+}
+
+// options returns the options of the download of j, which override the defaults of the daemon.
+func (q *Queue) options(j *Job) (*opt.Options, error) {
+	u, err := url.ParseRequestURI(j.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	o := q.defaults
+	o.URL = u
+	o.URLs = []*url.URL{u}
+	o.WorkDir = q.workDir(j.ID)
+
+	o.Mirrors = nil
+	for _, rawurl := range j.Mirrors {
+		m, err := url.ParseRequestURI(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		o.Mirrors = append(o.Mirrors, m)
+	}
+
+	if j.Output != "" {
+		o.Output = j.Output
+	}
+	if j.Dir != "" {
+		o.Dir = j.Dir
+	}
+	if j.Parallelism > 0 {
+		o.Parallelism = j.Parallelism
+	}
+
+	return &o, nil
+}
+
+// Add adds the download of j to the queue, and returns it with its ID.
+func (q *Queue) Add(j *Job) (*Job, error) {
+	u, err := url.ParseRequestURI(j.URL)
+	if err != nil {
+		return nil, err
+	}
+	if !downloading.IsSupported(u) {
+		return nil, fmt.Errorf("unsupported URL: %s", j.URL)
+	}
+
+	urls := []*url.URL{u}
+	var mirrors []string
+	for _, rawurl := range j.Mirrors {
+		m, err := url.ParseRequestURI(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		if !downloading.IsSupported(m) {
+			return nil, fmt.Errorf("unsupported URL: %s", rawurl)
+		}
+		urls = append(urls, m)
+		mirrors = append(mirrors, m.String())
+	}
+
+	if !q.allowLocal {
+		err := q.checkLocal(j, urls)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	added := &Job{
+		ID:          q.nextID,
+		URL:         u.String(),
+		Mirrors:     mirrors,
+		Output:      j.Output,
+		Dir:         j.Dir,
+		Parallelism: j.Parallelism,
+		Priority:    j.Priority,
+		State:       Queued,
+		Created:     time.Now(),
+	}
+	q.nextID++
+
+	q.entries = append(q.entries, added)
+	q.save()
+	q.notify()
+	q.publish(added)
+
+	fmt.Fprintf(q.outStream, "added: %d: %s\n", added.ID, added.URL)
+
+	copied := *added
+	return &copied, nil
+}
+
+// checkLocal refuses j if it reads the local files by the URLs, or saves the file outside the directory of the daemon,
+// since any process of the user can add the downloads through the API.
+func (q *Queue) checkLocal(j *Job, urls []*url.URL) error {
+	for _, u := range urls {
+		if u.Scheme == "file" {
+			return fmt.Errorf("%s: %s", u, errLocalFile)
+		}
+	}
+
+	root, err := filepath.Abs(q.defaults.Dir)
+	if err != nil {
+		return err
+	}
+
+	dir := root
+	if j.Dir != "" {
+		dir, err = filepath.Abs(j.Dir)
+		if err != nil {
+			return err
+		}
+		if !isInDir(root, dir) {
+			return fmt.Errorf("%s: %s", j.Dir, errOutsideDir)
+		}
+	}
+
+	// The relative output is saved under the directory, as the downloader does.
+	if j.Output != "" {
+		output := j.Output
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(dir, output)
+		}
+		if !isInDir(root, output) {
+			return fmt.Errorf("%s: %s", j.Output, errOutsideDir)
+		}
+	}
+
+	return nil
+}
+
+// isInDir reports whether the absolute path p is dir or under it.
+func isInDir(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// List returns the downloads in the queue in order of priority.
+func (q *Queue) List() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// An empty queue is an empty array rather than null in JSON.
+	jobs := []*Job{}
+	for _, j := range q.entries {
+		jobs = append(jobs, q.snapshot(j))
+	}
+
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return jobs[a].Priority > jobs[b].Priority
+	})
+
+	return jobs
+}
+
+// Get returns the download of id.
+func (q *Queue) Get(id int) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.index(id)
+	if i < 0 {
+		return nil, errJobNotFound
+	}
+
+	return q.snapshot(q.entries[i]), nil
+}
+
+// Pause keeps the download of id from being started, and cancels it if it is running.
+// A paused download only requests the ranges which it has not completed when it is resumed.
+func (q *Queue) Pause(id int) (*Job, error) {
+	return q.transit(id, Paused, func(j *Job) error {
+		if j.State != Queued && j.State != Running {
+			return &stateError{id: id, state: j.State}
+		}
+
+		if r, ok := q.runs[j.ID]; ok {
+			r.cancel()
+		}
+
+		return nil
+	})
+}
+
+// Resume queues the paused or failed download of id again.
+func (q *Queue) Resume(id int) (*Job, error) {
+	return q.transit(id, Queued, func(j *Job) error {
+		if j.State != Paused && j.State != Failed {
+			return &stateError{id: id, state: j.State}
+		}
+
+		j.Error = ""
+		return nil
+	})
+}
+
+// transit changes the state of the download of id to state if fn allows it.
+func (q *Queue) transit(id int, state State, fn func(j *Job) error) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.index(id)
+	if i < 0 {
+		return nil, errJobNotFound
+	}
+	j := q.entries[i]
+
+	err := fn(j)
+	if err != nil {
+		return nil, err
+	}
+
+	j.State = state
+	q.save()
+	q.notify()
+	q.publish(j)
+
+	fmt.Fprintf(q.outStream, "%s: %d: %s\n", state, j.ID, j.URL)
+
+	return q.snapshot(j), nil
+}
+
+// Remove removes the download of id from the queue, and cancels it if it is running.
+// The downloaded files are kept, while the ranges of the download not completed are removed.
+func (q *Queue) Remove(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.index(id)
+	if i < 0 {
+		return errJobNotFound
+	}
+	j := q.entries[i]
+
+	removed := q.snapshot(j)
+	removed.State = Removed
+	removed.Speed = 0
+	removed.Ranges = nil
+
+	if r, ok := q.runs[id]; ok {
+		// The work dir is removed by finish after the run stops writing to it.
+		r.cancel()
+	} else {
+		q.removeWorkDir(id)
+	}
+
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.removed = append(q.removed, removed)
+	if len(q.removed) > maxRemoved {
+		q.removed = q.removed[len(q.removed)-maxRemoved:]
+	}
+	q.save()
+	q.publish(removed)
+
+	fmt.Fprintf(q.outStream, "removed: %d: %s\n", j.ID, j.URL)
+
+	return nil
+}
+
+// Removed returns the downloads removed from the queue in the Removed state, the latest last.
+func (q *Queue) Removed() []*Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := []*Job{}
+	for _, j := range q.removed {
+		copied := *j
+		jobs = append(jobs, &copied)
+	}
+
+	return jobs
+}
+
+// Forget forgets the completed, failed or removed download of id, which is not kept as removed.
+func (q *Queue) Forget(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, j := range q.removed {
+		if j.ID == id {
+			q.removed = append(q.removed[:i], q.removed[i+1:]...)
+			q.save()
+			return nil
+		}
+	}
+
+	i := q.index(id)
+	if i < 0 {
+		return errJobNotFound
+	}
+	j := q.entries[i]
+
+	if j.State != Completed && j.State != Failed {
+		return &stateError{id: id, state: j.State}
+	}
+
+	forgotten := *j
+	forgotten.State = Removed
+
+	q.entries = append(q.entries[:i], q.entries[i+1:]...)
+	q.removeWorkDir(id)
+	q.save()
+	q.publish(&forgotten)
+
+	fmt.Fprintf(q.outStream, "forgotten: %d: %s\n", j.ID, j.URL)
+
+	return nil
+}
+
+// snapshot returns a copy of j with the progress of its run if it is running.
+func (q *Queue) snapshot(j *Job) *Job {
+	copied := *j
+	if r, ok := q.runs[j.ID]; ok && j.State == Running {
+		r.progress(&copied, time.Now())
+	}
+	return &copied
+}
+
+// Subscribe returns the channel which receives the download whenever its state changes, and the function to unsubscribe.
+// The removed download is received in the Removed state. The changes are dropped while the channel is full.
+func (q *Queue) Subscribe() (<-chan *Job, func()) {
+	ch := make(chan *Job, 64)
+
+	q.mu.Lock()
+	q.subscribers[ch] = struct{}{}
+	q.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			q.mu.Lock()
+			delete(q.subscribers, ch)
+			q.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish sends a copy of j to each subscriber.
+func (q *Queue) publish(j *Job) {
+	for ch := range q.subscribers {
+		copied := *j
+		select {
+		case ch <- &copied:
+		default:
+		}
+	}
+}
+
+// index returns the index of the download of id in the entries, or -1 if it is missing.
+func (q *Queue) index(id int) int {
+	for i, j := range q.entries {
+		if j.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// notify wakes up the scheduler.
+func (q *Queue) notify() {
+	select {
+	case q.changed <- struct{}{}:
+	default:
+	}
+}
+
+// workDir returns the directory which keeps the ranges of the download of id, next to the state file.
+func (q *Queue) workDir(id int) string {
+	return filepath.Join(q.state+".d", strconv.Itoa(id))
+}
+
+// removeWorkDir removes the ranges of the download of id. The queue keeps working even if it fails, so the error is only reported.
+func (q *Queue) removeWorkDir(id int) {
+	err := os.RemoveAll(q.workDir(id))
+	if err != nil {
+		fmt.Fprintf(q.outStream, "failed to remove ranges of %d: %s\n", id, err)
+	}
+}
+
+// queueState is the format of the state file.
+type queueState struct {
+	NextID  int    `json:"next_id"`
+	Jobs    []*Job `json:"jobs"`
+	Removed []*Job `json:"removed,omitempty"`
+}
+
+// load restores the downloads from the state file. A missing file has no downloads.
+// The downloads running when the daemon exited are queued again.
+func (q *Queue) load() error {
+	b, err := ioutil.ReadFile(q.state)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s queueState
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return fmt.Errorf("%s: %s", q.state, err)
+	}
+
+	for _, j := range s.Jobs {
+		if j.State == Running {
+			j.State = Queued
+		}
+		if j.ID >= s.NextID {
+			s.NextID = j.ID + 1
+		}
+	}
+
+	q.entries = s.Jobs
+	q.removed = s.Removed
+	if s.NextID > q.nextID {
+		q.nextID = s.NextID
+	}
+
+	return nil
+}
+
+// save saves the downloads in the state file.
+// The file is replaced by renaming so that it is never left half-written.
+// The queue keeps working even if it fails, so the error is only reported.
+func (q *Queue) save() {
+	err := persisting.WriteJSON(q.state, queueState{NextID: q.nextID, Jobs: q.entries, Removed: q.removed})
+	if err != nil {
+		fmt.Fprintf(q.outStream, "failed to save queue: %s\n", err)
+	}
+}
+
+// prefixWriter writes the progress of a download with the prefix of its ID, serialized with the other downloads.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.w.Write(append([]byte(w.prefix), p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,396 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/downloading"
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDaemon_Queue_Priority(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	started := make(chan string, 3)
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		started <- opts.URL.String()
+		return nil
+	})
+
+	for _, j := range []*Job{
+		{URL: "http://example.com/low", Priority: 0},
+		{URL: "http://example.com/high", Priority: 5},
+		{URL: "http://example.com/middle", Priority: 1},
+	} {
+		_, err := q.Add(j)
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	var actual []string
+	for i := 0; i < 3; i++ {
+		actual = append(actual, <-started)
+	}
+
+	expected := []string{"http://example.com/high", "http://example.com/middle", "http://example.com/low"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected order: expected: %v actual: %v", expected, actual)
+	}
+
+	waitState(t, q, 3, Completed)
+}
+
+func TestDaemon_Queue_PauseResume(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	runs := make(chan struct{}, 2)
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		runs <- struct{}{}
+		if len(runs) == 1 {
+			// The first run is paused after it has completed a range, which the next run resumes.
+			err := os.MkdirAll(opts.WorkDir, 0755)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(filepath.Join(opts.WorkDir, "0-99.part"), nil, 0644)
+			if err != nil {
+				return err
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		_, err := os.Stat(filepath.Join(opts.WorkDir, "0-99.part"))
+		return err
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	j, err := q.Add(&Job{URL: "http://example.com/foo.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	waitState(t, q, j.ID, Running)
+
+	_, err = q.Pause(j.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	waitState(t, q, j.ID, Paused)
+
+	_, err = q.Pause(j.ID)
+	if err == nil || err.Error() != "download 1 is paused" {
+		t.Errorf("unexpected error: expected: %q actual: %v", "download 1 is paused", err)
+	}
+
+	_, err = q.Resume(j.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	waitState(t, q, j.ID, Completed)
+
+	if len(runs) != 2 {
+		t.Errorf("unexpected runs: expected: 2 actual: %d", len(runs))
+	}
+}
+
+func TestDaemon_Queue_FailAndRemove(t *testing.T) {
+	q, clean := newTestQueue(t, 2)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		if opts.URL.Path == "/broken" {
+			return errors.New("unexpected status code: 500")
+		}
+		err := os.MkdirAll(opts.WorkDir, 0755)
+		if err != nil {
+			return err
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	broken, err := q.Add(&Job{URL: "http://example.com/broken"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	slow, err := q.Add(&Job{URL: "http://example.com/slow"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	j := waitState(t, q, broken.ID, Failed)
+	if j.Error != "unexpected status code: 500" {
+		t.Errorf("unexpected error: expected: %q actual: %q", "unexpected status code: 500", j.Error)
+	}
+
+	waitState(t, q, slow.ID, Running)
+
+	err = q.Remove(slow.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	_, err = q.Get(slow.ID)
+	if err != errJobNotFound {
+		t.Errorf("unexpected error: expected: %s actual: %v", errJobNotFound, err)
+	}
+
+	// The ranges of the removed download are removed after its run is canceled.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(q.workDir(slow.ID))
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected work dir: expected: removed actual: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	_, err = q.Add(&Job{URL: "ftp2://example.com/foo"})
+	if err == nil || err.Error() != "unsupported URL: ftp2://example.com/foo" {
+		t.Errorf("unexpected error: expected: %q actual: %v", "unsupported URL: ftp2://example.com/foo", err)
+	}
+}
+
+func TestDaemon_Queue_Add_Local(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	dir := q.defaults.Dir
+
+	cases := map[string]struct {
+		job      *Job
+		expected string
+	}{
+		"in dir":          {job: &Job{URL: "http://example.com/foo.png", Output: filepath.Join(dir, "out", "foo.png"), Dir: filepath.Join(dir, "sub")}},
+		"relative output": {job: &Job{URL: "http://example.com/foo.png", Output: "out/foo.png"}},
+		"file URL":        {job: &Job{URL: "file:///etc/passwd"}, expected: "file:///etc/passwd: " + errLocalFile.Error()},
+		"file mirror":     {job: &Job{URL: "http://example.com/foo.png", Mirrors: []string{"file:///etc/passwd"}}, expected: "file:///etc/passwd: " + errLocalFile.Error()},
+		"output outside":  {job: &Job{URL: "http://example.com/foo.png", Output: "/etc/foo.png"}, expected: "/etc/foo.png: " + errOutsideDir.Error()},
+		"escaping output": {job: &Job{URL: "http://example.com/foo.png", Output: "../foo.png"}, expected: "../foo.png: " + errOutsideDir.Error()},
+		"dir outside":     {job: &Job{URL: "http://example.com/foo.png", Dir: "/etc"}, expected: "/etc: " + errOutsideDir.Error()},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, err := q.Add(c.job)
+			if c.expected == "" {
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+
+			// They are allowed with --allow-local-files.
+			q.allowLocal = true
+			defer func() { q.allowLocal = false }()
+
+			_, err = q.Add(c.job)
+			if err != nil {
+				t.Errorf("unexpected error with --allow-local-files: %s", err)
+			}
+		})
+	}
+}
+
+func TestDaemon_Queue_Subscribe(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		return nil
+	})
+
+	events, unsubscribe := q.Subscribe()
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	j, err := q.Add(&Job{URL: "http://example.com/foo.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	waitState(t, q, j.ID, Completed)
+
+	err = q.Remove(j.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var actual []State
+	for len(actual) < 4 {
+		select {
+		case e := <-events:
+			if e.ID != j.ID {
+				t.Errorf("unexpected ID: expected: %d actual: %d", j.ID, e.ID)
+			}
+			actual = append(actual, e.State)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("unexpected states: expected: 4 states actual: %v", actual)
+		}
+	}
+
+	expected := []State{Queued, Running, Completed, Removed}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected states: expected: %v actual: %v", expected, actual)
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Errorf("unexpected event after unsubscribing")
+	}
+}
+
+func TestDaemon_Queue_Restore(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	q.newTask = testTask(func(ctx context.Context, opts *opt.Options) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	running, err := q.Add(&Job{URL: "http://example.com/foo.png", Output: "out/foo.png", Priority: 2})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	waitState(t, q, running.ID, Running)
+
+	paused, err := q.Add(&Job{URL: "http://example.com/bar.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	_, err = q.Pause(paused.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	// The daemon exits while the download is running.
+	cancel()
+	<-done
+
+	restored, err := NewQueue(ioutil.Discard, &opt.DaemonOptions{State: q.state, Jobs: 1})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	jobs := restored.List()
+	if len(jobs) != 2 {
+		t.Fatalf("unexpected downloads: expected: 2 actual: %d", len(jobs))
+	}
+
+	if j := jobs[0]; j.ID != running.ID || j.State != Queued || j.Output != "out/foo.png" || j.Priority != 2 {
+		t.Errorf("unexpected download: the running download is not queued again: %+v", j)
+	}
+	if j := jobs[1]; j.ID != paused.ID || j.State != Paused {
+		t.Errorf("unexpected download: the paused download is not kept: %+v", j)
+	}
+
+	added, err := restored.Add(&Job{URL: "http://example.com/baz.png"})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if added.ID != 3 {
+		t.Errorf("unexpected ID: expected: 3 actual: %d", added.ID)
+	}
+}
+
+// testTask returns the function to create task for Queue, which runs fn without progress.
+func testTask(fn func(ctx context.Context, opts *opt.Options) error) func(w io.Writer, opts *opt.Options) task {
+	return func(w io.Writer, opts *opt.Options) task {
+		return &funcTask{fn: fn, opts: opts}
+	}
+}
+
+type funcTask struct {
+	fn   func(ctx context.Context, opts *opt.Options) error
+	opts *opt.Options
+}
+
+func (t *funcTask) Run(ctx context.Context) error       { return t.fn(ctx, t.opts) }
+func (t *funcTask) Progress() (int64, int64)            { return 0, 0 }
+func (t *funcTask) Output() string                      { return "" }
+func (t *funcTask) Ranges() []downloading.RangeProgress { return nil }
+func (t *funcTask) Retries() int64                      { return 0 }
+func (t *funcTask) Errors() []downloading.RetryError    { return nil }
+
+func newTestQueue(t *testing.T, jobs int) (*Queue, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "parallel-download")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	opts := &opt.DaemonOptions{
+		Options: opt.Options{Parallelism: 2, Dir: dir, Timeout: time.Minute, MaxRedirects: opt.DefaultMaxRedirects},
+		State:   filepath.Join(dir, "queue.json"),
+		Jobs:    jobs,
+	}
+
+	q, err := NewQueue(ioutil.Discard, opts)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return q, func() { os.RemoveAll(dir) }
+}
+
+// waitState waits for the download of id to be in the state, and returns it.
+func waitState(t *testing.T, q *Queue, id int, state State) *Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j, err := q.Get(id)
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		if j.State == state {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected state of %d: expected: %s actual: %s", id, state, j.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
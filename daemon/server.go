@@ -0,0 +1,276 @@
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNotLocal    = errors.New("the API is served only on localhost or a Unix domain socket")
+	errCrossOrigin = errors.New("the requests from the pages of other sites are not allowed")
+	errNotJSON     = errors.New("Content-Type must be application/json")
+	errNotSocket   = errors.New("file exists and is not a socket")
+	errNoToken     = errors.New("the secret token is required")
+)
+
+// unixPrefix is the prefix of the addresses of Unix domain sockets such as "unix:/run/parallel-download.sock".
+const unixPrefix = "unix:"
+
+// Listen listens on addr, which is an address of localhost or a Unix domain socket prefixed by "unix:".
+// The other hosts are refused, and the socket is accessible only by the user.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return listenUnix(strings.TrimPrefix(addr, unixPrefix))
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isLocalHost(host) {
+		return nil, fmt.Errorf("%s: %s", addr, errNotLocal)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// listenUnix listens on the Unix domain socket, which is accessible only by the user from the start.
+// It is created in a private directory and made 0600 before it is moved to socket,
+// since the other users could connect to it before chmod otherwise.
+// The directory of socket is created if missing, such as that under the user cache directory by default.
+func listenUnix(socket string) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(socket), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket left by the previous daemon is replaced, but no other file is.
+	if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("%s: %s", socket, errNotSocket)
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(socket), ".parallel-download")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "daemon.sock")
+
+	l, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by unixListener at the path it is moved to.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	err = os.Chmod(private, 0600)
+	if err == nil {
+		err = os.Rename(private, socket)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: l, socket: socket}, nil
+}
+
+// unixListener removes the socket when it is closed.
+type unixListener struct {
+	net.Listener
+	socket string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.socket)
+	return err
+}
+
+// isLocalHost reports whether host is localhost or a loopback address.
+func isLocalHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// isLocalRequest reports whether r is sent to localhost and not by a page of another site,
+// which could control the daemon through the browser of the user.
+// The host is checked since a page of another site can be served from localhost by DNS rebinding.
+// The requests without Origin are sent by the tools rather than the browsers.
+func isLocalRequest(r *http.Request) bool {
+	if !isLocalHost((&url.URL{Host: r.Host}).Hostname()) {
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return isLocalHost(u.Hostname())
+}
+
+// NewHandler returns the handler of the JSON API to control q, and the web dashboard which shows the downloads.
+//
+//	GET    /                         serves the web dashboard.
+//	GET    /api/events               sends the downloads as server-sent events.
+//	GET    /api/downloads            lists the downloads.
+//	POST   /api/downloads            adds the download of Job in the body.
+//	GET    /api/downloads/:id        returns the download.
+//	POST   /api/downloads/:id/pause  pauses the download.
+//	POST   /api/downloads/:id/resume resumes the download.
+//	DELETE /api/downloads/:id        removes the download.
+//
+// Unless secret is empty, the requests require it as the bearer token, or as the query parameter "token" for the dashboard.
+func NewHandler(q *Queue, secret string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", serveDashboard)
+	mux.HandleFunc("/api/events", serveEvents(q))
+
+	mux.HandleFunc("/api/downloads", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, q.List())
+		case http.MethodPost:
+			// The forms of other sites can send text/plain without preflight, which is refused in addition to Origin.
+			if !isJSON(r) {
+				writeError(w, http.StatusUnsupportedMediaType, errNotJSON)
+				return
+			}
+
+			var j Job
+			err := json.NewDecoder(r.Body).Decode(&j)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			added, err := q.Add(&j)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, added)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+		}
+	})
+
+	mux.HandleFunc("/api/downloads/", func(w http.ResponseWriter, r *http.Request) {
+		fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/downloads/"), "/")
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil || len(fields) > 2 {
+			writeError(w, http.StatusNotFound, errJobNotFound)
+			return
+		}
+
+		action := ""
+		if len(fields) == 2 {
+			action = fields[1]
+		}
+
+		var j *Job
+		switch {
+		case r.Method == http.MethodGet && action == "":
+			j, err = q.Get(id)
+		case r.Method == http.MethodPost && action == "pause":
+			j, err = q.Pause(id)
+		case r.Method == http.MethodPost && action == "resume":
+			j, err = q.Resume(id)
+		case r.Method == http.MethodDelete && action == "":
+			err = q.Remove(id)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+			return
+		}
+
+		switch err.(type) {
+		case nil:
+			writeJSON(w, http.StatusOK, j)
+		case *stateError:
+			writeError(w, http.StatusConflict, err)
+		default:
+			writeError(w, http.StatusNotFound, err)
+		}
+	})
+
+	return localOnly(mux, secret)
+}
+
+// localOnly refuses the requests from the pages of other sites, and those without secret, before h handles them.
+func localOnly(h http.Handler, secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalRequest(r) {
+			writeError(w, http.StatusForbidden, errCrossOrigin)
+			return
+		}
+		if !hasToken(r, secret) {
+			writeError(w, http.StatusUnauthorized, errNoToken)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hasToken reports whether r has secret in Authorization header or in the query parameter "token",
+// which the dashboard sends since EventSource cannot set the header. No token is required if secret is empty.
+func hasToken(r *http.Request, secret string) bool {
+	if secret == "" {
+		return true
+	}
+
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// isJSON reports whether the body of r is JSON by Content-Type.
+func isJSON(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// apiError is the body of the error responses.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v in JSON as the response of the status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err in JSON as the response of the status code.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, apiError{Error: err.Error()})
+}
@@ -0,0 +1,316 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDaemon_Client(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "foo.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	ts := httptest.NewServer(NewHandler(q, ""))
+	defer ts.Close()
+
+	c := NewClient(ts.Listener.Addr().String(), "")
+
+	output := filepath.Join(q.defaults.Dir, "out", "foo.txt")
+	added, err := c.Add(ctx, &Job{URL: origin.URL + "/foo.txt", Output: output, Priority: 1})
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	waitState(t, q, added.ID, Completed)
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if string(b) != string(content) {
+		t.Errorf("unexpected content: expected: %q actual: %q", content, b)
+	}
+
+	jobs, err := c.List(ctx)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if len(jobs) != 1 || jobs[0].ID != added.ID || jobs[0].State != Completed || jobs[0].Priority != 1 {
+		t.Errorf("unexpected downloads: %+v", jobs)
+	}
+	if j := jobs[0]; j.Path != output || j.Length != int64(len(content)) || j.Received != int64(len(content)) {
+		t.Errorf("unexpected progress: expected: %s %d/%d actual: %s %d/%d", output, len(content), len(content), j.Path, j.Received, j.Length)
+	}
+
+	cases := map[string]struct {
+		call     func() error
+		expected string
+	}{
+		"pause completed": {
+			call:     func() error { _, err := c.Pause(ctx, added.ID); return err },
+			expected: "download 1 is completed",
+		},
+		"resume completed": {
+			call:     func() error { _, err := c.Resume(ctx, added.ID); return err },
+			expected: "download 1 is completed",
+		},
+		"missing": {
+			call:     func() error { _, err := c.Pause(ctx, 100); return err },
+			expected: errJobNotFound.Error(),
+		},
+		"unsupported URL": {
+			call:     func() error { _, err := c.Add(ctx, &Job{URL: "ftp2://example.com/foo"}); return err },
+			expected: "unsupported URL: ftp2://example.com/foo",
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			err := c.call()
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+
+	err = c.Remove(ctx, added.ID)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	jobs, err = c.List(ctx)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("unexpected downloads: expected: none actual: %+v", jobs)
+	}
+}
+
+func TestDaemon_Handler_Secret(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewHandler(q, "secret"))
+	defer ts.Close()
+
+	cases := map[string]struct {
+		path          string
+		authorization string
+		expected      int
+	}{
+		"bearer":       {path: "/api/downloads", authorization: "Bearer secret", expected: http.StatusOK},
+		"query":        {path: "/api/downloads?token=secret", expected: http.StatusOK},
+		"dashboard":    {path: "/?token=secret", expected: http.StatusOK},
+		"no token":     {path: "/api/downloads", expected: http.StatusUnauthorized},
+		"wrong bearer": {path: "/api/downloads", authorization: "Bearer wrong", expected: http.StatusUnauthorized},
+		"wrong query":  {path: "/api/events?token=wrong", expected: http.StatusUnauthorized},
+		"no dashboard": {path: "/", expected: http.StatusUnauthorized},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+c.path, nil)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if c.authorization != "" {
+				req.Header.Set("Authorization", c.authorization)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.expected {
+				t.Errorf("unexpected status code: expected: %d actual: %d", c.expected, resp.StatusCode)
+			}
+		})
+	}
+
+	// Client sends the secret as the bearer token.
+	addr := ts.Listener.Addr().String()
+
+	_, err := NewClient(addr, "secret").List(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	_, err = NewClient(addr, "").List(context.Background())
+	if err == nil || err.Error() != errNoToken.Error() {
+		t.Errorf("unexpected error: expected: %q actual: %v", errNoToken, err)
+	}
+}
+
+func TestDaemon_isLocalRequest(t *testing.T) {
+	cases := map[string]struct {
+		host     string
+		origin   string
+		expected bool
+	}{
+		"tool":                {host: "127.0.0.1:7800", expected: true},
+		"unix socket":         {host: "localhost", expected: true},
+		"dashboard":           {host: "127.0.0.1:7800", origin: "http://127.0.0.1:7800", expected: true},
+		"IPv6":                {host: "[::1]:7800", origin: "http://[::1]:7800", expected: true},
+		"another site":        {host: "127.0.0.1:7800", origin: "https://example.com", expected: false},
+		"DNS rebinding":       {host: "example.com:7800", expected: false},
+		"DNS rebinding fetch": {host: "example.com:7800", origin: "http://example.com:7800", expected: false},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/downloads", nil)
+			r.Host = c.host
+			if c.origin != "" {
+				r.Header.Set("Origin", c.origin)
+			}
+
+			if actual := isLocalRequest(r); actual != c.expected {
+				t.Errorf("unexpected result: expected: %t actual: %t", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDaemon_Handler_ContentType(t *testing.T) {
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	ts := httptest.NewServer(NewHandler(q, ""))
+	defer ts.Close()
+
+	cases := map[string]struct {
+		contentType string
+		expected    int
+	}{
+		"JSON":       {contentType: "application/json; charset=utf-8", expected: http.StatusCreated},
+		"text/plain": {contentType: "text/plain", expected: http.StatusUnsupportedMediaType},
+		"form":       {contentType: "application/x-www-form-urlencoded", expected: http.StatusUnsupportedMediaType},
+		"none":       {contentType: "", expected: http.StatusUnsupportedMediaType},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/downloads", strings.NewReader(`{"url": "http://localhost/foo.txt"}`))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if c.contentType != "" {
+				req.Header.Set("Content-Type", c.contentType)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != c.expected {
+				t.Errorf("unexpected status code: expected: %d actual: %d", c.expected, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestDaemon_Listen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "parallel-download")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = Listen("0.0.0.0:0")
+	if expected := "0.0.0.0:0: " + errNotLocal.Error(); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+
+	socket := filepath.Join(dir, "daemon.sock")
+
+	// The socket left by the previous daemon is replaced.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix:" + socket)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	q, clean := newTestQueue(t, 1)
+	defer clean()
+
+	srv := &http.Server{Handler: NewHandler(q, "")}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	jobs, err := NewClient("unix:"+socket, "").List(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("unexpected downloads: expected: none actual: %+v", jobs)
+	}
+
+	fi, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permission: expected: %s actual: %s", os.FileMode(0600), fi.Mode().Perm())
+	}
+
+	// No file is left but the socket.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("unexpected files: expected: 1 actual: %d", len(entries))
+	}
+
+	srv.Close()
+	if _, err := os.Lstat(socket); !os.IsNotExist(err) {
+		t.Errorf("unexpected socket after close: %v", err)
+	}
+
+	// The other files are not replaced.
+	regular := filepath.Join(dir, "regular")
+	err = ioutil.WriteFile(regular, nil, 0644)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	_, err = Listen("unix:" + regular)
+	if expected := regular + ": " + errNotSocket.Error(); err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
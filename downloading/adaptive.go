@@ -0,0 +1,362 @@
+package downloading
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/persisting"
+)
+
+const (
+	// adaptiveInitialParallelism is the parallelism to start with for the hosts not remembered in the host cache.
+	adaptiveInitialParallelism = 2
+
+	// adaptiveGain is the rate by which the throughput must improve to increase the parallelism further.
+	adaptiveGain = 0.1
+
+	// adaptiveMaxChunks is the maximum number of chunks in the adaptive mode, beyond which the chunks grow larger.
+	adaptiveMaxChunks = 1024
+
+	// adaptiveRetries is the number of times a chunk is requested again after the server pushed back.
+	adaptiveRetries = 5
+)
+
+var (
+	// adaptiveChunkSize is the size of the chunks in the adaptive mode, which is small enough to tune the parallelism while downloading.
+	adaptiveChunkSize = 1 << 20
+
+	// adaptiveBackoff is the duration to wait after the server pushed back without Retry-After header.
+	adaptiveBackoff = time.Second
+
+	// adaptiveMaxRetryAfter is the longest duration of Retry-After header to wait, so that a far one does not stall the download.
+	adaptiveMaxRetryAfter = time.Minute
+)
+
+// adaptiveChunks returns the number of chunks of the content of the specified length in the adaptive mode,
+// which are at least as many as the maximum parallelism.
+func adaptiveChunks(contentLength int, parallelism int) int {
+	n := (contentLength + adaptiveChunkSize - 1) / adaptiveChunkSize
+	if n > adaptiveMaxChunks {
+		n = adaptiveMaxChunks
+	}
+	if n < parallelism {
+		n = parallelism
+	}
+	return n
+}
+
+// adaptiveDownload downloads the chunks by as many concurrent range requests as adaptiveLimiter allows,
+// and saves each chunk in the file under the specified dir.
+// It returns the filenames by the index of the chunks, as parallelDownload does.
+//
+// The chunks refused by 429 or 503, or cut off by a reset connection, are requested again after a while with lower parallelism.
+// The best parallelism found is remembered for the host in the host cache, and used to start with next time.
+func (d *Downloader) adaptiveDownload(ctx context.Context, chunks []chunk, dir string) (map[int]string, error) {
+	host := d.hostCacheKey()
+
+	l := newAdaptiveLimiter(d.initialParallelism(host), d.parallelism)
+	fmt.Fprintf(d.outStream, "parallelism: %d\n", l.limit)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i        int
+		filename string
+		started  time.Time
+		err      error
+	}
+
+	// Buffered so that the goroutines finishing after an error do not block forever.
+	results := make(chan result, len(chunks))
+
+	var queue []int
+	for i := range chunks {
+		queue = append(queue, i)
+	}
+
+	filenames := map[int]string{}
+	retries := map[int]int{}
+	active := 0
+
+	for len(filenames) < len(chunks) {
+		for active < l.limit && len(queue) > 0 {
+			i := queue[0]
+			queue = queue[1:]
+			active++
+
+			go func(i int, started time.Time) {
+				filename, err := d.downloadChunk(ctx, chunks[i], dir)
+				results <- result{i: i, filename: filename, started: started, err: err}
+			}(i, l.now())
+		}
+
+		var r result
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r = <-results:
+		}
+		active--
+
+		if r.err == nil {
+			filenames[r.i] = r.filename
+			if l.done(chunks[r.i].length()) {
+				fmt.Fprintf(d.outStream, "parallelism: %d\n", l.limit)
+			}
+			continue
+		}
+
+		if !isBackoffError(r.err) || retries[r.i] >= adaptiveRetries {
+			return nil, r.err
+		}
+		retries[r.i]++
+
+		d.retry(r.err)
+		queue = append([]int{r.i}, queue...)
+
+		// The requests sent under the old limit are retried at once, since the wait for the first of them has passed.
+		if !l.backoff(r.started) {
+			fmt.Fprintf(d.outStream, "retry: %s\n", r.err)
+			continue
+		}
+
+		wait := adaptiveBackoff
+		if e, ok := r.err.(*statusError); ok && e.retryAfter > 0 {
+			wait = e.retryAfter
+		}
+		if wait > adaptiveMaxRetryAfter {
+			wait = adaptiveMaxRetryAfter
+		}
+
+		fmt.Fprintf(d.outStream, "back off: %s, parallelism: %d, retry in %s\n", r.err, l.limit, wait)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	d.rememberParallelism(host, l.best)
+
+	return filenames, nil
+}
+
+// isBackoffError reports whether err tells that the server is overloaded, that is 429, 503 or a reset connection.
+func isBackoffError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case *statusError:
+			return e.code == http.StatusTooManyRequests || e.code == http.StatusServiceUnavailable
+		case syscall.Errno:
+			return e == syscall.ECONNRESET
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// adaptiveLimiter tunes the limit of the concurrent range requests by the aggregate throughput.
+// The throughput is measured over a window of as many chunks as the limit,
+// and the limit is increased while the throughput improves by adaptiveGain, or goes back to the best one otherwise.
+type adaptiveLimiter struct {
+	limit int
+	max   int
+
+	// best is the limit of the highest throughput so far.
+	best           int
+	bestThroughput float64
+
+	windowStart  time.Time
+	windowBytes  int
+	windowChunks int
+
+	// lastBackoff is the time when the limit was decreased last.
+	lastBackoff time.Time
+
+	now func() time.Time
+}
+
+// newAdaptiveLimiter returns adaptiveLimiter which starts with the specified limit up to max.
+func newAdaptiveLimiter(start int, max int) *adaptiveLimiter {
+	if max < 1 {
+		max = 1
+	}
+	if start < 1 {
+		start = 1
+	}
+	if start > max {
+		start = max
+	}
+
+	l := &adaptiveLimiter{limit: start, max: max, best: start, now: time.Now}
+	l.windowStart = l.now()
+
+	return l
+}
+
+// done records that a chunk of n bytes is downloaded, and reports whether the limit has changed.
+func (l *adaptiveLimiter) done(n int) bool {
+	l.windowBytes += n
+	l.windowChunks++
+
+	if l.windowChunks < l.limit {
+		return false
+	}
+
+	prev := l.limit
+
+	throughput := float64(l.windowBytes) / l.now().Sub(l.windowStart).Seconds()
+	if throughput > l.bestThroughput*(1+adaptiveGain) {
+		l.best = l.limit
+		l.bestThroughput = throughput
+		if l.limit < l.max {
+			l.limit++
+		}
+	} else {
+		l.limit = l.best
+	}
+
+	l.resetWindow()
+
+	return l.limit != prev
+}
+
+// backoff halves the limit after the server pushed back the request started at the specified time,
+// and caps the limit below the one which overloaded the server.
+// The requests started before the last backoff do not decrease the limit again, since they were sent under the old limit.
+// It reports whether the limit was decreased, or capped at 1.
+func (l *adaptiveLimiter) backoff(started time.Time) bool {
+	if started.Before(l.lastBackoff) {
+		return false
+	}
+
+	if l.limit > 1 {
+		l.max = l.limit - 1
+	}
+	l.limit /= 2
+	if l.limit < 1 {
+		l.limit = 1
+	}
+
+	// The throughputs so far were measured before the server pushed back.
+	l.best = l.limit
+	l.bestThroughput = 0
+	l.lastBackoff = l.now()
+
+	l.resetWindow()
+
+	return true
+}
+
+func (l *adaptiveLimiter) resetWindow() {
+	l.windowStart = l.now()
+	l.windowBytes = 0
+	l.windowChunks = 0
+}
+
+// hostCacheKey returns the key of the sources in the host cache, which is the host of the URL,
+// or the hosts of the URL and the mirrors joined by "," since the chunks are spread across them.
+// The hosts are those which the URLs were redirected to.
+func (d *Downloader) hostCacheKey() string {
+	var hosts []string
+	for _, s := range d.getSources() {
+		hosts = append(hosts, d.location(s.url).Host)
+	}
+	sort.Strings(hosts)
+
+	return strings.Join(hosts, ",")
+}
+
+// initialParallelism returns the parallelism remembered for host in the host cache, or adaptiveInitialParallelism.
+func (d *Downloader) initialParallelism(host string) int {
+	if d.hostCache == "" {
+		return adaptiveInitialParallelism
+	}
+
+	entries, err := loadHostCache(d.hostCache)
+	if err != nil {
+		fmt.Fprintf(d.outStream, "ignore host cache: %s\n", err)
+		return adaptiveInitialParallelism
+	}
+
+	if e, ok := entries[host]; ok && e.Parallelism > 0 {
+		fmt.Fprintf(d.outStream, "remembered parallelism for %s: %d\n", host, e.Parallelism)
+		return e.Parallelism
+	}
+
+	return adaptiveInitialParallelism
+}
+
+// rememberParallelism saves parallelism of host in the host cache.
+// The download is not failed by an error, which is only reported.
+func (d *Downloader) rememberParallelism(host string, parallelism int) {
+	if d.hostCache == "" {
+		return
+	}
+
+	err := saveHostCache(d.hostCache, host, parallelism)
+	if err != nil {
+		fmt.Fprintf(d.outStream, "failed to save host cache: %s\n", err)
+		return
+	}
+
+	fmt.Fprintf(d.outStream, "remember parallelism for %s: %d\n", host, parallelism)
+}
+
+// hostCacheEntry is the best parallelism found for a host, or for a set of the hosts of the mirrors.
+type hostCacheEntry struct {
+	Parallelism int       `json:"parallelism"`
+	Updated     time.Time `json:"updated"`
+}
+
+// loadHostCache loads the entries by host from the JSON file. A missing file has no entries.
+func loadHostCache(filename string) (map[string]*hostCacheEntry, error) {
+	entries := map[string]*hostCacheEntry{}
+
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return entries, nil
+}
+
+// saveHostCache saves parallelism of host in the JSON file, keeping the entries of the other hosts.
+func saveHostCache(filename string, host string, parallelism int) error {
+	entries, err := loadHostCache(filename)
+	if err != nil {
+		// The broken file is overwritten.
+		entries = map[string]*hostCacheEntry{}
+	}
+
+	entries[host] = &hostCacheEntry{Parallelism: parallelism, Updated: time.Now()}
+
+	return persisting.WriteJSON(filename, entries)
+}
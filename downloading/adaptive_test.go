@@ -0,0 +1,316 @@
+package downloading
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDownloading_Download_Adaptive(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := readTestdata("foo.png")
+
+	defer func(size int, backoff time.Duration, maxRetryAfter time.Duration) {
+		adaptiveChunkSize = size
+		adaptiveBackoff = backoff
+		adaptiveMaxRetryAfter = maxRetryAfter
+	}(adaptiveChunkSize, adaptiveBackoff, adaptiveMaxRetryAfter)
+	adaptiveChunkSize = 16 << 10
+	adaptiveBackoff = 10 * time.Millisecond
+	adaptiveMaxRetryAfter = 20 * time.Millisecond
+
+	cases := map[string]struct {
+		// limit is the number of concurrent range requests over which the server responds 429, or 0 for no limit.
+		limit int
+		// retryAfter is Retry-After header of 429, or empty for none.
+		retryAfter string
+		// remembered is the parallelism in the host cache before the download, or 0 for none.
+		remembered int
+
+		expectedLogs []string
+	}{
+		"ramp up": {
+			expectedLogs: []string{"parallelism: 2\n", "parallelism: 3\n"},
+		},
+		"too many requests": {
+			limit:        2,
+			expectedLogs: []string{"parallelism: 3\n", "back off: unexpected status code: 429, parallelism: 1, retry in 10ms\n"},
+		},
+		"far Retry-After": {
+			limit:        2,
+			retryAfter:   "3600",
+			expectedLogs: []string{"back off: unexpected status code: 429, parallelism: 1, retry in 20ms\n"},
+		},
+		"remembered": {
+			remembered:   5,
+			expectedLogs: []string{"remembered parallelism for HOST: 5\n", "parallelism: 5\n"},
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			var active int32
+			ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					defer atomic.AddInt32(&active, -1)
+					if n := atomic.AddInt32(&active, 1); c.limit > 0 && int(n) > c.limit {
+						if c.retryAfter != "" {
+							w.Header().Set("Retry-After", c.retryAfter)
+						}
+						w.WriteHeader(http.StatusTooManyRequests)
+						return
+					}
+					// The requests overlap so that the server sees the parallelism.
+					time.Sleep(20 * time.Millisecond)
+				}
+				normalHandler(t, w, r)
+			})
+			defer clean()
+
+			host := mustParseRequestURI(t, ts.URL).Host
+
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			hostCache := filepath.Join(dir, "cache", "hosts.json")
+			if c.remembered > 0 {
+				err := saveHostCache(hostCache, host, c.remembered)
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+			}
+
+			output := filepath.Join(dir, "output.txt")
+			log := &lockedBuffer{}
+
+			d := newDownloader(t, output, ts, 8)
+			d.outStream = log
+			d.adaptive = true
+			d.hostCache = hostCache
+
+			err := d.Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, content)
+
+			for _, expected := range c.expectedLogs {
+				expected = strings.Replace(expected, "HOST", host, 1)
+				if !strings.Contains(log.String(), expected) {
+					t.Errorf("unexpected log: expected to contain: %q actual: %q", expected, log.String())
+				}
+			}
+
+			entries, err := loadHostCache(hostCache)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if e, ok := entries[host]; !ok || e.Parallelism < 1 || e.Parallelism > 8 {
+				t.Errorf("unexpected host cache: %q is not remembered: %v", host, entries)
+			}
+			if c.limit > 0 && entries[host].Parallelism > c.limit {
+				t.Errorf("unexpected parallelism: expected: <= %d actual: %d", c.limit, entries[host].Parallelism)
+			}
+		})
+	}
+}
+
+func TestDownloading_Download_AdaptiveMirrors(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	defer func(size int, backoff time.Duration) {
+		adaptiveChunkSize = size
+		adaptiveBackoff = backoff
+	}(adaptiveChunkSize, adaptiveBackoff)
+	adaptiveChunkSize = 16 << 10
+	adaptiveBackoff = 10 * time.Millisecond
+
+	var gets [2]int32
+	var urls []string
+	for i := range gets {
+		i := i
+		ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && atomic.AddInt32(&gets[i], 1) == 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			normalHandler(t, w, r)
+		})
+		defer clean()
+
+		urls = append(urls, ts.URL)
+	}
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloaderWithURL(t, output, urls[0], 4)
+	d.mirrors = []*url.URL{mustParseRequestURI(t, urls[1])}
+	d.outStream = &lockedBuffer{}
+	d.adaptive = true
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, registeredTestdatum["foo.png"])
+}
+
+func TestDownloading_hostCacheKey(t *testing.T) {
+	cases := map[string]struct {
+		mirrors  []string
+		expected string
+	}{
+		"no mirror": {expected: "b.example.com"},
+		"mirrors":   {mirrors: []string{"http://c.example.com/foo", "http://a.example.com:8080/foo"}, expected: "a.example.com:8080,b.example.com,c.example.com"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			d := &Downloader{url: mustParseRequestURI(t, "http://b.example.com/foo")}
+			for _, m := range c.mirrors {
+				d.mirrors = append(d.mirrors, mustParseRequestURI(t, m))
+			}
+
+			if actual := d.hostCacheKey(); actual != c.expected {
+				t.Errorf("unexpected key: expected: %q actual: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDownloading_adaptiveLimiter(t *testing.T) {
+	now := time.Now()
+
+	l := newAdaptiveLimiter(2, 4)
+	l.now = func() time.Time { return now }
+	l.resetWindow()
+
+	// window completes the chunks of a window of the current limit in the specified duration.
+	window := func(n int, d time.Duration) bool {
+		changed := false
+		limit := l.limit
+		for i := 0; i < limit; i++ {
+			if i == limit-1 {
+				now = now.Add(d)
+			}
+			changed = l.done(n)
+		}
+		return changed
+	}
+
+	// backoff backs off for the request started at the specified time, and reports whether it has backed off.
+	backoff := func(started time.Time) bool {
+		return l.backoff(started)
+	}
+
+	steps := []struct {
+		name     string
+		step     func() bool
+		expected int
+		changed  bool
+	}{
+		{name: "first window", step: func() bool { return window(100, time.Second) }, expected: 3, changed: true},
+		{name: "improved", step: func() bool { return window(100, time.Second) }, expected: 4, changed: true},
+		{name: "improved at max", step: func() bool { return window(100, time.Second) }, expected: 4},
+		{name: "not improved", step: func() bool { return window(100, 2*time.Second) }, expected: 4},
+		{name: "backoff", step: func() bool { return backoff(now) }, expected: 2, changed: true},
+		{name: "backoff of old request", step: func() bool { return backoff(now.Add(-time.Second)) }, expected: 2},
+		{name: "ramp up after backoff", step: func() bool { return window(100, time.Second) }, expected: 3, changed: true},
+		{name: "capped after backoff", step: func() bool { return window(100, time.Second) }, expected: 3},
+		{name: "worse", step: func() bool { return window(10, time.Second) }, expected: 3},
+	}
+
+	for _, s := range steps {
+		changed := s.step()
+		if l.limit != s.expected || changed != s.changed {
+			t.Fatalf("%s: unexpected limit: expected: %d (changed: %t) actual: %d (changed: %t)", s.name, s.expected, s.changed, l.limit, changed)
+		}
+	}
+
+	l = newAdaptiveLimiter(3, 8)
+	l.now = func() time.Time { return now }
+	l.resetWindow()
+
+	window(100, time.Second)
+	if changed := window(100, 2*time.Second); !changed || l.limit != 3 {
+		t.Errorf("unexpected limit: the limit does not go back to the best: expected: 3 actual: %d", l.limit)
+	}
+}
+
+func TestDownloading_isBackoffError(t *testing.T) {
+	reset := &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}
+	refused := &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}
+
+	cases := map[string]struct {
+		err      error
+		expected bool
+	}{
+		"429":                {err: &statusError{code: http.StatusTooManyRequests}, expected: true},
+		"503":                {err: &statusError{code: http.StatusServiceUnavailable}, expected: true},
+		"500":                {err: &statusError{code: http.StatusInternalServerError}, expected: false},
+		"connection reset":   {err: reset, expected: true},
+		"connection refused": {err: refused, expected: false},
+		"other":              {err: errors.New("foo"), expected: false},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			if actual := isBackoffError(c.err); actual != c.expected {
+				t.Errorf("unexpected result: expected: %t actual: %t", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDownloading_newStatusError_RetryAfter(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "3")
+
+	e := newStatusError(&http.Response{StatusCode: http.StatusTooManyRequests, Header: header})
+	if e.retryAfter != 3*time.Second {
+		t.Errorf("unexpected Retry-After: expected: %s actual: %s", 3*time.Second, e.retryAfter)
+	}
+}
+
+func TestDownloading_loadHostCache_Broken(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	hostCache := filepath.Join(dir, "hosts.json")
+	err := ioutil.WriteFile(hostCache, []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	d := &Downloader{outStream: ioutil.Discard, hostCache: hostCache}
+	if actual := d.initialParallelism("example.com"); actual != adaptiveInitialParallelism {
+		t.Errorf("unexpected parallelism: expected: %d actual: %d", adaptiveInitialParallelism, actual)
+	}
+
+	// The broken file is overwritten.
+	d.rememberParallelism("example.com", 4)
+
+	entries, err := loadHostCache(hostCache)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if e := entries["example.com"]; e == nil || e.Parallelism != 4 {
+		t.Errorf("unexpected host cache: %v", entries)
+	}
+}
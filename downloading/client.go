@@ -0,0 +1,174 @@
+package downloading
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+	"github.com/hioki-daichi/parallel-download/opt"
+	"golang.org/x/net/http2"
+)
+
+// dialFunc is the function to make the connections of the HTTP client.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialer makes the TCP connections for the HEAD and range requests,
+// overriding the hosts and the ports by --connect-to and --resolve, and the address family by -4 and -6.
+type dialer struct {
+	net.Dialer
+
+	network    string
+	resolves   []*opt.Resolve
+	connectTos []*opt.ConnectTo
+}
+
+// newDialer returns dialer with the overrides of opts, which connects from localAddr unless it is nil.
+func newDialer(opts *opt.Options, localAddr net.Addr) *dialer {
+	return &dialer{
+		Dialer:     net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, LocalAddr: localAddr},
+		network:    opts.Network,
+		resolves:   opts.Resolves,
+		connectTos: opts.ConnectTos,
+	}
+}
+
+// DialContext connects to addr, or to the address it is overridden with.
+// As curl does, --connect-to is applied first, and then --resolve to the resulting host and port.
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range d.connectTos {
+		if (c.Host == "" || strings.EqualFold(c.Host, host)) && (c.Port == "" || c.Port == port) {
+			if c.ToHost != "" {
+				host = c.ToHost
+			}
+			if c.ToPort != "" {
+				port = c.ToPort
+			}
+			break
+		}
+	}
+
+	for _, r := range d.resolves {
+		if strings.EqualFold(r.Host, host) && r.Port == port {
+			host = r.Addr
+			break
+		}
+	}
+
+	if network == "tcp" && d.network != "" {
+		network = d.network
+	}
+
+	return d.Dialer.DialContext(ctx, network, net.JoinHostPort(host, port))
+}
+
+// NewHTTPClient returns the HTTP client configured by opts, which is used for the HTTP(S) URLs of the downloads.
+// It is for the requests made outside the downloads, such as those of the listings and the metalinks,
+// so that they follow the redirects and connect in the same way.
+func NewHTTPClient(opts *opt.Options) *http.Client {
+	return newHTTPClient(opts, newDialer(opts, nil).DialContext)
+}
+
+// newHTTPClient returns the HTTP client for the HTTP(S) URLs.
+// Its connections are made to the Unix domain socket if it is specified.
+// HTTP/2 is negotiated by ALPN as http.DefaultTransport does, unless it is required by --http2,
+// or HTTP/1.1 is forced by --connection-per-range.
+func newHTTPClient(opts *opt.Options, dial dialFunc) *http.Client {
+	client := &http.Client{CheckRedirect: checkRedirect(opts.MaxRedirects, opts.NoFollow)}
+
+	switch {
+	case opts.UnixSocket != "":
+		client.Transport = newUnixTransport(opts.UnixSocket)
+	case opts.HTTP2:
+		client.Transport = newHTTP2Transport(dial, opts.HTTP2Connections)
+	case opts.ConnectionPerRange:
+		t := newTransport(dial, http.ProxyFromEnvironment)
+		// HTTP/2 is not negotiated, since it would multiplex the requests over one connection.
+		t.DisableKeepAlives = true
+		client.Transport = t
+	default:
+		t := newTransport(dial, http.ProxyFromEnvironment)
+		// It fails only if HTTP/2 is already configured.
+		http2.ConfigureTransport(t)
+		client.Transport = t
+	}
+
+	if opts.Metrics != nil {
+		client.Transport = &meteredTransport{RoundTripper: client.Transport, metrics: opts.Metrics}
+	}
+
+	return client
+}
+
+// meteredTransport records the duration of each request until its response header by the status code in metrics.
+// The requests canceled by the download, such as by an error of another range or the stall timeout, are recorded as "canceled"
+// rather than "error", since they do not tell that the server failed.
+type meteredTransport struct {
+	http.RoundTripper
+	metrics *metrics.Metrics
+}
+
+func (t *meteredTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		t.metrics.ObserveRequest("canceled", time.Since(start))
+		return nil, err
+	}
+	if err != nil {
+		t.metrics.ObserveRequest("error", time.Since(start))
+		return nil, err
+	}
+	t.metrics.ObserveRequest(strconv.Itoa(resp.StatusCode), time.Since(start))
+	return resp, nil
+}
+
+// checkRedirect returns the redirect policy which follows up to maxRedirects redirects, or none if noFollow.
+// As opt.Options, maxRedirects is opt.DefaultMaxRedirects if it is 0, and follows none if it is negative.
+// The redirects from HTTPS to HTTP are refused, since the content would be exposed to tampering.
+func checkRedirect(maxRedirects int, noFollow bool) func(req *http.Request, via []*http.Request) error {
+	if maxRedirects == 0 {
+		maxRedirects = opt.DefaultMaxRedirects
+	}
+	if maxRedirects < 0 {
+		noFollow = true
+	}
+
+	return func(req *http.Request, via []*http.Request) error {
+		if noFollow {
+			return fmt.Errorf("redirect to %s is not followed", req.URL)
+		}
+
+		if len(via) > maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		if via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return fmt.Errorf("redirect from HTTPS to HTTP is refused: %s", req.URL)
+		}
+
+		return nil
+	}
+}
+
+// newTransport returns the transport with the same settings as http.DefaultTransport except dial and proxy.
+func newTransport(dial dialFunc, proxy func(*http.Request) (*url.URL, error)) *http.Transport {
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,138 @@
+package downloading
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_DialerOverride(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	cases := map[string]struct {
+		rawurl      string
+		resolves    []*opt.Resolve
+		connectTos  []*opt.ConnectTo
+		network     string
+		expectedErr bool
+	}{
+		"--resolve": {
+			rawurl:   "http://example.com:" + port + "/foo.png",
+			resolves: []*opt.Resolve{{Host: "example.com", Port: port, Addr: "127.0.0.1"}},
+		},
+		"--connect-to": {
+			rawurl:     "http://cdn.example.com/foo.png",
+			connectTos: []*opt.ConnectTo{{Host: "cdn.example.com", Port: "80", ToHost: "127.0.0.1", ToPort: port}},
+		},
+		"--connect-to and --resolve": {
+			rawurl:     "http://cdn.example.com/foo.png",
+			connectTos: []*opt.ConnectTo{{Port: "80", ToHost: "origin.example.com", ToPort: port}},
+			resolves:   []*opt.Resolve{{Host: "origin.example.com", Port: port, Addr: "127.0.0.1"}},
+		},
+		"-4": {
+			rawurl:   "http://example.com:" + port + "/foo.png",
+			resolves: []*opt.Resolve{{Host: "example.com", Port: port, Addr: "127.0.0.1"}},
+			network:  "tcp4",
+		},
+		"-6 to IPv4 address": {
+			rawurl:      "http://example.com:" + port + "/foo.png",
+			resolves:    []*opt.Resolve{{Host: "example.com", Port: port, Addr: "127.0.0.1"}},
+			network:     "tcp6",
+			expectedErr: true,
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			opts := &opt.Options{
+				Parallelism: 4,
+				Output:      output,
+				URL:         mustParseRequestURI(t, c.rawurl),
+				Timeout:     60 * time.Second,
+				Resolves:    c.resolves,
+				ConnectTos:  c.connectTos,
+				Network:     c.network,
+			}
+
+			err := NewDownloader(ioutil.Discard, opts).Download(context.Background())
+			if c.expectedErr {
+				if err == nil {
+					t.Fatal("Unexpectedly err was nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, readTestdata("foo.png"))
+		})
+	}
+}
+
+func TestDownloading_Download_BindAddresses(t *testing.T) {
+	// 127.0.0.2 is available on the loopback interface of Linux, but not of some other platforms.
+	ln, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %s", err)
+	}
+	ln.Close()
+
+	currentTestdataName = "foo.png"
+
+	var mu sync.Mutex
+	sources := map[string]int{}
+
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			mu.Lock()
+			sources[host]++
+			mu.Unlock()
+		}
+		normalHandler(t, w, r)
+	})
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	opts := &opt.Options{
+		Parallelism:   4,
+		Output:        output,
+		URL:           mustParseRequestURI(t, ts.URL),
+		Timeout:       60 * time.Second,
+		BindAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")},
+	}
+
+	err = NewDownloader(ioutil.Discard, opts).Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, readTestdata("foo.png"))
+
+	expected := map[string]int{"127.0.0.1": 2, "127.0.0.2": 2}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("unexpected sources: expected: %v actual: %v", expected, sources)
+	}
+}
@@ -15,40 +15,109 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hioki-daichi/parallel-download/metrics"
 	"github.com/hioki-daichi/parallel-download/opt"
 	"github.com/hioki-daichi/parallel-download/termination"
+	"github.com/hioki-daichi/parallel-download/throttling"
 	"golang.org/x/sync/errgroup"
 )
 
-var (
-	errResponseDoesNotIncludeAcceptRangesHeader = errors.New("response does not include Accept-Ranges header")
-	errValueOfAcceptRangesHeaderIsNotBytes      = errors.New("the value of Accept-Ranges header is not bytes")
-	errNoContent                                = errors.New("no content")
-)
+var errNoContent = errors.New("no content")
 
 // Downloader has the information for the download.
 type Downloader struct {
-	outStream   io.Writer
-	url         *url.URL
-	parallelism int
-	output      string
-	timeout     time.Duration
+	// length, received and retries are the progress of the download, which are accessed atomically.
+	// They are the first fields to be 64-bit aligned on 32-bit platforms.
+	length   int64
+	received int64
+	retries  int64
+
+	outStream      io.Writer
+	url            *url.URL
+	parallelism    int
+	output         string
+	dir            string
+	outputTemplate string
+	timeout        time.Duration
+	maxBuffer      int
+	mirrors        []*url.URL
+	stallTimeout   time.Duration
+	checksum       *opt.Checksum
+	pieces         *opt.Pieces
+	pieceRetries   int
+	bandwidth      int
+	resolution     string
+	multiRange     int
+	size           int64
+	adaptive       bool
+	hostCache      string
+	workDir        string
+	throttle       *throttling.Throttle
+	metrics        *metrics.Metrics
+
+	// header is the header of the HEAD response, which is used to expand the output template.
+	header http.Header
+
+	// protocols are the protocols by scheme for each bind address.
+	protocols    []map[string]protocol
+	protocolCntr uint32
+
+	// locations are the final URLs which the URLs were redirected to by the HEAD requests.
+	locations   map[string]*url.URL
+	locationsMu sync.Mutex
+
+	sources     []*source
+	sourcesOnce sync.Once
+	sourceCntr  uint32
+
+	// saved is the path to save the downloaded file, requests are the requests in flight,
+	// and retryErrors are the latest errors retried on, which are reported while downloading.
+	saved       string
+	requests    map[*trackedBody]struct{}
+	retryErrors []RetryError
+	progressMu  sync.Mutex
 }
 
 // NewDownloader generates Downloader based on Options.
 func NewDownloader(w io.Writer, opts *opt.Options) *Downloader {
 	return &Downloader{
-		outStream:   w,
-		url:         opts.URL,
-		parallelism: opts.Parallelism,
-		output:      opts.Output,
-		timeout:     opts.Timeout,
+		outStream:      w,
+		url:            opts.URL,
+		parallelism:    opts.Parallelism,
+		output:         opts.Output,
+		dir:            opts.Dir,
+		outputTemplate: opts.OutputTemplate,
+		timeout:        opts.Timeout,
+		maxBuffer:      opts.MaxBuffer,
+		mirrors:        opts.Mirrors,
+		stallTimeout:   opts.StallTimeout,
+		checksum:       opts.Checksum,
+		pieces:         opts.Pieces,
+		pieceRetries:   opts.PieceRetries,
+		bandwidth:      opts.Bandwidth,
+		resolution:     opts.Resolution,
+		multiRange:     opts.MultiRange,
+		size:           opts.Size,
+		adaptive:       opts.Adaptive,
+		hostCache:      opts.HostCache,
+		workDir:        opts.WorkDir,
+		throttle:       opts.Throttle,
+		metrics:        opts.Metrics,
+		protocols:      newProtocolSets(w, opts),
 	}
 }
 
+// IsSupported reports whether the scheme of u is supported by Downloader.
+func IsSupported(u *url.URL) bool {
+	_, ok := newProtocols(ioutil.Discard, &opt.Options{}, nil)[u.Scheme]
+	return ok
+}
+
 // Download performs parallel download.
 func (d *Downloader) Download(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, d.timeout)
@@ -59,59 +128,169 @@ func (d *Downloader) Download(ctx context.Context) error {
 		return err
 	}
 
-	rangeHeaders := d.toRangeHeaders(contentLength)
+	err = d.verifyMirrors(ctx, contentLength)
+	if err != nil {
+		return err
+	}
+
+	output, err := d.outputPath()
+	if err != nil {
+		return err
+	}
+
+	err = d.checkSameFile(output)
+	if err != nil {
+		return err
+	}
+
+	n := d.parallelism
+	if d.adaptive {
+		n = adaptiveChunks(contentLength, d.parallelism)
+	}
+
+	chunks, err := d.toChunks(contentLength, n)
+	if err != nil {
+		return err
+	}
+
+	dir := d.workDir
+	if dir == "" {
+		dir, err = ioutil.TempDir("", "parallel-download")
+		if err != nil {
+			return err
+		}
+		clean := func() { os.RemoveAll(dir) }
+		defer clean()
+		defer termination.CleanFunc(clean)()
+	} else {
+		err = d.prepareWorkDir(chunks, contentLength)
+		if err != nil {
+			return err
+		}
+	}
+
+	filenames, missing, err := d.resumeChunks(ctx, chunks)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		pending := make([]chunk, len(missing))
+		for k, i := range missing {
+			pending[k] = chunks[i]
+		}
+
+		downloaded, err := d.downloadChunks(ctx, pending, dir)
+		if err != nil {
+			return err
+		}
+
+		for k, i := range missing {
+			filenames[i] = downloaded[k]
+		}
+	}
 
-	tempDir, err := ioutil.TempDir("", "parallel-download")
+	filename, err := d.concat(filenames, dir)
 	if err != nil {
 		return err
 	}
-	clean := func() { os.RemoveAll(tempDir) }
-	defer clean()
-	termination.CleanFunc(clean)
 
-	filenames, err := d.parallelDownload(ctx, rangeHeaders, tempDir)
+	err = d.verifyChecksum(filename)
 	if err != nil {
+		// The ranges are not resumed, since the corrupt one is unknown.
+		d.removeWorkDir()
 		return err
 	}
 
-	filename, err := d.concat(filenames, tempDir)
+	err = d.verifyContent(ctx, filename)
 	if err != nil {
+		d.removeWorkDir()
 		return err
 	}
 
-	fmt.Fprintf(d.outStream, "rename %q to %q\n", filename, d.output)
+	fmt.Fprintf(d.outStream, "rename %q to %q\n", filename, output)
 
-	err = os.Rename(filename, d.output)
+	err = os.Rename(filename, output)
 	if err != nil {
 		return err
 	}
 
-	fmt.Fprintf(d.outStream, "completed: %q\n", d.output)
+	d.removeWorkDir()
+
+	fmt.Fprintf(d.outStream, "completed: %q\n", output)
 
 	return nil
 }
 
-// getContentLength returns the value of Content-Length received by making a HEAD request.
-func (d *Downloader) getContentLength(ctx context.Context) (int, error) {
-	fmt.Fprintf(d.outStream, "start HEAD request to get Content-Length\n")
+// outputPath returns the path to save the downloaded file.
+// If no output is specified, the path is generated from the output template.
+// If a directory or an output template is specified, the parent directories are created.
+func (d *Downloader) outputPath() (string, error) {
+	output := d.output
 
-	req, err := http.NewRequest("HEAD", d.url.String(), nil)
-	if err != nil {
-		return 0, err
+	if output == "" {
+		var err error
+		output, err = d.expandOutputPath()
+		if err != nil {
+			return "", err
+		}
+	} else if d.dir != "" && !filepath.IsAbs(output) {
+		output = filepath.Join(d.dir, output)
+	}
+
+	if d.dir != "" || d.outputTemplate != "" {
+		err := os.MkdirAll(filepath.Dir(output), 0755)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	d.setOutput(output)
+
+	return output, nil
+}
+
+// expandOutputPath returns the path generated from the output template under the directory to save.
+// The path must stay in the directory of the template before its first placeholder,
+// since the values from the URL and the header such as an ETag of ".." could escape it.
+func (d *Downloader) expandOutputPath() (string, error) {
+	tmpl := d.outputTemplate
+	if tmpl == "" {
+		tmpl = defaultOutputTemplate
 	}
-	req = req.WithContext(ctx)
 
-	resp, err := http.DefaultClient.Do(req)
+	expanded, err := expandOutputTemplate(tmpl, d.url, d.header, time.Now())
 	if err != nil {
-		return 0, err
+		return "", err
 	}
 
-	err = d.validateAcceptRangesHeader(resp)
+	// The expansion keeps the directory before the first placeholder as it is.
+	prefix := tmpl
+	if loc := placeholderRegexp.FindStringIndex(tmpl); loc != nil {
+		prefix = tmpl[:loc[0]]
+	}
+	prefix = prefix[:strings.LastIndex(prefix, "/")+1]
+
+	dir := filepath.FromSlash(prefix)
+	if d.dir != "" && !filepath.IsAbs(dir) {
+		dir = filepath.Join(d.dir, dir)
+	}
+
+	return JoinInDir(dir, strings.TrimPrefix(expanded, prefix))
+}
+
+// getContentLength returns the size of the content received by making a HEAD request, or its equivalent of the protocol.
+func (d *Downloader) getContentLength(ctx context.Context) (int, error) {
+	fmt.Fprintf(d.outStream, "start HEAD request to get Content-Length\n")
+
+	md, err := d.head(ctx, d.url)
 	if err != nil {
 		return 0, err
 	}
 
-	contentLength := int(resp.ContentLength)
+	d.header = md.header
+
+	contentLength := int(md.contentLength)
 
 	fmt.Fprintf(d.outStream, "got: Content-Length: %d\n", contentLength)
 
@@ -119,77 +298,164 @@ func (d *Downloader) getContentLength(ctx context.Context) (int, error) {
 		return 0, errNoContent
 	}
 
+	if d.size > 0 && int64(contentLength) != d.size {
+		return 0, fmt.Errorf("Content-Length %d differs from the size %d", contentLength, d.size)
+	}
+
+	atomic.StoreInt64(&d.length, int64(contentLength))
+
 	return contentLength, nil
 }
 
-// validateAcceptRangesHeader validates the following.
-// - The presence of an Accept-Ranges header
-// - The value of the Accept-Ranges header is "bytes"
-func (d *Downloader) validateAcceptRangesHeader(resp *http.Response) error {
-	acceptRangesHeader := resp.Header.Get("Accept-Ranges")
+// head returns the metadata of the content at u with the protocol for its scheme.
+func (d *Downloader) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	p, err := d.protocol(u)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Fprintf(d.outStream, "got: Accept-Ranges: %s\n", acceptRangesHeader)
+	release, err := d.acquire(ctx, u)
+	if err != nil {
+		return nil, err
+	}
 
-	if acceptRangesHeader == "" {
-		return errResponseDoesNotIncludeAcceptRangesHeader
+	md, err := p.head(ctx, u)
+	release(err)
+	if err != nil {
+		return nil, err
 	}
 
-	if acceptRangesHeader != "bytes" {
-		return errValueOfAcceptRangesHeaderIsNotBytes
+	if md.location != nil && md.location.String() != u.String() {
+		fmt.Fprintf(d.outStream, "redirected: %s to %s\n", u, md.location)
+		d.setLocation(u, md.location)
 	}
 
-	return nil
+	return md, nil
 }
 
-// toRangeHeaders converts the value of Content-Length to the value of Range header.
-func (d *Downloader) toRangeHeaders(contentLength int) []string {
-	parallelism := d.parallelism
+// setLocation records location as the final URL which u was redirected to.
+func (d *Downloader) setLocation(u *url.URL, location *url.URL) {
+	d.locationsMu.Lock()
+	defer d.locationsMu.Unlock()
 
-	// 1 <= parallelism <= Content-Length
-	if parallelism < 1 {
-		parallelism = 1
+	if d.locations == nil {
+		d.locations = map[string]*url.URL{}
 	}
-	if contentLength < parallelism {
-		parallelism = contentLength
+	d.locations[u.String()] = location
+}
+
+// location returns the final URL which u was redirected to, or u if it was not redirected.
+func (d *Downloader) location(u *url.URL) *url.URL {
+	d.locationsMu.Lock()
+	defer d.locationsMu.Unlock()
+
+	if location, ok := d.locations[u.String()]; ok {
+		return location
 	}
+	return u
+}
 
-	unitLength := contentLength / parallelism
-	remainingLength := contentLength % parallelism
+// toChunks splits the content of the specified length into n chunks.
+// If the hashes of pieces are specified, the chunks are aligned to the pieces so that each piece can be verified.
+func (d *Downloader) toChunks(contentLength int, n int) ([]chunk, error) {
+	if d.pieces == nil {
+		return splitContent(contentLength, n), nil
+	}
+
+	numPieces, err := d.numPieces(contentLength)
+	if err != nil {
+		return nil, err
+	}
 
-	var rangeHeaders []string
+	var chunks []chunk
+	for _, c := range splitContent(numPieces, n) {
+		last := (c.last+1)*d.pieces.Length - 1
+		if last >= contentLength {
+			last = contentLength - 1
+		}
+		chunks = append(chunks, chunk{first: c.first * d.pieces.Length, last: last})
+	}
+
+	return chunks, nil
+}
+
+// chunk represents the byte range of the content from first to last inclusive.
+type chunk struct {
+	first int
+	last  int
+}
+
+// rangeHeader returns the value of Range header to request c.
+func (c chunk) rangeHeader() string {
+	return fmt.Sprintf("bytes=%d-%d", c.first, c.last)
+}
+
+// length returns the number of bytes in c.
+func (c chunk) length() int {
+	return c.last - c.first + 1
+}
+
+// splitContent splits the content of the specified length into n chunks.
+func splitContent(contentLength int, n int) []chunk {
+	// 1 <= n <= Content-Length
+	if n < 1 {
+		n = 1
+	}
+	if contentLength < n {
+		n = contentLength
+	}
+
+	unitLength := contentLength / n
+	remainingLength := contentLength % n
+
+	var chunks []chunk
 
 	cntr := 0
-	for n := parallelism; n > 0; n-- {
+	for i := n; i > 0; i-- {
 		min := cntr
 		max := cntr + unitLength - 1
 
 		// Add the remaining length to the last chunk
-		if n == 1 && remainingLength != 0 {
+		if i == 1 && remainingLength != 0 {
 			max += remainingLength
 		}
 
-		rangeHeaders = append(rangeHeaders, fmt.Sprintf("bytes=%d-%d", min, max))
+		chunks = append(chunks, chunk{first: min, last: max})
 
 		cntr += unitLength
 	}
 
-	return rangeHeaders
+	return chunks
+}
+
+// downloadChunks downloads the chunks in the way specified by the options, and saves them in the specified dir.
+// It returns the filenames by the index of the chunks.
+func (d *Downloader) downloadChunks(ctx context.Context, chunks []chunk, dir string) (map[int]string, error) {
+	switch {
+	case d.multiRange > 0:
+		return d.multiRangeDownload(ctx, chunks, dir)
+	case d.adaptive:
+		return d.adaptiveDownload(ctx, chunks, dir)
+	default:
+		return d.parallelDownload(ctx, chunks, dir)
+	}
 }
 
-// parallelDownload downloads in parallel for each specified rangeHeaders and saves it in the specified dir.
-func (d *Downloader) parallelDownload(ctx context.Context, rangeHeaders []string, dir string) (map[int]string, error) {
+// parallelDownload downloads in parallel for each specified chunks and saves it in the specified dir.
+func (d *Downloader) parallelDownload(ctx context.Context, chunks []chunk, dir string) (map[int]string, error) {
 	filenames := map[int]string{}
 
-	filenameCh := make(chan map[int]string)
-	errCh := make(chan error)
+	// Buffered so that the goroutines finishing after an error do not block forever.
+	filenameCh := make(chan map[int]string, len(chunks))
+	errCh := make(chan error, len(chunks))
 
-	for i, rangeHeader := range rangeHeaders {
-		go d.partialDownloadAndSendToChannel(ctx, i, rangeHeader, filenameCh, errCh, dir)
+	for i, c := range chunks {
+		go d.partialDownloadAndSendToChannel(ctx, i, c, filenameCh, errCh, dir)
 	}
 
 	eg, ctx := errgroup.WithContext(ctx)
 	var mu sync.Mutex
-	for i := 0; i < len(rangeHeaders); i++ {
+	for i := 0; i < len(chunks); i++ {
 		eg.Go(func() error {
 			select {
 			case <-ctx.Done():
@@ -215,8 +481,8 @@ func (d *Downloader) parallelDownload(ctx context.Context, rangeHeaders []string
 }
 
 // partialDownloadAndSendToChannel performs partialDownload and sends it to the appropriate channel according to the result.
-func (d *Downloader) partialDownloadAndSendToChannel(ctx context.Context, i int, rangeHeader string, filenameCh chan<- map[int]string, errCh chan<- error, dir string) {
-	filename, err := d.partialDownload(ctx, rangeHeader, dir)
+func (d *Downloader) partialDownloadAndSendToChannel(ctx context.Context, i int, c chunk, filenameCh chan<- map[int]string, errCh chan<- error, dir string) {
+	filename, err := d.downloadChunk(ctx, c, dir)
 	if err != nil {
 		errCh <- err
 		return
@@ -227,45 +493,109 @@ func (d *Downloader) partialDownloadAndSendToChannel(ctx context.Context, i int,
 	return
 }
 
-// partialDownload sends a partial request with the specified rangeHeader,
-// and saves the response body in the file under the specified dir,
-// and returns the filename.
-func (d *Downloader) partialDownload(ctx context.Context, rangeHeader string, dir string) (string, error) {
-	req, err := http.NewRequest("GET", d.url.String(), nil)
+// downloadChunk downloads c by partialDownload and repairs its corrupt pieces, and returns the filename.
+func (d *Downloader) downloadChunk(ctx context.Context, c chunk, dir string) (string, error) {
+	filename, source, err := d.partialDownload(ctx, c, dir)
 	if err != nil {
 		return "", err
 	}
-	req = req.WithContext(ctx)
 
-	req.Header.Set("Range", rangeHeader)
-
-	fmt.Fprintf(d.outStream, "start GET request with header: \"Range: %s\"\n", rangeHeader)
+	filename, err = d.keepChunk(filename, c)
+	if err != nil {
+		return "", err
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	err = d.repairPieces(ctx, filename, c, source)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent {
-		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	return filename, nil
+}
+
+// partialDownload sends a partial request for c,
+// and saves the response body in the file under the specified dir,
+// and returns the filename and the URL which served it.
+// If mirrors are specified, the request is sent to one of them.
+// A body shorter or longer than c is an error, since it would corrupt the concatenated file.
+func (d *Downloader) partialDownload(ctx context.Context, c chunk, dir string) (string, *url.URL, error) {
+	var filename string
+
+	source, err := d.failover(ctx, nil, func(ctx context.Context, u *url.URL) error {
+		body, err := d.requestRange(ctx, u, c.rangeHeader())
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		fp, err := os.Create(path.Join(dir, randomHexStr()))
+		if err != nil {
+			return local(err)
+		}
+		defer fp.Close()
+
+		n, err := io.Copy(&localWriter{w: fp}, body)
+		if err != nil {
+			return err
+		}
+
+		if n != int64(c.length()) {
+			return fmt.Errorf("unexpected length of %q: expected: %d actual: %d", c.rangeHeader(), c.length(), n)
+		}
+
+		filename = fp.Name()
+
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
 	}
 
-	fp, err := os.Create(path.Join(dir, randomHexStr()))
+	fmt.Fprintf(d.outStream, "downloaded: %q\n", filename)
+
+	return filename, source, nil
+}
+
+// requestRange requests the range of the content at u specified by rangeHeader with the protocol for its scheme,
+// and returns the body. If rangeHeader is empty, the whole content is requested.
+// If u was redirected by the HEAD request, the range is requested from the final URL without following the redirects again.
+// The requests are made from the bind addresses in turn, after the throttle of the host allows them.
+// The request is canceled if no data is received within stallTimeout.
+func (d *Downloader) requestRange(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	u = d.location(u)
+
+	p, err := d.nextProtocol(u)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	_, err = io.Copy(fp, resp.Body)
+	release, err := d.acquire(ctx, u)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	filename := fp.Name()
+	ctx, cancel := context.WithCancel(ctx)
+	watchdog := newStallWatchdog(d.stallTimeout, cancel)
 
-	fmt.Fprintf(d.outStream, "downloaded: %q\n", filename)
+	switch {
+	case rangeHeader == "":
+		fmt.Fprintf(d.outStream, "start GET request: %s\n", u)
+	case len(d.mirrors) > 0:
+		fmt.Fprintf(d.outStream, "start GET request to %s with header: \"Range: %s\"\n", u.Host, rangeHeader)
+	default:
+		fmt.Fprintf(d.outStream, "start GET request with header: \"Range: %s\"\n", rangeHeader)
+	}
 
-	return filename, nil
+	body, err := p.get(ctx, u, rangeHeader)
+	if err != nil {
+		watchdog.stop()
+		cancel()
+		err = watchdog.wrap(err)
+		release(err)
+		return nil, err
+	}
+
+	return &watchedBody{ReadCloser: d.track(body, u, rangeHeader, release), watchdog: watchdog, cancel: cancel}, nil
 }
 
 // concat concatenates the files in order based on the mapping of the specified filenames,
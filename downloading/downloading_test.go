@@ -58,6 +58,35 @@ func TestDownloading_Download_Success(t *testing.T) {
 
 }
 
+func TestDownloading_Download_DirAndOutputTemplate(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, "", ts, 2)
+	d.url = mustParseRequestURI(t, ts.URL+"/images/foo.png")
+	d.dir = filepath.Join(dir, "non/existent")
+	d.outputTemplate = "{host}/{path}"
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "non/existent/127.0.0.1/images/foo.png"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if string(b) != registeredTestdatum["foo.png"] {
+		t.Errorf("unexpected content")
+	}
+}
+
 func TestDownloading_Download_NoContent(t *testing.T) {
 	expected := errNoContent
 
@@ -75,6 +104,26 @@ func TestDownloading_Download_NoContent(t *testing.T) {
 	}
 }
 
+func TestDownloading_Download_SizeMismatch(t *testing.T) {
+	currentTestdataName = "a.txt"
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 2)
+	d.size = 1
+
+	expected := fmt.Sprintf("Content-Length %d differs from the size 1", len(registeredTestdatum["a.txt"]))
+
+	err := d.Download(context.Background())
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
+
 func TestDownloading_Download_AcceptRangesHeaderNotFound(t *testing.T) {
 	expected := errResponseDoesNotIncludeAcceptRangesHeader
 
@@ -148,7 +197,7 @@ func TestDownloading_Download_RenameError(t *testing.T) {
 }
 
 func TestDownloading_getContentLength_DoError(t *testing.T) {
-	expected := `Head A: unsupported protocol scheme ""`
+	expected := `unsupported scheme: ""`
 
 	ts, clean := newTestServer(t, noopHandler)
 	defer clean()
@@ -176,7 +225,7 @@ func TestDownloading_partialDownload_osCreateError(t *testing.T) {
 	})
 	defer clean()
 
-	_, err := newDownloader(t, "", ts, 2).partialDownload(context.Background(), "bytes=0-1", "non/existent/path")
+	_, _, err := newDownloader(t, "", ts, 2).partialDownload(context.Background(), chunk{first: 0, last: 1}, "non/existent/path")
 	if !regexp.MustCompile("no such file or directory").MatchString(err.Error()) {
 		t.Errorf("unexpectedly not matched: %s", err.Error())
 	}
@@ -299,10 +348,18 @@ func readTestdata(filename string) string {
 func createTempOutput(t *testing.T) (string, func()) {
 	t.Helper()
 
+	dir, clean := createTempDir(t)
+
+	return filepath.Join(dir, "output.txt"), clean
+}
+
+func createTempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
 	dir, err := ioutil.TempDir("", "parallel-download")
 	if err != nil {
 		panic(err)
 	}
 
-	return filepath.Join(dir, "output.txt"), func() { os.RemoveAll(dir) }
+	return dir, func() { os.RemoveAll(dir) }
 }
@@ -0,0 +1,119 @@
+package downloading
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+var (
+	errNotRegularFile = errors.New("not a regular file")
+	errSameFile       = errors.New("output is the same file as the source")
+)
+
+// fileProtocol reads the content of local files, including the files on network filesystems such as NFS and SMB mounts.
+// Each range is read with ReadAt of its own file descriptor, so the ranges are read in parallel.
+type fileProtocol struct{}
+
+// head gets the size and the modification time as Last-Modified of the regular file.
+func (p *fileProtocol) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	name, err := filePath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %s", name, errNotRegularFile)
+	}
+
+	header := http.Header{}
+	header.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+
+	return &metadata{contentLength: fi.Size(), header: header}, nil
+}
+
+// get opens the file and returns the reader of the range.
+func (p *fileProtocol) get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	name, err := filePath(u)
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rangeHeader == "" {
+		return fp, nil
+	}
+
+	first, last, err := parseRangeHeader(rangeHeader)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return &fileBody{SectionReader: io.NewSectionReader(fp, first, last-first+1), fp: fp}, nil
+}
+
+// filePath returns the local path of the file URL, whose host must be empty or localhost.
+func filePath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL of remote host is not supported: %s", u)
+	}
+
+	return filepath.FromSlash(u.Path), nil
+}
+
+// checkSameFile returns errSameFile if the output is the source file itself,
+// which would be replaced by the copy before it is read.
+func (d *Downloader) checkSameFile(output string) error {
+	if d.url.Scheme != "file" {
+		return nil
+	}
+
+	name, err := filePath(d.url)
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Stat(output)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if os.SameFile(src, dst) {
+		return errSameFile
+	}
+
+	return nil
+}
+
+// fileBody is the range of a file, which closes the file when closed.
+type fileBody struct {
+	*io.SectionReader
+	fp *os.File
+}
+
+func (b *fileBody) Close() error {
+	return b.fp.Close()
+}
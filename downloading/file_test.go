@@ -0,0 +1,74 @@
+package downloading
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloading_Download_File(t *testing.T) {
+	content := readTestdata("foo.png")
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloaderWithURL(t, output, testdataFileURL(t, "foo.png"), 4)
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+
+	if d.header.Get("Last-Modified") == "" {
+		t.Error("Last-Modified is not set from the modification time")
+	}
+}
+
+func TestDownloading_Download_FileError(t *testing.T) {
+	src, err := filepath.Abs(filepath.Join("testdata", "foo.png"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	cases := map[string]struct {
+		rawurl   string
+		output   string
+		expected string
+	}{
+		"directory":   {rawurl: testdataFileURL(t, ""), expected: filepath.Dir(src) + ": " + errNotRegularFile.Error()},
+		"same file":   {rawurl: testdataFileURL(t, "foo.png"), output: src, expected: errSameFile.Error()},
+		"remote host": {rawurl: "file://example.com/foo.png", expected: "file URL of remote host is not supported: file://example.com/foo.png"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			output, clean := createTempOutput(t)
+			defer clean()
+			if c.output != "" {
+				output = c.output
+			}
+
+			err := newDownloaderWithURL(t, output, c.rawurl, 2).Download(context.Background())
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+
+	assertFileContent(t, src, readTestdata("foo.png"))
+}
+
+func testdataFileURL(t *testing.T, filename string) string {
+	t.Helper()
+
+	abs, err := filepath.Abs(filepath.Join("testdata", filename))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String()
+}
@@ -0,0 +1,423 @@
+package downloading
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errInvalidPassiveReply = errors.New("invalid reply to the passive mode")
+
+// ftpProtocol accesses the content on FTP servers.
+//
+// "ftps" is FTP over implicit TLS, and "ftpes" is FTP upgraded to TLS by AUTH TLS.
+// In both, the data connections are protected as well.
+// Each range is requested over its own control and data connections, starting at the offset given by REST,
+// so the ranges are downloaded over multiple data connections in parallel.
+// The path of the URL is relative to the login directory, and it is absolute if it starts with %2F.
+type ftpProtocol struct {
+	tlsConfig *tls.Config
+	dialer    *dialer
+}
+
+// head gets the size by SIZE and the modification time by MDTM as Last-Modified,
+// and validates that the server supports REST.
+func (p *ftpProtocol) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	c, err := p.login(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	_, msg, err := c.cmd(2, "SIZE %s", ftpPath(u))
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reply to SIZE: %q", msg)
+	}
+
+	header := http.Header{}
+
+	// MDTM is optional, so the modification time is just missing if it is not supported.
+	if _, msg, err := c.cmd(2, "MDTM %s", ftpPath(u)); err == nil && len(msg) >= 14 {
+		if t, err := time.Parse("20060102150405", msg[:14]); err == nil {
+			header.Set("Last-Modified", t.Format(http.TimeFormat))
+		}
+	}
+
+	_, _, err = c.cmd(3, "REST 0")
+	if err != nil {
+		return nil, fmt.Errorf("REST is not supported: %s", err)
+	}
+
+	return &metadata{contentLength: size, header: header}, nil
+}
+
+// get retrieves the content by RETR from the offset given by REST, and reads it up to the end of the range.
+func (p *ftpProtocol) get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	var offset int64
+	length := int64(-1)
+
+	if rangeHeader != "" {
+		first, last, err := parseRangeHeader(rangeHeader)
+		if err != nil {
+			return nil, err
+		}
+		offset, length = first, last-first+1
+	}
+
+	c, err := p.login(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.openData(ctx)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if offset > 0 {
+		_, _, err = c.cmd(3, "REST %d", offset)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	_, _, err = c.cmd(1, "RETR %s", ftpPath(u))
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &ftpBody{data: data, remaining: length, conn: c}, nil
+}
+
+// login connects to the server of u and logs in with the user info of u, or anonymously.
+// The connections are closed when ctx is done.
+func (p *ftpProtocol) login(ctx context.Context, u *url.URL) (*ftpConn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "21"
+		if u.Scheme == "ftps" {
+			port = "990"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	raw, err := p.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ftpConn{raw: raw, dialer: &p.dialer.Dialer, done: make(chan struct{}), closers: []io.Closer{raw}}
+
+	var conn net.Conn = raw
+	if u.Scheme != "ftp" {
+		c.tlsConfig = p.tlsConfig.Clone()
+		if c.tlsConfig.ServerName == "" {
+			c.tlsConfig.ServerName = u.Hostname()
+		}
+	}
+	if u.Scheme == "ftps" {
+		conn = tls.Client(raw, c.tlsConfig)
+	}
+	c.Conn = textproto.NewConn(conn)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.done:
+		}
+	}()
+
+	err = c.handshake(u)
+	if err != nil {
+		c.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ftpPath returns the path of u for the FTP commands.
+func ftpPath(u *url.URL) string {
+	return strings.TrimPrefix(u.Path, "/")
+}
+
+// ftpConn is the control connection to an FTP server.
+type ftpConn struct {
+	*textproto.Conn
+	raw net.Conn
+
+	// dialer makes the data connections to the address of the control connection, which needs no override.
+	dialer *net.Dialer
+
+	// tlsConfig is nil unless the connections are protected by TLS.
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	closers []io.Closer
+	done    chan struct{}
+	closed  bool
+}
+
+// handshake reads the greeting, upgrades the connection to TLS if required, logs in and sets the binary mode.
+func (c *ftpConn) handshake(u *url.URL) error {
+	_, _, err := c.ReadResponse(2)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "ftpes" {
+		_, _, err = c.cmd(2, "AUTH TLS")
+		if err != nil {
+			return err
+		}
+		c.Conn = textproto.NewConn(tls.Client(c.raw, c.tlsConfig))
+	}
+
+	if c.tlsConfig != nil {
+		_, _, err = c.cmd(2, "PBSZ 0")
+		if err != nil {
+			return err
+		}
+		_, _, err = c.cmd(2, "PROT P")
+		if err != nil {
+			return err
+		}
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+	case 331:
+		_, _, err = c.cmd(2, "PASS %s", password)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("USER: %d %s", code, msg)
+	}
+
+	_, _, err = c.cmd(2, "TYPE I")
+
+	return err
+}
+
+// cmd sends the command and reads the reply, whose code must match expectCode as textproto.Reader.ReadResponse does.
+// An unexpected reply is reported with the command name, but without the arguments such as the password.
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+
+	code, msg, err := c.ReadResponse(expectCode)
+	if e, ok := err.(*textproto.Error); ok {
+		return code, msg, fmt.Errorf("%s: %d %s", strings.Fields(format)[0], e.Code, e.Msg)
+	}
+
+	return code, msg, err
+}
+
+// openData opens a data connection in the extended passive mode, or in the passive mode if it is not supported.
+// The data connection is made to the host of the control connection regardless of the address in the reply,
+// which may be unreachable behind NAT.
+func (c *ftpConn) openData(ctx context.Context) (net.Conn, error) {
+	var port int
+
+	_, msg, err := c.cmd(2, "EPSV")
+	if err == nil {
+		port, err = parseEPSV(msg)
+	} else {
+		_, msg, err = c.cmd(2, "PASV")
+		if err == nil {
+			port, err = parsePASV(msg)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(c.raw.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.tlsConfig != nil {
+		data = tls.Client(data, c.tlsConfig)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		data.Close()
+		return nil, ctx.Err()
+	}
+	c.closers = append(c.closers, data)
+
+	return data, nil
+}
+
+// Close closes the data connections and the control connection.
+func (c *ftpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		c.closers[i].Close()
+	}
+
+	return nil
+}
+
+// parseEPSV parses the reply to EPSV such as "Entering Extended Passive Mode (|||6446|)" and returns the port.
+func parseEPSV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start+2 {
+		return 0, errInvalidPassiveReply
+	}
+
+	inner := msg[start+1 : end]
+	fields := strings.Split(inner, inner[:1])
+	if len(fields) != 5 {
+		return 0, errInvalidPassiveReply
+	}
+
+	port, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return 0, errInvalidPassiveReply
+	}
+
+	return port, nil
+}
+
+// parsePASV parses the reply to PASV such as "Entering Passive Mode (192,168,0,1,25,46)" and returns the port.
+func parsePASV(msg string) (int, error) {
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, errInvalidPassiveReply
+	}
+
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, errInvalidPassiveReply
+	}
+
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return 0, errInvalidPassiveReply
+	}
+
+	return p1<<8 | p2, nil
+}
+
+// ftpBody is the content read from a data connection, which closes the connections when closed.
+// remaining is the bytes left in the range, or -1 if the whole content is read.
+// The transfer of a range is aborted by closing the connections once it is read,
+// and that of the whole content is completed by the reply to RETR, which is read at the end of the data.
+// The data connection closed before the end is io.ErrUnexpectedEOF, since it would look like the end of the content.
+type ftpBody struct {
+	data      net.Conn
+	remaining int64
+	conn      *ftpConn
+	err       error
+}
+
+func (b *ftpBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.remaining == 0 {
+		return 0, io.EOF
+	}
+	if b.remaining > 0 && int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.data.Read(p)
+	if b.remaining > 0 {
+		b.remaining -= int64(n)
+	}
+
+	if err == io.EOF {
+		if b.remaining > 0 {
+			err = io.ErrUnexpectedEOF
+		} else {
+			err = b.complete()
+		}
+		b.err = err
+	}
+
+	return n, err
+}
+
+// complete reads the reply to RETR after the data connection is closed by the server,
+// which is 226 if the whole content is transferred, and returns io.EOF, or the error otherwise.
+func (b *ftpBody) complete() error {
+	b.data.Close()
+
+	_, _, err := b.conn.ReadResponse(2)
+	if e, ok := err.(*textproto.Error); ok {
+		return fmt.Errorf("RETR: %d %s", e.Code, e.Msg)
+	}
+	if err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// Close closes the connections, and returns the error of the reply to RETR if it failed.
+func (b *ftpBody) Close() error {
+	b.conn.Close()
+	if b.err != nil && b.err != io.EOF && b.err != io.ErrUnexpectedEOF {
+		return b.err
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package downloading
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ftpTestServer is a minimal FTP server which serves content as foo.png.
+type ftpTestServer struct {
+	t       *testing.T
+	ln      net.Listener
+	content string
+
+	// scheme is "ftp", "ftps" for implicit TLS or "ftpes" for explicit TLS.
+	scheme    string
+	tlsConfig *tls.Config
+	noEPSV    bool
+
+	// truncate is the bytes sent by each RETR before the transfer fails, or 0 to send all.
+	truncate int
+
+	mu      sync.Mutex
+	offsets []int64
+}
+
+func newFTPTestServer(t *testing.T, scheme string, content string) (*ftpTestServer, *x509.CertPool, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	// Borrow the certificate of httptest, which is valid for 127.0.0.1.
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+
+	s := &ftpTestServer{
+		t:         t,
+		ln:        ln,
+		content:   content,
+		scheme:    scheme,
+		tlsConfig: &tls.Config{Certificates: ts.TLS.Certificates},
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s, pool, func() { ln.Close() }
+}
+
+func (s *ftpTestServer) url(userinfo string) string {
+	return fmt.Sprintf("%s://%s%s/foo.png", s.scheme, userinfo, s.ln.Addr())
+}
+
+func (s *ftpTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if s.scheme == "ftps" {
+		conn = tls.Server(conn, s.tlsConfig)
+	}
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 ready")
+
+	var (
+		rest   int64
+		dataLn net.Listener
+		prot   bool
+		user   string
+	)
+	defer func() {
+		if dataLn != nil {
+			dataLn.Close()
+		}
+	}()
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+
+		switch cmd {
+		case "AUTH":
+			tp.PrintfLine("234 proceed")
+			conn = tls.Server(conn, s.tlsConfig)
+			tp = textproto.NewConn(conn)
+		case "PBSZ":
+			tp.PrintfLine("200 ok")
+		case "PROT":
+			prot = arg == "P"
+			tp.PrintfLine("200 ok")
+		case "USER":
+			user = arg
+			tp.PrintfLine("331 password required")
+		case "PASS":
+			if user != "anonymous" && (user != "alice" || arg != "secret") {
+				tp.PrintfLine("530 login incorrect")
+				continue
+			}
+			tp.PrintfLine("230 logged in")
+		case "TYPE":
+			tp.PrintfLine("200 binary")
+		case "SIZE", "MDTM", "RETR":
+			if arg != "foo.png" {
+				tp.PrintfLine("550 %s: no such file", arg)
+				continue
+			}
+			switch cmd {
+			case "SIZE":
+				tp.PrintfLine("213 %d", len(s.content))
+			case "MDTM":
+				tp.PrintfLine("213 20190102030405")
+			default:
+				s.retr(tp, dataLn, rest, prot)
+				rest = 0
+			}
+		case "REST":
+			rest, _ = strconv.ParseInt(arg, 10, 64)
+			tp.PrintfLine("350 restarting at %d", rest)
+		case "EPSV", "PASV":
+			if cmd == "EPSV" && s.noEPSV {
+				tp.PrintfLine("502 not implemented")
+				continue
+			}
+			dataLn, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				s.t.Errorf("err %s", err)
+				return
+			}
+			port := dataLn.Addr().(*net.TCPAddr).Port
+			if cmd == "EPSV" {
+				tp.PrintfLine("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				// The address in the reply is ignored by the client.
+				tp.PrintfLine("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func (s *ftpTestServer) retr(tp *textproto.Conn, dataLn net.Listener, rest int64, prot bool) {
+	if dataLn == nil {
+		tp.PrintfLine("425 no data connection")
+		return
+	}
+
+	s.mu.Lock()
+	s.offsets = append(s.offsets, rest)
+	s.mu.Unlock()
+
+	tp.PrintfLine("150 opening data connection")
+
+	dc, err := dataLn.Accept()
+	if err != nil {
+		return
+	}
+	if prot {
+		dc = tls.Server(dc, s.tlsConfig)
+	}
+
+	if s.truncate > 0 {
+		io.WriteString(dc, s.content[rest:rest+int64(s.truncate)])
+		dc.Close()
+		tp.PrintfLine("426 connection closed; transfer aborted")
+		return
+	}
+
+	// The client closes the connection once the range is read.
+	io.WriteString(dc, s.content[rest:])
+	dc.Close()
+
+	tp.PrintfLine("226 transfer complete")
+}
+
+func TestDownloading_Download_FTP(t *testing.T) {
+	content := readTestdata("foo.png")
+
+	cases := map[string]struct {
+		scheme   string
+		userinfo string
+		noEPSV   bool
+	}{
+		"anonymous":    {scheme: "ftp"},
+		"user":         {scheme: "ftp", userinfo: "alice:secret@"},
+		"PASV":         {scheme: "ftp", noEPSV: true},
+		"implicit TLS": {scheme: "ftps"},
+		"explicit TLS": {scheme: "ftpes"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			s, pool, closeServer := newFTPTestServer(t, c.scheme, content)
+			defer closeServer()
+			s.noEPSV = c.noEPSV
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			d := newDownloaderWithURL(t, output, s.url(c.userinfo), 4)
+			d.protocols[0][c.scheme].(*ftpProtocol).tlsConfig.RootCAs = pool
+
+			err := d.Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, content)
+
+			if d.header.Get("Last-Modified") != "Wed, 02 Jan 2019 03:04:05 GMT" {
+				t.Errorf("unexpected Last-Modified: %s", d.header.Get("Last-Modified"))
+			}
+
+			// Each range is retrieved over its own data connection from the offset given by REST.
+			var expected []int64
+			for _, c := range splitContent(len(content), 4) {
+				expected = append(expected, int64(c.first))
+			}
+
+			s.mu.Lock()
+			actual := append([]int64{}, s.offsets...)
+			s.mu.Unlock()
+			sort.Slice(actual, func(i, j int) bool { return actual[i] < actual[j] })
+
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("unexpected offsets: expected: %v actual: %v", expected, actual)
+			}
+		})
+	}
+}
+
+func TestDownloading_Download_FTPError(t *testing.T) {
+	s, _, closeServer := newFTPTestServer(t, "ftp", readTestdata("foo.png"))
+	defer closeServer()
+
+	cases := map[string]struct {
+		rawurl   string
+		expected string
+	}{
+		"no such file":  {rawurl: fmt.Sprintf("ftp://%s/bar.png", s.ln.Addr()), expected: "SIZE: 550 bar.png: no such file"},
+		"login failure": {rawurl: s.url("alice:wrong@"), expected: "PASS: 530 login incorrect"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			err := newDownloaderWithURL(t, output, c.rawurl, 2).Download(context.Background())
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestDownloading_ftpProtocol_get_Truncated(t *testing.T) {
+	s, _, closeServer := newFTPTestServer(t, "ftp", readTestdata("foo.png"))
+	defer closeServer()
+	s.truncate = 10
+
+	cases := map[string]struct {
+		rangeHeader string
+		expected    string
+	}{
+		"range":         {rangeHeader: "bytes=100-199", expected: io.ErrUnexpectedEOF.Error()},
+		"whole content": {rangeHeader: "", expected: "RETR: 426 connection closed; transfer aborted"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			d := newDownloaderWithURL(t, "", s.url(""), 1)
+			p := d.protocols[0]["ftp"]
+
+			body, err := p.get(context.Background(), d.url, c.rangeHeader)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			defer body.Close()
+
+			b, err := ioutil.ReadAll(body)
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+			if len(b) != s.truncate {
+				t.Errorf("unexpected length: expected: %d actual: %d", s.truncate, len(b))
+			}
+		})
+	}
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	// The short ranges are not saved as complete.
+	err := newDownloaderWithURL(t, output, s.url(""), 2).Download(context.Background())
+	if err == nil {
+		t.Error("unexpected success of the truncated download")
+	}
+}
+
+func TestDownloading_parsePassiveReply(t *testing.T) {
+	port, err := parseEPSV("Entering Extended Passive Mode (|||6446|)")
+	if err != nil || port != 6446 {
+		t.Errorf("unexpected result of EPSV: port: %d err: %v", port, err)
+	}
+
+	port, err = parsePASV("Entering Passive Mode (192,168,0,1,25,46)")
+	if err != nil || port != 25<<8|46 {
+		t.Errorf("unexpected result of PASV: port: %d err: %v", port, err)
+	}
+
+	for _, msg := range []string{"Entering Passive Mode", "(|||x|)", "(1,2,3)"} {
+		if _, err := parseEPSV(msg); err != errInvalidPassiveReply {
+			t.Errorf("unexpected error of EPSV %q: %v", msg, err)
+		}
+		if _, err := parsePASV(msg); err != errInvalidPassiveReply {
+			t.Errorf("unexpected error of PASV %q: %v", msg, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package downloading
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+var errHTTP2NotNegotiated = errors.New("server did not negotiate HTTP/2")
+
+// newHTTP2Transport returns the transport which requires HTTP/2,
+// negotiated by ALPN over TLS for https URLs, or with prior knowledge (h2c) for http URLs.
+// The requests to each host are multiplexed over the specified number of connections in turn.
+// The connections are made directly without the proxy of the environment.
+func newHTTP2Transport(dial dialFunc, connections int) *http2.Transport {
+	if connections < 1 {
+		connections = 1
+	}
+
+	t := &http2.Transport{AllowHTTP: true, TLSClientConfig: &tls.Config{}}
+	t.ConnPool = &http2ConnPool{t: t, dial: dial, size: connections, conns: map[string][]*http2.ClientConn{}, next: map[string]int{}, dialing: map[string]chan struct{}{}}
+
+	return t
+}
+
+// http2ConnPool keeps up to size connections for each host, and spreads the requests over them in turn.
+// The connections are made outside mu, so that a stalled host does not block the requests to the others.
+type http2ConnPool struct {
+	t    *http2.Transport
+	dial dialFunc
+	size int
+
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn
+	next  map[string]int
+
+	// dialing has the channels closed when the connections being made to the hosts are ready.
+	dialing map[string]chan struct{}
+}
+
+// GetClientConn returns the connection to addr for req, which reserves a stream for the request.
+// A connection is made while the host has fewer connections than size,
+// or when all of them have reached the limit of concurrent streams.
+// The connections to a host are made one at a time, and the other requests wait for it meanwhile.
+func (p *http2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	for {
+		p.mu.Lock()
+
+		cc := p.reserve(addr)
+		if cc != nil {
+			p.mu.Unlock()
+			return cc, nil
+		}
+
+		dialing, ok := p.dialing[addr]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	done := make(chan struct{})
+	p.dialing[addr] = done
+	p.mu.Unlock()
+
+	cc, err := p.newClientConn(req, addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.dialing, addr)
+	close(done)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A new connection can always take the request.
+	cc.ReserveNewRequest()
+
+	p.conns[addr] = append(p.conns[addr], cc)
+
+	return cc, nil
+}
+
+// reserve removes the closed connections to addr, and reserves a stream of one of the others in turn
+// if the host has size connections. It returns nil if a connection should be made. p.mu must be held.
+func (p *http2ConnPool) reserve(addr string) *http2.ClientConn {
+	var conns []*http2.ClientConn
+	for _, cc := range p.conns[addr] {
+		if st := cc.State(); !st.Closed && !st.Closing {
+			conns = append(conns, cc)
+		}
+	}
+	p.conns[addr] = conns
+
+	if len(conns) < p.size {
+		return nil
+	}
+
+	for range conns {
+		cc := conns[p.next[addr]%len(conns)]
+		p.next[addr]++
+
+		if cc.ReserveNewRequest() {
+			return cc
+		}
+	}
+
+	return nil
+}
+
+// MarkDead removes the connection from the pool.
+func (p *http2ConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for addr, conns := range p.conns {
+		var alive []*http2.ClientConn
+		for _, cc := range conns {
+			if cc != dead {
+				alive = append(alive, cc)
+			}
+		}
+		p.conns[addr] = alive
+	}
+}
+
+// newClientConn connects to addr, and negotiates HTTP/2 by ALPN if the URL of req is https.
+func (p *http2ConnPool) newClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	conn, err := p.dial(req.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL.Scheme == "https" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		cfg := p.t.TLSClientConfig.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = host
+		}
+		cfg.NextProtos = []string{http2.NextProtoTLS}
+
+		tlsConn := tls.Client(conn, cfg)
+
+		// The handshake is abandoned with the request, as the dial is.
+		err = tlsConn.HandshakeContext(req.Context())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+			conn.Close()
+			return nil, errHTTP2NotNegotiated
+		}
+
+		conn = tlsConn
+	}
+
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return cc, nil
+}
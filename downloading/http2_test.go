@@ -0,0 +1,206 @@
+package downloading
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestDownloading_Download_HTTP2(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	cases := map[string]struct {
+		tls                bool
+		http2              bool
+		http2Connections   int
+		connectionPerRange bool
+		expectedProto      string
+		expectedConns      int
+	}{
+		"h2c":                    {http2: true, http2Connections: 2, expectedProto: "HTTP/2.0", expectedConns: 2},
+		"ALPN":                   {tls: true, expectedProto: "HTTP/2.0", expectedConns: 1},
+		"--http2 over TLS":       {tls: true, http2: true, http2Connections: 3, expectedProto: "HTTP/2.0", expectedConns: 3},
+		"--connection-per-range": {tls: true, connectionPerRange: true, expectedProto: "HTTP/1.1", expectedConns: 5},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			var mu sync.Mutex
+			protos := map[string]bool{}
+			conns := 0
+
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				protos[r.Proto] = true
+				mu.Unlock()
+				normalHandler(t, w, r)
+			})
+			if !c.tls {
+				handler = h2c.NewHandler(handler, &http2.Server{})
+			}
+
+			ts := httptest.NewUnstartedServer(handler)
+			ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					mu.Lock()
+					conns++
+					mu.Unlock()
+				}
+			}
+			if c.tls {
+				err := http2.ConfigureServer(ts.Config, nil)
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				ts.TLS = ts.Config.TLSConfig
+				ts.StartTLS()
+			} else {
+				ts.Start()
+			}
+			defer ts.Close()
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			opts := &opt.Options{
+				Parallelism:        4,
+				Output:             output,
+				URL:                mustParseRequestURI(t, ts.URL),
+				Timeout:            60 * time.Second,
+				HTTP2:              c.http2,
+				HTTP2Connections:   c.http2Connections,
+				ConnectionPerRange: c.connectionPerRange,
+				Verbose:            true,
+			}
+
+			out := &lockedBuffer{}
+			d := NewDownloader(out, opts)
+			if c.tls {
+				trustTestServer(d, ts)
+			}
+
+			err := d.Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, readTestdata("foo.png"))
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if len(protos) != 1 || !protos[c.expectedProto] {
+				t.Errorf("unexpected protocols: expected: %s actual: %v", c.expectedProto, protos)
+			}
+
+			if conns != c.expectedConns {
+				t.Errorf("unexpected number of connections: expected: %d actual: %d", c.expectedConns, conns)
+			}
+
+			expectedLog := "protocol: " + c.expectedProto + ` for GET request with header: "Range: bytes=0-`
+			if !strings.Contains(out.String(), expectedLog) {
+				t.Errorf("output does not contain %q", expectedLog)
+			}
+		})
+	}
+}
+
+// trustTestServer makes the HTTP client of d trust the certificate of ts.
+func trustTestServer(d *Downloader, ts *httptest.Server) {
+	pool := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	switch t := d.protocols[0]["https"].(*httpProtocol).client.Transport.(type) {
+	case *http.Transport:
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.RootCAs = pool
+	case *http2.Transport:
+		t.TLSClientConfig.RootCAs = pool
+	}
+}
+
+func TestDownloading_http2ConnPool_StalledHost(t *testing.T) {
+	// The stalled host accepts the connections but never completes the TLS handshake.
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer stalled.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := stalled.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	err = http2.ConfigureServer(ts.Config, nil)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	ts.TLS = ts.Config.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	tr := newHTTP2Transport((&net.Dialer{}).DialContext, 1)
+	tr.TLSClientConfig.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	client := &http.Client{Transport: tr}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stalledErr := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+stalled.Addr().String()+"/", nil)
+		_, err := client.Do(req.WithContext(ctx))
+		stalledErr <- err
+	}()
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("err %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the request to another host is blocked by the stalled host")
+	}
+
+	// The handshake is abandoned with the request.
+	cancel()
+	select {
+	case err := <-stalledErr:
+		if err == nil {
+			t.Error("unexpected success of the request to the stalled host")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the handshake with the stalled host is not abandoned")
+	}
+}
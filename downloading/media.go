@@ -0,0 +1,307 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hioki-daichi/parallel-download/media"
+	"github.com/hioki-daichi/parallel-download/termination"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	errNestedMasterPlaylist = errors.New("variant is a master playlist")
+	errInvalidPadding       = errors.New("invalid PKCS#7 padding")
+)
+
+// IsMedia reports whether u is an HLS playlist or a DASH manifest, judging from its extension.
+func IsMedia(u *url.URL) bool {
+	return media.IsHLS(u) || media.IsDASH(u)
+}
+
+// DownloadMedia downloads the segments of the HLS playlist or the DASH manifest at the URL,
+// and saves them concatenated in order.
+//
+// A variant is selected from a master playlist or a manifest by the bandwidth and the resolution.
+// The segments are downloaded concurrently up to the parallelism,
+// and the segments encrypted with AES-128 are decrypted with the keys.
+func (d *Downloader) DownloadMedia(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	segments, err := d.mediaSegments(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) == 0 {
+		return errNoContent
+	}
+
+	keys, err := d.fetchKeys(ctx, segments)
+	if err != nil {
+		return err
+	}
+
+	output, err := d.outputPath()
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := ioutil.TempDir("", "parallel-download")
+	if err != nil {
+		return err
+	}
+	clean := func() { os.RemoveAll(tempDir) }
+	defer clean()
+	defer termination.CleanFunc(clean)()
+
+	filenames, err := d.downloadSegments(ctx, segments, keys, tempDir)
+	if err != nil {
+		return err
+	}
+
+	filename, err := d.concat(filenames, tempDir)
+	if err != nil {
+		return err
+	}
+
+	err = d.verifyChecksum(filename)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(d.outStream, "rename %q to %q\n", filename, output)
+
+	err = os.Rename(filename, output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(d.outStream, "completed: %q\n", output)
+
+	return nil
+}
+
+// mediaSegments returns the segments of the media playlist, or of the variant selected from the master playlist.
+func (d *Downloader) mediaSegments(ctx context.Context) ([]*media.Segment, error) {
+	p, err := d.fetchPlaylist(ctx, d.url)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Variants) == 0 {
+		return p.Segments, nil
+	}
+
+	// Only the video is downloaded, so the user is told what the file lacks.
+	if len(p.Skipped) > 0 {
+		fmt.Fprintf(d.outStream, "warning: skipped adaptation sets: %s\n", strings.Join(p.Skipped, ", "))
+	}
+
+	v, err := media.SelectVariant(p.Variants, d.bandwidth, d.resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(d.outStream, "selected variant: bandwidth: %d resolution: %q\n", v.Bandwidth, v.Resolution())
+
+	// The segments of a DASH representation are resolved along with the manifest.
+	if v.URL == nil {
+		return v.Segments, nil
+	}
+
+	p, err = d.fetchPlaylist(ctx, v.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.Variants) > 0 {
+		return nil, errNestedMasterPlaylist
+	}
+
+	return p.Segments, nil
+}
+
+// fetchPlaylist requests the HLS playlist or the DASH manifest at u and parses it.
+func (d *Downloader) fetchPlaylist(ctx context.Context, u *url.URL) (*media.Playlist, error) {
+	b, err := d.fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	var p *media.Playlist
+	if media.IsDASH(u) {
+		p, err = media.ParseDASH(u, bytes.NewReader(b))
+	} else {
+		p, err = media.ParseHLS(u, bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", u, err)
+	}
+
+	return p, nil
+}
+
+// fetchKeys requests the keys of the encrypted segments and returns them by URL.
+func (d *Downloader) fetchKeys(ctx context.Context, segments []*media.Segment) (map[string][]byte, error) {
+	keys := map[string][]byte{}
+
+	for _, s := range segments {
+		if s.Key == nil {
+			continue
+		}
+
+		k := s.Key.URL.String()
+		if _, ok := keys[k]; ok {
+			continue
+		}
+
+		b, err := d.fetch(ctx, s.Key.URL)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(b) != aes.BlockSize {
+			return nil, fmt.Errorf("%s: AES-128 key must be %d bytes, but %d bytes", k, aes.BlockSize, len(b))
+		}
+
+		keys[k] = b
+	}
+
+	return keys, nil
+}
+
+// fetch requests the whole content at u and returns it.
+func (d *Downloader) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	body, err := d.requestRange(ctx, u, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", u, err)
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// downloadSegments downloads the segments concurrently up to the parallelism and saves them under the specified dir.
+// It returns the filenames by the index of the segments, as parallelDownload does.
+func (d *Downloader) downloadSegments(ctx context.Context, segments []*media.Segment, keys map[string][]byte, dir string) (map[int]string, error) {
+	parallelism := d.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	filenames := map[int]string{}
+	var mu sync.Mutex
+
+	eg, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, parallelism)
+
+	for i, s := range segments {
+		i, s := i, s
+
+		select {
+		case <-ctx.Done():
+			return nil, eg.Wait()
+		case sem <- struct{}{}:
+		}
+
+		eg.Go(func() error {
+			defer func() { <-sem }()
+
+			filename, err := d.downloadSegment(ctx, s, keys, dir)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(d.outStream, "downloaded: segment %d of %d\n", i+1, len(segments))
+
+			mu.Lock()
+			filenames[i] = filename
+			mu.Unlock()
+
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return filenames, nil
+}
+
+// downloadSegment downloads the segment, decrypting it if encrypted, and saves it in the file under the specified dir.
+func (d *Downloader) downloadSegment(ctx context.Context, s *media.Segment, keys map[string][]byte, dir string) (string, error) {
+	body, err := d.requestRange(ctx, s.URL, s.Range)
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", s.URL, err)
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+
+	if s.Key != nil {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			return "", err
+		}
+
+		b, err = decryptSegment(b, keys[s.Key.URL.String()], s.Key.IV)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", s.URL, err)
+		}
+
+		r = bytes.NewReader(b)
+	}
+
+	fp, err := os.Create(path.Join(dir, randomHexStr()))
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	_, err = io.Copy(fp, r)
+	if err != nil {
+		return "", err
+	}
+
+	return fp.Name(), nil
+}
+
+// decryptSegment decrypts b encrypted with AES-128 in CBC mode and removes the PKCS#7 padding.
+func decryptSegment(b []byte, key []byte, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 || len(b)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted segment of %d bytes is not a multiple of the block size", len(b))
+	}
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(b, b)
+
+	padding := int(b[len(b)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errInvalidPadding
+	}
+	for _, p := range b[len(b)-padding:] {
+		if int(p) != padding {
+			return nil, errInvalidPadding
+		}
+	}
+
+	return b[:len(b)-padding], nil
+}
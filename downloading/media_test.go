@@ -0,0 +1,146 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloading_DownloadMedia_HLS(t *testing.T) {
+	content := readTestdata("foo.png")
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, aes.BlockSize)
+	iv[15] = 1
+
+	// The content is split into three segments, and the second one is encrypted with the IV of the media sequence number 1.
+	segments := []string{content[:1000], content[1000:3000], content[3000:]}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/master.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=100000\nlow/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=500000\nhigh/index.m3u8\n")
+		case "/high/index.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:1,\n0.ts\n#EXT-X-KEY:METHOD=AES-128,URI=\"/key\"\n#EXTINF:1,\n1.ts\n#EXT-X-KEY:METHOD=NONE\n#EXTINF:1,\n2.ts\n#EXT-X-ENDLIST\n")
+		case "/key":
+			w.Write(key)
+		case "/high/0.ts":
+			fmt.Fprint(w, segments[0])
+		case "/high/1.ts":
+			w.Write(encryptSegment(t, []byte(segments[1]), key, iv))
+		case "/high/2.ts":
+			fmt.Fprint(w, segments[2])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	err := newDownloaderWithURL(t, output, ts.URL+"/master.m3u8", 2).DownloadMedia(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+}
+
+func TestDownloading_DownloadMedia_DASH(t *testing.T) {
+	content := readTestdata("foo.png")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/manifest.mpd":
+			fmt.Fprintf(w, `<MPD type="static"><Period><AdaptationSet mimeType="audio/mp4"><Representation id="a" bandwidth="128"/></AdaptationSet>
+<AdaptationSet mimeType="video/mp4">
+<Representation id="v" bandwidth="1000" width="640" height="360"><BaseURL>video.mp4</BaseURL>
+<SegmentList><Initialization range="0-99"/><SegmentURL mediaRange="100-2047"/><SegmentURL mediaRange="2048-%d"/></SegmentList>
+</Representation></AdaptationSet></Period></MPD>`, len(content)-1)
+		case "/video.mp4":
+			serveContent(t, w, r, content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	log := &lockedBuffer{}
+
+	d := newDownloaderWithURL(t, output, ts.URL+"/manifest.mpd", 4)
+	d.outStream = log
+	d.resolution = "640x360"
+
+	err := d.DownloadMedia(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+
+	if expected := "warning: skipped adaptation sets: audio\n"; !strings.Contains(log.String(), expected) {
+		t.Errorf("unexpected log: expected to contain: %q actual: %q", expected, log.String())
+	}
+}
+
+func TestDownloading_DownloadMedia_SegmentNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.m3u8" {
+			fmt.Fprint(w, "#EXTM3U\n#EXTINF:1,\n0.ts\n")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	err := newDownloaderWithURL(t, output, ts.URL+"/index.m3u8", 2).DownloadMedia(context.Background())
+
+	expected := fmt.Sprintf("%s/0.ts: unexpected status code: 404", ts.URL)
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: expected: %q actual: %v", expected, err)
+	}
+}
+
+func TestDownloading_decryptSegment_InvalidPadding(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	iv := make([]byte, aes.BlockSize)
+
+	// Encrypted without padding, so the last byte of the plaintext is not a valid padding.
+	b := []byte(strings.Repeat("a", aes.BlockSize))
+	block, _ := aes.NewCipher(key)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(b, b)
+
+	_, err := decryptSegment(b, key, iv)
+	if err != errInvalidPadding {
+		t.Errorf("unexpected error: expected: %v actual: %v", errInvalidPadding, err)
+	}
+}
+
+// encryptSegment encrypts b with AES-128 in CBC mode with PKCS#7 padding.
+func encryptSegment(t *testing.T, b []byte, key []byte, iv []byte) []byte {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	padding := aes.BlockSize - len(b)%aes.BlockSize
+	b = append(append([]byte{}, b...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(b, b)
+
+	return b
+}
@@ -0,0 +1,275 @@
+package downloading
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errStalled = errors.New("stalled: no data received within the stall timeout")
+
+// source is one of the URLs which serve the same content, that is the URL and the mirrors.
+type source struct {
+	url *url.URL
+
+	mu     sync.Mutex
+	err    error
+	failed chan struct{}
+}
+
+func newSource(u *url.URL) *source {
+	return &source{url: u, failed: make(chan struct{})}
+}
+
+// fail marks s as unhealthy with err. Only the first err is kept.
+func (s *source) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.failed)
+}
+
+// failure returns the error which marked s as unhealthy, or nil if s is healthy.
+func (s *source) failure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// localError is the error on the local side such as of writing a file, which does not tell that the source failed.
+type localError struct {
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+// local wraps err as localError unless it is nil.
+func local(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &localError{err: err}
+}
+
+// unwrapLocal returns the error wrapped by localError, or err as it is.
+func unwrapLocal(err error) error {
+	if e, ok := err.(*localError); ok {
+		return e.err
+	}
+	return err
+}
+
+// localWriter wraps the errors of writing to w as localError.
+type localWriter struct {
+	w io.Writer
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	return n, local(err)
+}
+
+// getSources returns the URL and the mirrors as sources.
+func (d *Downloader) getSources() []*source {
+	d.sourcesOnce.Do(func() {
+		d.sources = []*source{newSource(d.url)}
+		for _, m := range d.mirrors {
+			d.sources = append(d.sources, newSource(m))
+		}
+	})
+	return d.sources
+}
+
+// verifyMirrors verifies that every mirror reports the same Content-Length and validator (ETag or Last-Modified) as the URL.
+// If the hashes of the content are specified, the validators are not compared
+// because the content is verified by the hashes and independent mirrors rarely share the validators.
+func (d *Downloader) verifyMirrors(ctx context.Context, contentLength int) error {
+	for _, m := range d.mirrors {
+		fmt.Fprintf(d.outStream, "start HEAD request to verify mirror: %s\n", m)
+
+		md, err := d.head(ctx, m)
+		if err != nil {
+			return fmt.Errorf("mirror %s: %s", m, err)
+		}
+
+		if int(md.contentLength) != contentLength {
+			return fmt.Errorf("mirror %s: Content-Length %d differs from %d", m, md.contentLength, contentLength)
+		}
+
+		if d.checksum != nil || d.pieces != nil {
+			continue
+		}
+
+		for _, key := range []string{"ETag", "Last-Modified"} {
+			expected := d.header.Get(key)
+			if expected == "" {
+				continue
+			}
+			if actual := md.header.Get(key); actual != expected {
+				return fmt.Errorf("mirror %s: %s %q differs from %q", m, key, actual, expected)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// failover calls fn with the URL of a healthy source, and returns the URL with which fn succeeded.
+// The sources are assigned in turn so that the requests spread across them, but avoid is tried last.
+// When fn fails, the source is marked as unhealthy, which also cancels the other requests to it,
+// and fn is called again with the next healthy source.
+// The error wrapped by local is returned at once without marking the source, since the other sources would fail alike.
+// Nor is the source pushing back by 429, 503 or a reset connection marked, since it is overloaded rather than broken,
+// and the error is returned if all the sources fail so that the caller backs off and retries.
+func (d *Downloader) failover(ctx context.Context, avoid *url.URL, fn func(ctx context.Context, u *url.URL) error) (*url.URL, error) {
+	sources := d.getSources()
+	if len(sources) == 1 {
+		return sources[0].url, unwrapLocal(fn(ctx, sources[0].url))
+	}
+
+	start := int(atomic.AddUint32(&d.sourceCntr, 1) - 1)
+
+	var ordered []*source
+	var avoided []*source
+	for n := 0; n < len(sources); n++ {
+		s := sources[(start+n)%len(sources)]
+		if avoid != nil && s.url.String() == avoid.String() {
+			avoided = append(avoided, s)
+			continue
+		}
+		ordered = append(ordered, s)
+	}
+	ordered = append(ordered, avoided...)
+
+	var lastErr, retryErr error
+	for _, s := range ordered {
+		if err := s.failure(); err != nil {
+			lastErr = err
+			continue
+		}
+
+		if retryErr != nil {
+			d.retry(retryErr)
+		}
+
+		err := d.callWithSource(ctx, s, fn)
+		if err == nil {
+			return s.url, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if _, ok := err.(*localError); ok {
+			return nil, unwrapLocal(err)
+		}
+
+		fmt.Fprintf(d.outStream, "failed: %s: %s\n", s.url, err)
+		retryErr = fmt.Errorf("%s: %s", s.url, err)
+
+		if isBackoffError(err) {
+			lastErr = err
+			continue
+		}
+
+		s.fail(err)
+
+		// The error which marked the source as unhealthy is reported rather than the cancellation caused by it.
+		lastErr = s.failure()
+	}
+
+	return nil, lastErr
+}
+
+// callWithSource calls fn with the URL of s, and cancels it when s is marked as unhealthy.
+func (d *Downloader) callWithSource(ctx context.Context, s *source, fn func(ctx context.Context, u *url.URL) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-s.failed:
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return fn(ctx, s.url)
+}
+
+// stallWatchdog calls cancel when it is not reset within timeout.
+// A zero timeout disables it.
+type stallWatchdog struct {
+	timer   *time.Timer
+	timeout time.Duration
+	fired   int32
+}
+
+func newStallWatchdog(timeout time.Duration, cancel func()) *stallWatchdog {
+	w := &stallWatchdog{timeout: timeout}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&w.fired, 1)
+			cancel()
+		})
+	}
+	return w
+}
+
+func (w *stallWatchdog) reset() {
+	if w.timer != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+func (w *stallWatchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// wrap replaces err with errStalled if the watchdog has fired.
+func (w *stallWatchdog) wrap(err error) error {
+	if err != nil && atomic.LoadInt32(&w.fired) == 1 {
+		return errStalled
+	}
+	return err
+}
+
+// watchedBody resets the watchdog whenever data is received.
+type watchedBody struct {
+	io.ReadCloser
+	watchdog *stallWatchdog
+	cancel   func()
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.watchdog.reset()
+	}
+	return n, b.watchdog.wrap(err)
+}
+
+func (b *watchedBody) Close() error {
+	b.watchdog.stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,245 @@
+package downloading
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_Mirrors(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	var gets [3]int32
+	var mirrors []*url.URL
+	var primaryURL string
+	for i := range gets {
+		i := i
+		ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				atomic.AddInt32(&gets[i], 1)
+			}
+			normalHandler(t, w, r)
+		})
+		defer clean()
+
+		if i == 0 {
+			primaryURL = ts.URL
+		} else {
+			mirrors = append(mirrors, mustParseRequestURI(t, ts.URL))
+		}
+	}
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloaderWithURL(t, output, primaryURL, 6)
+	d.mirrors = mirrors
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, registeredTestdatum["foo.png"])
+
+	for i := range gets {
+		if n := atomic.LoadInt32(&gets[i]); n != 2 {
+			t.Errorf("unexpected number of requests to source %d: expected: %d actual: %d", i, 2, n)
+		}
+	}
+}
+
+func TestDownloading_Download_MirrorFailover(t *testing.T) {
+	cases := map[string]struct {
+		handler func(t *testing.T, w http.ResponseWriter, r *http.Request)
+	}{
+		"error": {handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			normalHandler(t, w, r)
+		}},
+		"stall": {handler: func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return
+			}
+			normalHandler(t, w, r)
+		}},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = "foo.png"
+
+			ts, clean := newTestServer(t, normalHandler)
+			defer clean()
+
+			bad, clean := newTestServer(t, c.handler)
+			defer clean()
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			d := newDownloader(t, output, ts, 4)
+			d.mirrors = []*url.URL{mustParseRequestURI(t, bad.URL)}
+			d.stallTimeout = 100 * time.Millisecond
+
+			err := d.Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, registeredTestdatum["foo.png"])
+		})
+	}
+}
+
+func TestDownloading_Download_AllMirrorsFail(t *testing.T) {
+	expected := "unexpected status code: 500"
+
+	currentTestdataName = "foo.png"
+
+	handler := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		normalHandler(t, w, r)
+	}
+
+	ts, clean := newTestServer(t, handler)
+	defer clean()
+
+	mirror, clean := newTestServer(t, handler)
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 4)
+	d.mirrors = []*url.URL{mustParseRequestURI(t, mirror.URL)}
+
+	err := d.Download(context.Background())
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	actual := err.Error()
+	if actual != expected {
+		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+func TestDownloading_partialDownload_LocalError(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	mirror, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, "", ts, 2)
+	d.mirrors = []*url.URL{mustParseRequestURI(t, mirror.URL)}
+
+	_, _, err := d.partialDownload(context.Background(), chunk{first: 0, last: 1}, "non/existent/path")
+	if err == nil || !regexp.MustCompile("no such file or directory").MatchString(err.Error()) {
+		t.Errorf("unexpected error: expected: no such file or directory actual: %v", err)
+	}
+
+	// The sources are not blamed for the local error.
+	for _, s := range d.getSources() {
+		if err := s.failure(); err != nil {
+			t.Errorf("unexpected failure of %s: %s", s.url, err)
+		}
+	}
+}
+
+func TestDownloading_verifyMirrors(t *testing.T) {
+	cases := map[string]struct {
+		contentLength string
+		etag          string
+		expected      string
+	}{
+		"Content-Length": {contentLength: "10", etag: `"a"`, expected: "Content-Length 10 differs from 169406"},
+		"ETag":           {contentLength: "169406", etag: `"b"`, expected: `ETag "\"b\"" differs from "\"a\""`},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = "foo.png"
+
+			ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"a"`)
+				normalHandler(t, w, r)
+			})
+			defer clean()
+
+			mirror, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "bytes")
+				w.Header().Set("ETag", c.etag)
+				w.Header().Set("Content-Length", c.contentLength)
+			})
+			defer clean()
+
+			d := newDownloader(t, "", ts, 4)
+			d.mirrors = []*url.URL{mustParseRequestURI(t, mirror.URL)}
+
+			contentLength, err := d.getContentLength(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			err = d.verifyMirrors(context.Background(), contentLength)
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if !regexp.MustCompile(regexp.QuoteMeta(c.expected)).MatchString(err.Error()) {
+				t.Errorf("unexpectedly not matched: %s", err.Error())
+			}
+		})
+	}
+}
+
+func newDownloaderWithURL(t *testing.T, output string, rawurl string, parallelism int) *Downloader {
+	t.Helper()
+
+	opts := &opt.Options{
+		Parallelism: parallelism,
+		Output:      output,
+		URL:         mustParseRequestURI(t, rawurl),
+		Timeout:     60 * time.Second,
+	}
+
+	return NewDownloader(ioutil.Discard, opts)
+}
+
+func assertFileContent(t *testing.T, filename string, expected string) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if string(b) != expected {
+		t.Errorf("unexpected content of %s", filename)
+	}
+}
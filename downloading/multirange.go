@@ -0,0 +1,296 @@
+package downloading
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// multiRangeRetries is the number of times the ranges missing from the responses are requested again.
+const multiRangeRetries = 3
+
+var errMultiRangeNotSupported = errors.New("multiple ranges in a request are not supported")
+
+// multiRangeDownload downloads the chunks by up to multiRange concurrent GET requests, each of which asks for multiple ranges,
+// and saves each chunk in the file under the specified dir.
+// It returns the filenames by the index of the chunks, as parallelDownload does.
+//
+// The chunks missing from the responses, such as those the server omitted or those cut off by a closed connection,
+// are requested again together up to multiRangeRetries times, so that only the holes are downloaded again.
+// The local errors, and the servers which ignore multiple ranges, fail at once since they would fail alike again.
+func (d *Downloader) multiRangeDownload(ctx context.Context, chunks []chunk, dir string) (map[int]string, error) {
+	filenames := map[int]string{}
+	sources := map[int]*url.URL{}
+	var mu sync.Mutex
+
+	save := func(i int, filename string, source *url.URL) error {
+		filename, err := d.keepChunk(filename, chunks[i])
+		if err != nil {
+			return local(err)
+		}
+
+		fmt.Fprintf(d.outStream, "downloaded: %q\n", filename)
+
+		mu.Lock()
+		defer mu.Unlock()
+		filenames[i] = filename
+		sources[i] = source
+
+		return nil
+	}
+
+	var missing []int
+	for i := range chunks {
+		missing = append(missing, i)
+	}
+
+	for retry := 0; ; retry++ {
+		var eg errgroup.Group
+		for _, indexes := range splitIndexes(missing, d.multiRange) {
+			indexes := indexes
+			eg.Go(func() error {
+				return d.requestChunks(ctx, chunks, indexes, dir, save)
+			})
+		}
+		err := eg.Wait()
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if _, ok := err.(*localError); ok {
+			return nil, unwrapLocal(err)
+		}
+		if err == errMultiRangeNotSupported {
+			return nil, err
+		}
+
+		missing = nil
+		for i := range chunks {
+			if _, ok := filenames[i]; !ok {
+				missing = append(missing, i)
+			}
+		}
+
+		if len(missing) == 0 {
+			break
+		}
+
+		if retry >= multiRangeRetries {
+			if err != nil {
+				return nil, fmt.Errorf("%d ranges are missing after %d retries: %s", len(missing), retry, err)
+			}
+			return nil, fmt.Errorf("%d ranges are missing after %d retries", len(missing), retry)
+		}
+
+		fmt.Fprintf(d.outStream, "missing: %d ranges, request them again\n", len(missing))
+		if err == nil {
+			err = fmt.Errorf("%d ranges are missing", len(missing))
+		}
+		d.retry(err)
+	}
+
+	for i, c := range chunks {
+		err := d.repairPieces(ctx, filenames[i], c, sources[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return filenames, nil
+}
+
+// splitIndexes splits the indexes into up to n groups of consecutive indexes.
+func splitIndexes(indexes []int, n int) [][]int {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(indexes) {
+		n = len(indexes)
+	}
+
+	var groups [][]int
+	for k := 0; k < n; k++ {
+		groups = append(groups, indexes[len(indexes)*k/n:len(indexes)*(k+1)/n])
+	}
+
+	return groups
+}
+
+// requestChunks requests the chunks of the indexes by a GET request of multiple ranges, and saves each received chunk.
+// If the request fails, the chunks not received yet are requested from the other sources.
+// The local error is returned as localError, which failover unwraps, so that the caller does not retry it.
+func (d *Downloader) requestChunks(ctx context.Context, chunks []chunk, indexes []int, dir string, save func(i int, filename string, source *url.URL) error) error {
+	received := map[int]bool{}
+	var localErr error
+
+	_, err := d.failover(ctx, nil, func(ctx context.Context, u *url.URL) error {
+		var pending []int
+		var ranges []string
+		for _, i := range indexes {
+			if !received[i] {
+				pending = append(pending, i)
+				ranges = append(ranges, fmt.Sprintf("%d-%d", chunks[i].first, chunks[i].last))
+			}
+		}
+
+		header, body, err := d.requestRanges(ctx, u, "bytes="+strings.Join(ranges, ","))
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		err = readParts(header, body, chunks, pending, dir, func(i int, filename string) error {
+			err := save(i, filename, u)
+			if err != nil {
+				return err
+			}
+			received[i] = true
+			return nil
+		})
+		if _, ok := err.(*localError); ok {
+			localErr = err
+		}
+		return err
+	})
+
+	if localErr != nil {
+		return localErr
+	}
+
+	return err
+}
+
+// requestRanges requests the multiple ranges of the content at u specified by rangeHeader with the protocol for its scheme,
+// and returns the header and the body of the response.
+// The request is canceled if no data is received within stallTimeout.
+func (d *Downloader) requestRanges(ctx context.Context, u *url.URL, rangeHeader string) (http.Header, io.ReadCloser, error) {
+	u = d.location(u)
+
+	p, err := d.nextProtocol(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mr, ok := p.(multiRanger)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s: %s", u.Scheme, errMultiRangeNotSupported)
+	}
+
+	release, err := d.acquire(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	watchdog := newStallWatchdog(d.stallTimeout, cancel)
+
+	if len(d.mirrors) > 0 {
+		fmt.Fprintf(d.outStream, "start GET request to %s with header: \"Range: %s\"\n", u.Host, rangeHeader)
+	} else {
+		fmt.Fprintf(d.outStream, "start GET request with header: \"Range: %s\"\n", rangeHeader)
+	}
+
+	header, body, err := mr.getRanges(ctx, u, rangeHeader)
+	if err != nil {
+		watchdog.stop()
+		cancel()
+		err = watchdog.wrap(err)
+		release(err)
+		return nil, nil, err
+	}
+
+	return header, &watchedBody{ReadCloser: d.track(body, u, rangeHeader, release), watchdog: watchdog, cancel: cancel}, nil
+}
+
+// readParts reads the parts of the multipart/byteranges body, or the single range of the body,
+// and saves the pending chunks contained in them.
+func readParts(header http.Header, body io.Reader, chunks []chunk, pending []int, dir string, save func(i int, filename string) error) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		// The server may coalesce the ranges into a single range.
+		return savePart(body, header.Get("Content-Range"), chunks, pending, dir, save)
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = savePart(part, part.Header.Get("Content-Range"), chunks, pending, dir, save)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// savePart saves the pending chunks contained in the part of the range specified by contentRange such as "bytes 0-99/1000".
+// A part may contain multiple chunks if the server merged the adjacent ranges.
+func savePart(r io.Reader, contentRange string, chunks []chunk, pending []int, dir string, save func(i int, filename string) error) error {
+	var first, last int
+	_, err := fmt.Sscanf(contentRange, "bytes %d-%d/", &first, &last)
+	if err != nil {
+		return fmt.Errorf("invalid Content-Range: %q", contentRange)
+	}
+
+	pos := first
+	for _, i := range pending {
+		c := chunks[i]
+		if c.first < pos || c.last > last {
+			continue
+		}
+
+		_, err := io.CopyN(ioutil.Discard, r, int64(c.first-pos))
+		if err != nil {
+			return err
+		}
+
+		filename, err := saveChunk(r, c, dir)
+		if err != nil {
+			return err
+		}
+
+		err = save(i, filename)
+		if err != nil {
+			return err
+		}
+
+		pos = c.last + 1
+	}
+
+	return nil
+}
+
+// saveChunk saves the content of c read from r in the file under the specified dir, and returns the filename.
+func saveChunk(r io.Reader, c chunk, dir string) (string, error) {
+	fp, err := os.Create(path.Join(dir, randomHexStr()))
+	if err != nil {
+		return "", local(err)
+	}
+	defer fp.Close()
+
+	_, err = io.CopyN(&localWriter{w: fp}, r, int64(c.length()))
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", err
+	}
+
+	return fp.Name(), nil
+}
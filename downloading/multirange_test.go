@@ -0,0 +1,165 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_MultiRange(t *testing.T) {
+	content := readTestdata("foo.png")
+
+	chunks := splitContent(len(content), 6)
+
+	// rangesOf returns the Range header to request the chunks of the indexes.
+	rangesOf := func(indexes ...int) string {
+		var ranges []string
+		for _, i := range indexes {
+			ranges = append(ranges, strings.TrimPrefix(chunks[i].rangeHeader(), "bytes="))
+		}
+		return "bytes=" + strings.Join(ranges, ",")
+	}
+
+	firstRange := func(rangeHeader string) string {
+		return strings.SplitN(rangeHeader, ",", 2)[0]
+	}
+
+	cases := map[string]struct {
+		// rewrite rewrites the Range header of the n-th GET request to simulate the server.
+		rewrite        func(rangeHeader string, n int) string
+		expectedRanges []string
+		expectedErr    string
+	}{
+		"multipart/byteranges": {
+			expectedRanges: []string{rangesOf(0, 1, 2), rangesOf(3, 4, 5)},
+		},
+		"coalesced": {
+			rewrite: func(rangeHeader string, n int) string {
+				first := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)[0]
+				last := rangeHeader[strings.LastIndex(rangeHeader, "-")+1:]
+				return "bytes=" + first + "-" + last
+			},
+			expectedRanges: []string{rangesOf(0, 1, 2), rangesOf(3, 4, 5)},
+		},
+		"holes": {
+			rewrite: func(rangeHeader string, n int) string {
+				if n < 2 {
+					return firstRange(rangeHeader)
+				}
+				return rangeHeader
+			},
+			expectedRanges: []string{rangesOf(0, 1, 2), rangesOf(3, 4, 5), rangesOf(1, 2), rangesOf(4, 5)},
+		},
+		"missing": {
+			// The last chunk is never served.
+			rewrite: func(rangeHeader string, n int) string {
+				if rangeHeader == rangesOf(5) {
+					return rangesOf(0)
+				}
+				return strings.TrimSuffix(rangeHeader, ","+strings.TrimPrefix(rangesOf(5), "bytes="))
+			},
+			expectedErr: "1 ranges are missing after 3 retries",
+		},
+		"ignored": {
+			// The server responds the whole content with 200, which is not retried.
+			rewrite: func(rangeHeader string, n int) string {
+				return ""
+			},
+			expectedErr: errMultiRangeNotSupported.Error(),
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+
+			ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+					mu.Lock()
+					n := len(ranges)
+					ranges = append(ranges, rangeHeader)
+					mu.Unlock()
+
+					if c.rewrite != nil {
+						r.Header.Set("Range", c.rewrite(rangeHeader, n))
+					}
+				}
+				http.ServeContent(w, r, "foo.png", time.Time{}, bytes.NewReader([]byte(content)))
+			})
+			defer clean()
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			opts := &opt.Options{
+				Parallelism: 6,
+				Output:      output,
+				URL:         mustParseRequestURI(t, ts.URL),
+				Timeout:     60 * time.Second,
+				MultiRange:  2,
+			}
+
+			err := NewDownloader(ioutil.Discard, opts).Download(context.Background())
+			if c.expectedErr != "" {
+				if err == nil || err.Error() != c.expectedErr {
+					t.Errorf("unexpected error: expected: %q actual: %v", c.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, content)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			// The concurrent requests may arrive in any order.
+			sort.Strings(ranges)
+			sort.Strings(c.expectedRanges)
+
+			if !reflect.DeepEqual(ranges, c.expectedRanges) {
+				t.Errorf("unexpected ranges: expected: %v actual: %v", c.expectedRanges, ranges)
+			}
+		})
+	}
+}
+
+func TestDownloading_multiRangeDownload_LocalError(t *testing.T) {
+	content := readTestdata("foo.png")
+
+	var gets int32
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, "foo.png", time.Time{}, bytes.NewReader([]byte(content)))
+	})
+	defer clean()
+
+	d := newDownloader(t, "", ts, 4)
+	d.multiRange = 2
+
+	_, err := d.multiRangeDownload(context.Background(), splitContent(len(content), 4), "non/existent/path")
+	if err == nil || !strings.Contains(err.Error(), "no such file or directory") {
+		t.Errorf("unexpected error: expected: no such file or directory actual: %v", err)
+	}
+
+	// The local error is not retried.
+	if n := atomic.LoadInt32(&gets); n != 2 {
+		t.Errorf("unexpected number of requests: expected: %d actual: %d", 2, n)
+	}
+}
@@ -0,0 +1,97 @@
+package downloading
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultOutputTemplate is used when neither an output nor an output template is specified.
+const defaultOutputTemplate = "{basename}"
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// expandOutputTemplate replaces the placeholders in tmpl with the values derived from u and the header of the HEAD response.
+//
+// - {host}: host name of the URL
+// - {path}: path of the URL without the leading slash
+// - {basename}: last element of the path of the URL
+// - {ext}: extension of {basename} without the leading dot
+// - {date}: date of Last-Modified (or Date, or now) in the form of YYYY-MM-DD
+// - {etag}: value of ETag without quotes
+func expandOutputTemplate(tmpl string, u *url.URL, header http.Header, now time.Time) (string, error) {
+	values := map[string]string{
+		"{host}":     u.Hostname(),
+		"{path}":     urlPath(u),
+		"{basename}": path.Base(urlPath(u)),
+		"{ext}":      strings.TrimPrefix(path.Ext(urlPath(u)), "."),
+		"{date}":     headerDate(header, now).Format("2006-01-02"),
+		"{etag}":     sanitizeETag(header.Get("ETag")),
+	}
+
+	var err error
+	expanded := placeholderRegexp.ReplaceAllStringFunc(tmpl, func(placeholder string) string {
+		v, ok := values[placeholder]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown placeholder: %s", placeholder)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return expanded, nil
+}
+
+// JoinInDir joins the slash-separated name to dir, which is the current directory if empty.
+// It returns an error if the path escapes dir, such as by ".." elements or by backslashes on Windows.
+func JoinInDir(dir string, name string) (string, error) {
+	if dir == "" {
+		dir = "."
+	}
+
+	joined := filepath.Join(dir, filepath.FromSlash(name))
+
+	rel, err := filepath.Rel(dir, joined)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is not in the directory %q", name, dir)
+	}
+
+	return joined, nil
+}
+
+// urlPath returns the cleaned path of u without the leading slash.
+// Inspired by the --default-page option of wget, "index.html" is complemented to the path of a directory.
+func urlPath(u *url.URL) string {
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "index.html"
+	}
+
+	// Cleaning as an absolute path drops ".." elements that would escape the output directory.
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// headerDate returns the time of Last-Modified or Date header, or now if neither is available.
+func headerDate(header http.Header, now time.Time) time.Time {
+	for _, key := range []string{"Last-Modified", "Date"} {
+		t, err := http.ParseTime(header.Get(key))
+		if err == nil {
+			return t
+		}
+	}
+	return now
+}
+
+// sanitizeETag removes the weak indicator and the quotes from etag so that it can be used in a path.
+func sanitizeETag(etag string) string {
+	etag = strings.TrimPrefix(etag, "W/")
+	etag = strings.Trim(etag, `"`)
+	return strings.NewReplacer("/", "_", `\`, "_").Replace(etag)
+}
@@ -0,0 +1,137 @@
+package downloading
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDownloading_expandOutputTemplate(t *testing.T) {
+	now := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	header := http.Header{}
+	header.Set("ETag", `W/"abc/def"`)
+	header.Set("Last-Modified", "Wed, 26 Sep 2018 12:34:56 GMT")
+
+	cases := map[string]struct {
+		tmpl     string
+		url      string
+		header   http.Header
+		expected string
+	}{
+		"host and path":   {tmpl: "{host}/{path}", url: "http://example.com:8080/a/b/foo.png", header: header, expected: "example.com/a/b/foo.png"},
+		"basename":        {tmpl: "{basename}", url: "http://example.com/a/b/foo.png", header: header, expected: "foo.png"},
+		"ext":             {tmpl: "bar.{ext}", url: "http://example.com/foo.tar.gz", header: header, expected: "bar.gz"},
+		"date":            {tmpl: "{date}/{basename}", url: "http://example.com/foo.png", header: header, expected: "2018-09-26/foo.png"},
+		"date fallback":   {tmpl: "{date}", url: "http://example.com/foo.png", header: http.Header{}, expected: "2018-10-01"},
+		"etag":            {tmpl: "{etag}-{basename}", url: "http://example.com/foo.png", header: header, expected: "abc_def-foo.png"},
+		"directory":       {tmpl: "{path}", url: "http://example.com/a/", header: header, expected: "a/index.html"},
+		"path traversal":  {tmpl: "{path}", url: "http://example.com/../../etc/passwd", header: header, expected: "etc/passwd"},
+		"no placeholders": {tmpl: "foo.png", url: "http://example.com/bar.png", header: header, expected: "foo.png"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			actual, err := expandOutputTemplate(c.tmpl, mustParseRequestURI(t, c.url), c.header, now)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if actual != c.expected {
+				t.Errorf(`unexpected output: expected: "%s" actual: "%s"`, c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDownloading_expandOutputTemplate_UnknownPlaceholder(t *testing.T) {
+	expected := "unknown placeholder: {foo}"
+
+	_, err := expandOutputTemplate("{foo}/{basename}", mustParseRequestURI(t, "http://example.com/foo.png"), http.Header{}, time.Now())
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	actual := err.Error()
+	if actual != expected {
+		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+func TestDownloading_JoinInDir(t *testing.T) {
+	cases := map[string]struct {
+		dir      string
+		name     string
+		expected string
+		err      string
+	}{
+		"file":           {dir: "out", name: "foo.png", expected: "out/foo.png"},
+		"subdirectory":   {dir: "out", name: "a/b/foo.png", expected: "out/a/b/foo.png"},
+		"current dir":    {name: "a/foo.png", expected: "a/foo.png"},
+		"inner ..":       {dir: "out", name: "a/../foo.png", expected: "out/foo.png"},
+		"parent":         {dir: "out", name: "../foo.png", err: `"../foo.png" is not in the directory "out"`},
+		"parent of dir":  {dir: "out", name: "a/../..", err: `"a/../.." is not in the directory "out"`},
+		"directory only": {dir: "out", name: "", err: `"" is not in the directory "out"`},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			actual, err := JoinInDir(c.dir, c.name)
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Errorf("unexpected error: expected: %q actual: %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if actual != c.expected {
+				t.Errorf(`unexpected path: expected: "%s" actual: "%s"`, c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDownloading_expandOutputPath(t *testing.T) {
+	header := http.Header{}
+	header.Set("ETag", `W/".."`)
+
+	cases := map[string]struct {
+		dir      string
+		tmpl     string
+		expected string
+		err      string
+	}{
+		"in dir":                         {dir: "out", tmpl: "{host}/{basename}", expected: "out/example.com/foo.png"},
+		"literal directory":              {dir: "out", tmpl: "a/{basename}", expected: "out/a/foo.png"},
+		"absolute":                       {tmpl: "/tmp/{etag}x/{basename}", expected: "/tmp/..x/foo.png"},
+		"etag escapes dir":               {dir: "out", tmpl: "{etag}/{etag}/{basename}", err: `"../../foo.png" is not in the directory "out"`},
+		"etag escapes literal directory": {dir: "out", tmpl: "a/{etag}/{basename}", err: `"../foo.png" is not in the directory "out/a"`},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			d := &Downloader{url: mustParseRequestURI(t, "http://example.com/foo.png"), dir: c.dir, outputTemplate: c.tmpl, header: header}
+
+			actual, err := d.expandOutputPath()
+			if c.err != "" {
+				if err == nil || err.Error() != c.err {
+					t.Errorf("unexpected error: expected: %q actual: %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if actual != c.expected {
+				t.Errorf(`unexpected output: expected: "%s" actual: "%s"`, c.expected, actual)
+			}
+		})
+	}
+}
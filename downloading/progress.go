@@ -0,0 +1,192 @@
+package downloading
+
+import (
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxRetryErrors is the number of the latest errors kept for Errors.
+const maxRetryErrors = 10
+
+// RangeProgress is the progress of a request in flight, which requests the range of the content.
+// Range is the value of Range header, which is empty if the whole content is requested.
+// Length is 0 if it is unknown.
+type RangeProgress struct {
+	Host     string `json:"host"`
+	Range    string `json:"range,omitempty"`
+	Length   int64  `json:"length"`
+	Received int64  `json:"received"`
+}
+
+// RetryError is an error which the download retried on.
+type RetryError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// Progress returns the length of the content and the bytes received so far, which is safe to call while downloading.
+// The length is 0 until it is known, and the received bytes are capped by it since the failed ranges are downloaded again.
+func (d *Downloader) Progress() (int64, int64) {
+	length := atomic.LoadInt64(&d.length)
+	received := atomic.LoadInt64(&d.received)
+	if length > 0 && received > length {
+		received = length
+	}
+	return length, received
+}
+
+// Ranges returns the progress of the requests in flight in order of the ranges, which is safe to call while downloading.
+func (d *Downloader) Ranges() []RangeProgress {
+	d.progressMu.Lock()
+	bodies := make([]*trackedBody, 0, len(d.requests))
+	for b := range d.requests {
+		bodies = append(bodies, b)
+	}
+	d.progressMu.Unlock()
+
+	sort.Slice(bodies, func(a, b int) bool {
+		return bodies[a].first < bodies[b].first
+	})
+
+	ranges := make([]RangeProgress, 0, len(bodies))
+	for _, b := range bodies {
+		length := b.length
+		if b.rangeHeader == "" {
+			length = atomic.LoadInt64(&d.length)
+		}
+		ranges = append(ranges, RangeProgress{Host: b.host, Range: b.rangeHeader, Length: length, Received: atomic.LoadInt64(&b.received)})
+	}
+	return ranges
+}
+
+// Retries returns the number of the retries, which is safe to call while downloading.
+// A retry is a request made again after an error, or to another mirror after one failed.
+func (d *Downloader) Retries() int64 {
+	return atomic.LoadInt64(&d.retries)
+}
+
+// Errors returns the latest errors which the download retried on, the latest last.
+func (d *Downloader) Errors() []RetryError {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	return append([]RetryError(nil), d.retryErrors...)
+}
+
+// Output returns the path to save the downloaded file, or empty until it is decided.
+func (d *Downloader) Output() string {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	return d.saved
+}
+
+// setOutput records the path to save the downloaded file for Output.
+func (d *Downloader) setOutput(output string) {
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+	d.saved = output
+}
+
+// retry counts a retry on err for Retries and Errors.
+func (d *Downloader) retry(err error) {
+	atomic.AddInt64(&d.retries, 1)
+	d.metrics.AddRetry()
+
+	d.progressMu.Lock()
+	defer d.progressMu.Unlock()
+
+	d.retryErrors = append(d.retryErrors, RetryError{Time: time.Now(), Error: err.Error()})
+	if len(d.retryErrors) > maxRetryErrors {
+		d.retryErrors = d.retryErrors[len(d.retryErrors)-maxRetryErrors:]
+	}
+}
+
+// track returns body which counts the bytes received in the progress until it is closed,
+// and releases the request to the throttle then.
+func (d *Downloader) track(body io.ReadCloser, u *url.URL, rangeHeader string, release func(err error)) io.ReadCloser {
+	first, length := rangeExtent(rangeHeader)
+
+	b := &trackedBody{
+		ReadCloser:  body,
+		d:           d,
+		host:        u.Host,
+		rangeHeader: rangeHeader,
+		first:       first,
+		length:      length,
+		release:     release,
+	}
+
+	d.progressMu.Lock()
+	if d.requests == nil {
+		d.requests = map[*trackedBody]struct{}{}
+	}
+	d.requests[b] = struct{}{}
+	d.progressMu.Unlock()
+
+	d.metrics.AddActiveRanges(b.host, 1)
+
+	return b
+}
+
+// rangeExtent returns the first byte and the total length of the ranges of rangeHeader such as "bytes=0-99,200-299".
+// The length is 0 if rangeHeader is invalid.
+func rangeExtent(rangeHeader string) (int64, int64) {
+	var first, length int64
+	for i, spec := range strings.Split(strings.TrimPrefix(rangeHeader, "bytes="), ",") {
+		f, l, err := parseRangeHeader("bytes=" + spec)
+		if err != nil {
+			return first, 0
+		}
+		if i == 0 {
+			first = f
+		}
+		length += l - f + 1
+	}
+	return first, length
+}
+
+// trackedBody counts the bytes read from the body in the progress of the download, its own and the metrics,
+// and releases the request to the throttle when it is closed, with the error which interrupted reading it.
+type trackedBody struct {
+	// received is accessed atomically, which is the first field to be 64-bit aligned on 32-bit platforms.
+	received int64
+
+	io.ReadCloser
+	d           *Downloader
+	host        string
+	rangeHeader string
+	first       int64
+	length      int64
+	release     func(err error)
+	err         error
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.received, int64(n))
+	atomic.AddInt64(&b.d.received, int64(n))
+	b.d.metrics.AddReceived(b.host, n)
+	if err != nil && err != io.EOF && b.err == nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	b.d.progressMu.Lock()
+	_, ok := b.d.requests[b]
+	delete(b.d.requests, b)
+	b.d.progressMu.Unlock()
+
+	// It is closed only once in the metrics, even if it is closed again.
+	if ok {
+		b.d.metrics.AddActiveRanges(b.host, -1)
+	}
+
+	err := b.ReadCloser.Close()
+	b.release(b.err)
+	return err
+}
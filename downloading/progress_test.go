@@ -0,0 +1,256 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Progress(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 3)
+
+	if length, received := d.Progress(); length != 0 || received != 0 {
+		t.Errorf("unexpected progress before download: expected: 0/0 actual: %d/%d", received, length)
+	}
+	if d.Output() != "" {
+		t.Errorf("unexpected output before download: expected: empty actual: %q", d.Output())
+	}
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := int64(len(registeredTestdatum["foo.png"]))
+	if length, received := d.Progress(); length != expected || received != expected {
+		t.Errorf("unexpected progress: expected: %d/%d actual: %d/%d", expected, expected, received, length)
+	}
+	if d.Output() != output {
+		t.Errorf("unexpected output: expected: %q actual: %q", output, d.Output())
+	}
+	if ranges := d.Ranges(); len(ranges) != 0 {
+		t.Errorf("unexpected ranges after download: expected: none actual: %+v", ranges)
+	}
+	if d.Retries() != 0 {
+		t.Errorf("unexpected retries: expected: 0 actual: %d", d.Retries())
+	}
+}
+
+func TestDownloading_Ranges(t *testing.T) {
+	content := "0123456789abcdefghij"
+	unblock := make(chan struct{})
+
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "20")
+			return
+		}
+
+		// The first byte of each range is sent before the rest.
+		first, last, _ := parseRangeHeader(r.Header.Get("Range"))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[first : first+1]))
+		w.(http.Flusher).Flush()
+		<-unblock
+		w.Write([]byte(content[first+1 : last+1]))
+	})
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 2)
+
+	done := make(chan error)
+	go func() {
+		done <- d.Download(context.Background())
+	}()
+
+	expected := []RangeProgress{
+		{Host: ts.Listener.Addr().String(), Range: "bytes=0-9", Length: 10, Received: 1},
+		{Host: ts.Listener.Addr().String(), Range: "bytes=10-19", Length: 10, Received: 1},
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ranges := d.Ranges()
+		if len(ranges) == 2 && ranges[0] == expected[0] && ranges[1] == expected[1] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected ranges: expected: %+v actual: %+v", expected, ranges)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(unblock)
+
+	err := <-done
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+}
+
+func TestDownloading_Retries(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	bad, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		normalHandler(t, w, r)
+	})
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 4)
+	d.mirrors = []*url.URL{mustParseRequestURI(t, bad.URL)}
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	// The requests assigned to the failing mirror are retried with the other source.
+	if d.Retries() < 1 {
+		t.Errorf("unexpected retries: expected: 1 or more actual: %d", d.Retries())
+	}
+
+	errs := d.Errors()
+	expected := bad.URL + ": unexpected status code: 500"
+	if len(errs) == 0 || !strings.HasPrefix(errs[0].Error, expected) {
+		t.Errorf("unexpected errors: expected: %q actual: %+v", expected, errs)
+	}
+}
+
+func TestDownloading_rangeExtent(t *testing.T) {
+	cases := map[string]struct {
+		rangeHeader string
+		first       int64
+		length      int64
+	}{
+		"single":   {rangeHeader: "bytes=10-19", first: 10, length: 10},
+		"multiple": {rangeHeader: "bytes=0-9,20-29,40-44", first: 0, length: 25},
+		"whole":    {rangeHeader: "", first: 0, length: 0},
+		"invalid":  {rangeHeader: "bytes=10-", first: 0, length: 0},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			first, length := rangeExtent(c.rangeHeader)
+			if first != c.first || length != c.length {
+				t.Errorf("unexpected extent: expected: %d+%d actual: %d+%d", c.first, c.length, first, length)
+			}
+		})
+	}
+}
+
+func TestDownloading_Metrics(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	m := metrics.New()
+	opts := &opt.Options{
+		Parallelism: 3,
+		Output:      output,
+		URL:         mustParseRequestURI(t, ts.URL),
+		Timeout:     60 * time.Second,
+		Checksum:    &opt.Checksum{Type: "sha-256", Value: sha256Hex("")},
+		Metrics:     m,
+	}
+
+	err := NewDownloader(ioutil.Discard, opts).Download(context.Background())
+	assertErrorMatches(t, err, "sha-256 checksum mismatch")
+
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	host := opts.URL.Host
+	for _, expected := range []string{
+		fmt.Sprintf("parallel_download_received_bytes_total{host=%q} %d\n", host, len(registeredTestdatum["foo.png"])),
+		fmt.Sprintf("parallel_download_active_ranges{host=%q} 0\n", host),
+		// The length is requested with a range, and then the 3 ranges.
+		"parallel_download_request_duration_seconds_count{code=\"206\"} 4\n",
+		"parallel_download_checksum_failures_total{kind=\"checksum\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("unexpected metrics: expected: %q actual: %q", expected, buf.String())
+		}
+	}
+}
+
+func TestDownloading_meteredTransport(t *testing.T) {
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer clean()
+
+	m := metrics.New()
+	client := &http.Client{Transport: &meteredTransport{RoundTripper: http.DefaultTransport, metrics: m}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err = client.Do(req.WithContext(ctx))
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	_, err = client.Get("http://127.0.0.1:0/")
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	var buf bytes.Buffer
+	_, err = m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	for _, expected := range []string{
+		"parallel_download_request_duration_seconds_count{code=\"canceled\"} 1\n",
+		"parallel_download_request_duration_seconds_count{code=\"error\"} 1\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("unexpected metrics: expected: %q actual: %q", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package downloading
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+var (
+	errResponseDoesNotIncludeAcceptRangesHeader = errors.New("response does not include Accept-Ranges header")
+	errValueOfAcceptRangesHeaderIsNotBytes      = errors.New("the value of Accept-Ranges header is not bytes")
+)
+
+// protocol accesses the content at the URLs of a scheme.
+type protocol interface {
+	// head returns the metadata of the content at u, validating that its ranges can be requested.
+	head(ctx context.Context, u *url.URL) (*metadata, error)
+
+	// get returns the range of the content at u specified by rangeHeader such as "bytes=0-99",
+	// or the whole content if rangeHeader is empty.
+	get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error)
+}
+
+// verifier is implemented by the protocols which can verify the downloaded content with their metadata.
+type verifier interface {
+	verify(ctx context.Context, u *url.URL, header http.Header, filename string) error
+}
+
+// multiRanger is implemented by the protocols which can request multiple ranges at once.
+type multiRanger interface {
+	// getRanges returns the header and the body of the response to rangeHeader of multiple ranges such as "bytes=0-99,200-299".
+	// The body is multipart/byteranges, or a single range described by Content-Range if the server coalesced the ranges.
+	getRanges(ctx context.Context, u *url.URL, rangeHeader string) (http.Header, io.ReadCloser, error)
+}
+
+// metadata is the size of the content and the header which describes it.
+// The protocols other than HTTP map their metadata to the header such as Last-Modified.
+type metadata struct {
+	contentLength int64
+	header        http.Header
+
+	// location is the final URL which the request was redirected to, or nil.
+	location *url.URL
+}
+
+// statusError is the error of the response with an unexpected status code.
+type statusError struct {
+	code int
+
+	// retryAfter is the duration of Retry-After header, or 0 if it is missing.
+	retryAfter time.Duration
+}
+
+// newStatusError returns statusError of resp.
+func newStatusError(resp *http.Response) *statusError {
+	e := &statusError{code: resp.StatusCode}
+
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			e.retryAfter = time.Duration(seconds) * time.Second
+		} else if t, err := http.ParseTime(v); err == nil {
+			e.retryAfter = time.Until(t)
+		}
+	}
+
+	return e
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.code)
+}
+
+// newProtocolSets returns the protocols by scheme for each of the bind addresses,
+// or for the default source address if none is specified.
+func newProtocolSets(w io.Writer, opts *opt.Options) []map[string]protocol {
+	if len(opts.BindAddresses) == 0 {
+		return []map[string]protocol{newProtocols(w, opts, nil)}
+	}
+
+	var sets []map[string]protocol
+	for _, ip := range opts.BindAddresses {
+		sets = append(sets, newProtocols(w, opts, &net.TCPAddr{IP: ip}))
+	}
+
+	return sets
+}
+
+// newProtocols returns the protocols by scheme, whose connections are made from localAddr unless it is nil.
+func newProtocols(w io.Writer, opts *opt.Options, localAddr net.Addr) map[string]protocol {
+	dialer := newDialer(opts, localAddr)
+	client := newHTTPClient(opts, dialer.DialContext)
+
+	hp := &httpProtocol{outStream: w, client: client, verbose: opts.Verbose}
+
+	// The TLS sessions are shared so that the data connections of FTPS resume the session of the control connection.
+	fp := &ftpProtocol{tlsConfig: &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}, dialer: dialer}
+
+	return map[string]protocol{
+		"http":      hp,
+		"https":     hp,
+		"ftp":       fp,
+		"ftps":      fp,
+		"ftpes":     fp,
+		"s3":        newS3Protocol(w, client, opts.S3Endpoint, opts.S3Region),
+		"file":      &fileProtocol{},
+		"http+unix": &unixProtocol{outStream: w, verbose: opts.Verbose, checkRedirect: checkRedirect(opts.MaxRedirects, opts.NoFollow), metrics: opts.Metrics},
+	}
+}
+
+// protocol returns the protocol for the scheme of u, which connects from the first bind address.
+func (d *Downloader) protocol(u *url.URL) (protocol, error) {
+	return d.protocolFrom(0, u)
+}
+
+// nextProtocol returns the protocol for the scheme of u, which connects from the bind addresses in turn.
+func (d *Downloader) nextProtocol(u *url.URL) (protocol, error) {
+	return d.protocolFrom(int(atomic.AddUint32(&d.protocolCntr, 1)-1), u)
+}
+
+// protocolFrom returns the protocol for the scheme of u, which connects from the i-th bind address in rotation.
+func (d *Downloader) protocolFrom(i int, u *url.URL) (protocol, error) {
+	p, ok := d.protocols[i%len(d.protocols)][u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	return p, nil
+}
+
+// parseRangeHeader parses the value of Range header of a single range such as "bytes=0-99".
+func parseRangeHeader(rangeHeader string) (int64, int64, error) {
+	var first, last int64
+
+	_, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &first, &last)
+	if err != nil || first < 0 || last < first {
+		return 0, 0, fmt.Errorf("invalid range: %q", rangeHeader)
+	}
+
+	return first, last, nil
+}
+
+// httpProtocol accesses the content with HTTP range requests.
+type httpProtocol struct {
+	outStream io.Writer
+	client    *http.Client
+	verbose   bool
+}
+
+// head makes a HEAD request to u and validates that the response supports range requests.
+func (p *httpProtocol) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	p.logProto(resp)
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, newStatusError(resp)
+	}
+
+	err = p.validateAcceptRangesHeader(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadata{contentLength: resp.ContentLength, header: resp.Header, location: resp.Request.URL}, nil
+}
+
+// validateAcceptRangesHeader validates the following.
+// - The presence of an Accept-Ranges header
+// - The value of the Accept-Ranges header is "bytes"
+func (p *httpProtocol) validateAcceptRangesHeader(resp *http.Response) error {
+	acceptRangesHeader := resp.Header.Get("Accept-Ranges")
+
+	fmt.Fprintf(p.outStream, "got: Accept-Ranges: %s\n", acceptRangesHeader)
+
+	if acceptRangesHeader == "" {
+		return errResponseDoesNotIncludeAcceptRangesHeader
+	}
+
+	if acceptRangesHeader != "bytes" {
+		return errValueOfAcceptRangesHeaderIsNotBytes
+	}
+
+	return nil
+}
+
+// get sends a GET request to u with rangeHeader and returns the response body.
+func (p *httpProtocol) get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	resp, err := p.do(ctx, u, rangeHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// getRanges sends a GET request to u with rangeHeader of multiple ranges,
+// and returns the response header, which describes the parts, and the body.
+func (p *httpProtocol) getRanges(ctx context.Context, u *url.URL, rangeHeader string) (http.Header, io.ReadCloser, error) {
+	resp, err := p.do(ctx, u, rangeHeader)
+	if e, ok := err.(*statusError); ok && e.code == http.StatusOK {
+		// The server ignored Range, which it would do again.
+		return nil, nil, errMultiRangeNotSupported
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp.Header, resp.Body, nil
+}
+
+// do sends a GET request to u with rangeHeader and returns the response if its status code is expected.
+func (p *httpProtocol) do(ctx context.Context, u *url.URL, rangeHeader string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	expectedStatusCode := http.StatusOK
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+		expectedStatusCode = http.StatusPartialContent
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.logProto(resp)
+
+	if resp.StatusCode != expectedStatusCode {
+		resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+// logProto reports the protocol of the response in verbose output, such as "HTTP/2.0".
+func (p *httpProtocol) logProto(resp *http.Response) {
+	if !p.verbose {
+		return
+	}
+
+	if rangeHeader := resp.Request.Header.Get("Range"); rangeHeader != "" {
+		fmt.Fprintf(p.outStream, "protocol: %s for %s request with header: \"Range: %s\"\n", resp.Proto, resp.Request.Method, rangeHeader)
+		return
+	}
+
+	fmt.Fprintf(p.outStream, "protocol: %s for %s request\n", resp.Proto, resp.Request.Method)
+}
@@ -0,0 +1,130 @@
+package downloading
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_Redirect(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	cdn, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		normalHandler(t, w, r)
+	})
+	defer clean()
+
+	var originHits int32
+	origin, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&originHits, 1)
+		http.Redirect(w, r, cdn.URL+"/foo.png?signature=abc", http.StatusFound)
+	})
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	opts := &opt.Options{
+		Parallelism:  4,
+		Output:       output,
+		URL:          mustParseRequestURI(t, origin.URL+"/foo.png"),
+		Timeout:      60 * time.Second,
+		MaxRedirects: opt.DefaultMaxRedirects,
+	}
+
+	err := NewDownloader(ioutil.Discard, opts).Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, readTestdata("foo.png"))
+
+	// The ranges are requested from the final URL resolved by the HEAD request.
+	if hits := atomic.LoadInt32(&originHits); hits != 1 {
+		t.Errorf("unexpected requests to the origin: expected: 1 actual: %d", hits)
+	}
+}
+
+func TestDownloading_Download_RedirectPolicy(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	plain, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	// Each request to /n redirects to /n-1, and /0 redirects to the plain server.
+	redirectHandler := func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/0":
+			http.Redirect(w, r, plain.URL, http.StatusFound)
+		case "/1":
+			http.Redirect(w, r, "/0", http.StatusFound)
+		default:
+			http.Redirect(w, r, "/1", http.StatusFound)
+		}
+	}
+
+	ts, clean := newTestServer(t, redirectHandler)
+	defer clean()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirectHandler(t, w, r)
+	}))
+	defer tlsServer.Close()
+
+	cases := map[string]struct {
+		rawurl       string
+		maxRedirects int
+		noFollow     bool
+		expected     string
+	}{
+		"within --max-redirects": {rawurl: ts.URL + "/2", maxRedirects: 3},
+		"over --max-redirects":   {rawurl: ts.URL + "/2", maxRedirects: 2, expected: "stopped after 2 redirects"},
+		"--no-follow":            {rawurl: ts.URL + "/0", maxRedirects: 10, noFollow: true, expected: "redirect to " + plain.URL + " is not followed"},
+		"HTTPS to HTTP":          {rawurl: tlsServer.URL + "/0", maxRedirects: 10, expected: "redirect from HTTPS to HTTP is refused: " + plain.URL},
+		"default":                {rawurl: ts.URL + "/2", maxRedirects: 0},
+		"negative":               {rawurl: ts.URL + "/0", maxRedirects: -1, expected: "redirect to " + plain.URL + " is not followed"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			opts := &opt.Options{
+				Parallelism:  2,
+				Output:       output,
+				URL:          mustParseRequestURI(t, c.rawurl),
+				Timeout:      60 * time.Second,
+				MaxRedirects: c.maxRedirects,
+				NoFollow:     c.noFollow,
+			}
+
+			d := NewDownloader(ioutil.Discard, opts)
+			trustTestServer(d, tlsServer)
+
+			err := d.Download(context.Background())
+			if c.expected == "" {
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.HasSuffix(err.Error(), c.expected) {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package downloading
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultBlockSize is the size of the unit in which RemoteFile requests and caches the content.
+	defaultBlockSize = 1 << 20
+
+	// defaultCacheBlocks is the number of blocks RemoteFile keeps in its cache.
+	defaultCacheBlocks = 64
+)
+
+var (
+	errNegativeOffset = errors.New("negative offset")
+	errInvalidWhence  = errors.New("invalid whence")
+)
+
+// RemoteFile presents the remote resource as io.ReaderAt and io.ReadSeeker.
+//
+// The content is requested in blocks with Range header and the blocks are kept in an LRU cache.
+// The blocks covered by a read are requested in parallel,
+// and the blocks following a sequential read are prefetched in the background.
+// RemoteFile is safe for concurrent use of ReadAt.
+type RemoteFile struct {
+	d      *Downloader
+	ctx    context.Context
+	cancel func()
+	size   int64
+
+	blockSize int64
+	readAhead int
+	sem       chan struct{}
+	group     singleflight.Group
+
+	mu      sync.Mutex
+	offset  int64
+	lastEnd int64
+	cache   *blockCache
+}
+
+// Open makes a HEAD request and returns RemoteFile to read the content of the resource.
+// The requests for RemoteFile are canceled when ctx is done or RemoteFile is closed.
+func (d *Downloader) Open(ctx context.Context) (*RemoteFile, error) {
+	contentLength, err := d.getContentLength(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.verifyMirrors(ctx, contentLength)
+	if err != nil {
+		return nil, err
+	}
+
+	parallelism := d.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &RemoteFile{
+		d:         d,
+		ctx:       ctx,
+		cancel:    cancel,
+		size:      int64(contentLength),
+		blockSize: defaultBlockSize,
+		readAhead: parallelism,
+		sem:       make(chan struct{}, parallelism),
+		cache:     newBlockCache(defaultCacheBlocks),
+	}, nil
+}
+
+// Size returns the size of the content.
+func (f *RemoteFile) Size() int64 {
+	return f.size
+}
+
+// Close cancels the requests in progress.
+func (f *RemoteFile) Close() error {
+	f.cancel()
+	return nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *RemoteFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errNegativeOffset
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	end := off + int64(len(p))
+	if end > f.size {
+		end = f.size
+	}
+	if end == off {
+		return 0, nil
+	}
+
+	firstBlock := off / f.blockSize
+	lastBlock := (end - 1) / f.blockSize
+
+	f.mu.Lock()
+	sequential := off == f.lastEnd
+	f.lastEnd = end
+	f.mu.Unlock()
+
+	if sequential {
+		f.prefetch(lastBlock+1, lastBlock+int64(f.readAhead))
+	}
+
+	blocks := make([][]byte, lastBlock-firstBlock+1)
+
+	var eg errgroup.Group
+	for i := firstBlock; i <= lastBlock; i++ {
+		i := i
+		eg.Go(func() error {
+			b, err := f.block(i)
+			if err != nil {
+				return err
+			}
+			blocks[i-firstBlock] = b
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, b := range blocks {
+		blockOffset := (firstBlock + int64(i)) * f.blockSize
+		start := int64(0)
+		if blockOffset < off {
+			start = off - blockOffset
+		}
+		n += copy(p[n:], b[start:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Read implements io.Reader.
+func (f *RemoteFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	offset := f.offset
+	f.mu.Unlock()
+
+	n, err := f.ReadAt(p, offset)
+
+	f.mu.Lock()
+	f.offset = offset + int64(n)
+	f.mu.Unlock()
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (f *RemoteFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, errInvalidWhence
+	}
+
+	if offset < 0 {
+		return 0, errNegativeOffset
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+// prefetch requests the blocks from first to last in the background.
+func (f *RemoteFile) prefetch(first int64, last int64) {
+	maxBlock := (f.size - 1) / f.blockSize
+	if last > maxBlock {
+		last = maxBlock
+	}
+
+	for i := first; i <= last; i++ {
+		if f.cache.contains(i) {
+			continue
+		}
+		// The error is ignored because the block is requested again when it is read.
+		go f.block(i)
+	}
+}
+
+// block returns the i-th block from the cache, or requests it if not cached.
+// Concurrent calls for the same block share one request.
+func (f *RemoteFile) block(i int64) ([]byte, error) {
+	if b, ok := f.cache.get(i); ok {
+		return b, nil
+	}
+
+	v, err, _ := f.group.Do(strconv.FormatInt(i, 10), func() (interface{}, error) {
+		select {
+		case <-f.ctx.Done():
+			return nil, f.ctx.Err()
+		case f.sem <- struct{}{}:
+		}
+		defer func() { <-f.sem }()
+
+		first := i * f.blockSize
+		last := first + f.blockSize - 1
+		if last >= f.size {
+			last = f.size - 1
+		}
+
+		b, err := f.d.partialRead(f.ctx, chunk{first: int(first), last: int(last)})
+		if err != nil {
+			return nil, err
+		}
+
+		f.cache.add(i, b)
+
+		return b, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.([]byte), nil
+}
+
+// blockCache is an LRU cache of blocks.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[int64]*list.Element
+}
+
+type blockCacheEntry struct {
+	index int64
+	data  []byte
+}
+
+func newBlockCache(capacity int) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    map[int64]*list.Element{},
+	}
+}
+
+// get returns the i-th block and marks it as recently used.
+func (c *blockCache) get(i int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[i]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+
+	return e.Value.(*blockCacheEntry).data, true
+}
+
+// contains reports whether the i-th block is cached without marking it as recently used.
+func (c *blockCache) contains(i int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.items[i]
+	return ok
+}
+
+// add adds the i-th block and evicts the least recently used block if the capacity is exceeded.
+func (c *blockCache) add(i int64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[i]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*blockCacheEntry).data = data
+		return
+	}
+
+	c.items[i] = c.ll.PushFront(&blockCacheEntry{index: i, data: data})
+
+	for c.ll.Len() > c.capacity {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*blockCacheEntry).index)
+	}
+}
@@ -0,0 +1,246 @@
+package downloading
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloading_RemoteFile_ReadAt(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := registeredTestdatum[currentTestdataName]
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	f := openRemoteFile(t, newDownloader(t, "", ts, 4), 1000)
+	defer f.Close()
+
+	if f.Size() != int64(len(content)) {
+		t.Fatalf("unexpected size: expected: %d actual: %d", len(content), f.Size())
+	}
+
+	cases := map[string]struct {
+		off    int64
+		length int
+	}{
+		"within a block":  {off: 10, length: 100},
+		"across blocks":   {off: 990, length: 3000},
+		"whole content":   {off: 0, length: len(content)},
+		"empty":           {off: 5, length: 0},
+		"last block only": {off: int64(len(content)) - 6, length: 6},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			p := make([]byte, c.length)
+			n, err := f.ReadAt(p, c.off)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if n != c.length {
+				t.Errorf("unexpected n: expected: %d actual: %d", c.length, n)
+			}
+
+			expected := content[c.off : c.off+int64(c.length)]
+			if string(p) != expected {
+				t.Errorf("unexpected content")
+			}
+		})
+	}
+}
+
+func TestDownloading_RemoteFile_ReadAt_EOF(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := registeredTestdatum[currentTestdataName]
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	f := openRemoteFile(t, newDownloader(t, "", ts, 4), 1000)
+	defer f.Close()
+
+	p := make([]byte, 10)
+	n, err := f.ReadAt(p, int64(len(content))-4)
+	if err != io.EOF {
+		t.Errorf("unexpected error: expected: %s actual: %v", io.EOF, err)
+	}
+	if n != 4 {
+		t.Errorf("unexpected n: expected: %d actual: %d", 4, n)
+	}
+
+	_, err = f.ReadAt(p, int64(len(content)))
+	if err != io.EOF {
+		t.Errorf("unexpected error: expected: %s actual: %v", io.EOF, err)
+	}
+
+	_, err = f.ReadAt(p, -1)
+	if err != errNegativeOffset {
+		t.Errorf("unexpected error: expected: %s actual: %v", errNegativeOffset, err)
+	}
+}
+
+func TestDownloading_RemoteFile_ReadSeeker(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := registeredTestdatum[currentTestdataName]
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	f := openRemoteFile(t, newDownloader(t, "", ts, 4), 1000)
+	defer f.Close()
+
+	pos, err := f.Seek(-1000, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if pos != int64(len(content))-1000 {
+		t.Errorf("unexpected position: expected: %d actual: %d", len(content)-1000, pos)
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if string(b) != content[len(content)-1000:] {
+		t.Errorf("unexpected content")
+	}
+
+	_, err = f.Seek(-1, io.SeekStart)
+	if err != errNegativeOffset {
+		t.Errorf("unexpected error: expected: %s actual: %v", errNegativeOffset, err)
+	}
+
+	_, err = f.Seek(0, 3)
+	if err != errInvalidWhence {
+		t.Errorf("unexpected error: expected: %s actual: %v", errInvalidWhence, err)
+	}
+}
+
+func TestDownloading_RemoteFile_Zip(t *testing.T) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for i := 0; i < 10; i++ {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("file%d.txt", i), Method: zip.Store})
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		fmt.Fprint(w, strings.Repeat(strconv.Itoa(i), 10000))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var gets int32
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		serveContent(t, w, r, buf.String())
+	})
+	defer clean()
+
+	f := openRemoteFile(t, newDownloader(t, "", ts, 1), 1000)
+	defer f.Close()
+
+	zr, err := zip.NewReader(f, f.Size())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if len(zr.File) != 10 {
+		t.Fatalf("unexpected number of files: expected: %d actual: %d", 10, len(zr.File))
+	}
+
+	rc, err := zr.File[5].Open()
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if string(b) != strings.Repeat("5", 10000) {
+		t.Errorf("unexpected content")
+	}
+
+	// The central directory and about one entry are enough, not the whole archive.
+	if n := atomic.LoadInt32(&gets); int(n) >= buf.Len()/1000 {
+		t.Errorf("too many requests: %d", n)
+	}
+}
+
+func TestDownloading_blockCache(t *testing.T) {
+	c := newBlockCache(2)
+
+	c.add(0, []byte("a"))
+	c.add(1, []byte("b"))
+	c.get(0)
+	c.add(2, []byte("c"))
+
+	if _, ok := c.get(1); ok {
+		t.Errorf("least recently used block is not evicted")
+	}
+
+	for _, i := range []int64{0, 2} {
+		if !c.contains(i) {
+			t.Errorf("block %d is unexpectedly evicted", i)
+		}
+	}
+}
+
+func openRemoteFile(t *testing.T, d *Downloader, blockSize int64) *RemoteFile {
+	t.Helper()
+
+	f, err := d.Open(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	f.blockSize = blockSize
+
+	return f
+}
+
+// serveContent serves content with the support of Range header.
+func serveContent(t *testing.T, w http.ResponseWriter, r *http.Request, content string) {
+	t.Helper()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	rangeHdr := r.Header.Get("Range")
+	if rangeHdr == "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		fmt.Fprint(w, content)
+		return
+	}
+
+	c := strings.Split(strings.TrimPrefix(rangeHdr, "bytes="), "-")
+
+	min, err := strconv.Atoi(c[0])
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	max, err := strconv.Atoi(c[1])
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(max-min+1))
+	w.WriteHeader(http.StatusPartialContent)
+	fmt.Fprint(w, content[min:max+1])
+}
@@ -0,0 +1,131 @@
+package downloading
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/hioki-daichi/parallel-download/persisting"
+)
+
+// resumeStateFile is the file in the work dir which has resumeState.
+const resumeStateFile = "resume.json"
+
+// resumeState identifies the content which the ranges in the work dir were downloaded from.
+// The content without the ETag nor Last-Modified is identified only by its length.
+type resumeState struct {
+	URL          string `json:"url"`
+	Length       int    `json:"length"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// prepareWorkDir creates the work dir, and removes the files in it other than the completed chunks,
+// which are also removed if the content has changed since they were downloaded.
+func (d *Downloader) prepareWorkDir(chunks []chunk, contentLength int) error {
+	err := os.MkdirAll(d.workDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	state := resumeState{URL: d.url.String(), Length: contentLength, ETag: d.header.Get("ETag"), LastModified: d.header.Get("Last-Modified")}
+	stateFile := filepath.Join(d.workDir, resumeStateFile)
+
+	// The chunks split differently, such as by the other parallelism, are not resumed either.
+	sizes := map[string]int64{}
+	var saved resumeState
+	b, err := ioutil.ReadFile(stateFile)
+	if err == nil && json.Unmarshal(b, &saved) == nil && saved == state {
+		for _, c := range chunks {
+			sizes[c.partName()] = int64(c.length())
+		}
+	}
+
+	files, err := ioutil.ReadDir(d.workDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if size, ok := sizes[f.Name()]; (ok && f.Size() == size) || f.Name() == resumeStateFile {
+			continue
+		}
+
+		err := os.RemoveAll(filepath.Join(d.workDir, f.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return persisting.WriteJSON(stateFile, state)
+}
+
+// resumeChunks returns the filenames of the chunks completed in the work dir by their indexes, and the indexes of the others.
+// The pieces of the completed chunks are verified again, since the run may have been stopped while they were repaired.
+func (d *Downloader) resumeChunks(ctx context.Context, chunks []chunk) (map[int]string, []int, error) {
+	filenames := map[int]string{}
+	var missing []int
+
+	for i, c := range chunks {
+		if d.workDir == "" {
+			missing = append(missing, i)
+			continue
+		}
+
+		filename := filepath.Join(d.workDir, c.partName())
+		if _, err := os.Stat(filename); err != nil {
+			missing = append(missing, i)
+			continue
+		}
+
+		fmt.Fprintf(d.outStream, "resumed: %q\n", filename)
+		atomic.AddInt64(&d.received, int64(c.length()))
+
+		err := d.repairPieces(ctx, filename, c, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		filenames[i] = filename
+	}
+
+	return filenames, missing, nil
+}
+
+// keepChunk renames the downloaded file of c after its range in the work dir, so that it is resumed by the next run,
+// and returns the new filename. Without the work dir, filename is returned as it is.
+func (d *Downloader) keepChunk(filename string, c chunk) (string, error) {
+	if d.workDir == "" {
+		return filename, nil
+	}
+
+	kept := filepath.Join(d.workDir, c.partName())
+
+	err := os.Rename(filename, kept)
+	if err != nil {
+		return "", err
+	}
+
+	return kept, nil
+}
+
+// removeWorkDir removes the work dir, whose ranges are no longer resumed.
+func (d *Downloader) removeWorkDir() {
+	if d.workDir == "" {
+		return
+	}
+
+	err := os.RemoveAll(d.workDir)
+	if err != nil {
+		fmt.Fprintf(d.outStream, "failed to remove %q: %s\n", d.workDir, err)
+	}
+}
+
+// partName returns the name of the file which keeps the completed c in the work dir.
+func (c chunk) partName() string {
+	return fmt.Sprintf("%d-%d.part", c.first, c.last)
+}
@@ -0,0 +1,116 @@
+package downloading
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloading_Download_WorkDir(t *testing.T) {
+	cases := map[string]struct {
+		etag     string
+		expected int
+	}{
+		"same content":    {etag: `"a"`, expected: 1},
+		"changed content": {etag: `"b"`, expected: 3},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = "foo.png"
+
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			var mu sync.Mutex
+			etag := `"a"`
+			paused := true
+			var requested []string
+
+			ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				w.Header().Set("ETag", etag)
+				block := paused && strings.HasPrefix(r.Header.Get("Range"), "bytes=112936-")
+				if r.Method == "GET" && !paused {
+					requested = append(requested, r.Header.Get("Range"))
+				}
+				mu.Unlock()
+
+				// The last range is never received until the download is paused.
+				if block {
+					<-r.Context().Done()
+					return
+				}
+				normalHandler(t, w, r)
+			})
+			defer clean()
+
+			workDir := filepath.Join(dir, "work")
+			output := filepath.Join(dir, "output.png")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			d := newDownloader(t, output, ts, 3)
+			d.workDir = workDir
+
+			errCh := make(chan error, 1)
+			go func() { errCh <- d.Download(ctx) }()
+
+			var files []string
+			for i := 0; i < 100 && len(files) < 2; i++ {
+				time.Sleep(10 * time.Millisecond)
+				files, _ = filepath.Glob(filepath.Join(workDir, "*.part"))
+			}
+			cancel()
+
+			if err := <-errCh; err != context.Canceled {
+				t.Fatalf("unexpected error: expected: %s actual: %v", context.Canceled, err)
+			}
+
+			files, err := filepath.Glob(filepath.Join(workDir, "*.part"))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if len(files) != 2 {
+				t.Errorf("unexpected kept ranges: expected: 2 actual: %q", files)
+			}
+
+			mu.Lock()
+			etag = c.etag
+			paused = false
+			mu.Unlock()
+
+			d = newDownloader(t, output, ts, 3)
+			d.workDir = workDir
+
+			err = d.Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if len(requested) != c.expected {
+				t.Errorf("unexpected requests: expected: %d actual: %q", c.expected, requested)
+			}
+
+			b, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if string(b) != registeredTestdatum["foo.png"] {
+				t.Errorf("unexpected content")
+			}
+
+			if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+				t.Errorf("unexpected work dir: expected: removed actual: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package downloading
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultS3Region is the region used when neither --s3-region, AWS_REGION nor AWS_DEFAULT_REGION is specified.
+const defaultS3Region = "us-east-1"
+
+// s3Protocol accesses the objects of "s3://bucket/key" URLs by GetObject with Range header,
+// signed with AWS Signature Version 4.
+//
+// Without an endpoint, the objects are requested from AWS with virtual-hosted-style URLs.
+// With an endpoint such as "http://localhost:9000" of MinIO, path-style URLs are used.
+type s3Protocol struct {
+	outStream io.Writer
+	client    *http.Client
+	endpoint  string
+	region    string
+	getenv    func(string) string
+
+	credsOnce sync.Once
+	creds     *credentials
+	credsErr  error
+}
+
+// newS3Protocol returns s3Protocol. endpoint and region fall back to the environment variables of the AWS CLI.
+func newS3Protocol(w io.Writer, client *http.Client, endpoint string, region string) *s3Protocol {
+	return &s3Protocol{outStream: w, client: client, endpoint: endpoint, region: region, getenv: os.Getenv}
+}
+
+// head gets the size and the ETag by HeadObject.
+func (p *s3Protocol) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	resp, err := p.do(ctx, "HEAD", u, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &metadata{contentLength: resp.ContentLength, header: resp.Header}, nil
+}
+
+// get gets the range of the object by GetObject.
+func (p *s3Protocol) get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	resp, err := p.do(ctx, "GET", u, rangeHeader, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// verify verifies the downloaded file with the ETag of the object, where possible.
+//
+// The ETag of an object uploaded at once is the MD5 of the content.
+// The ETag of a multipart upload such as "<hex>-3" is the MD5 of the MD5s of the parts,
+// and the size of the parts is got by HeadObject with partNumber=1.
+// The ETags of the objects encrypted with SSE-KMS or SSE-C are not MD5, so they are not verified.
+// Neither are the missing ETags, and the multipart ones whose parts are not all of the size of the first,
+// which is found by the number of the parts, since a false mismatch would fail the download.
+func (p *s3Protocol) verify(ctx context.Context, u *url.URL, header http.Header, filename string) error {
+	etag := strings.Trim(header.Get("ETag"), `"`)
+	if etag == "" {
+		fmt.Fprintf(p.outStream, "skip verification of ETag because it is missing\n")
+		return nil
+	}
+
+	if sse := header.Get("X-Amz-Server-Side-Encryption"); (sse != "" && sse != "AES256") || header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		fmt.Fprintf(p.outStream, "skip verification of ETag of the encrypted object\n")
+		return nil
+	}
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	var actual string
+
+	if strings.Contains(etag, "-") {
+		resp, err := p.do(ctx, "HEAD", u, "", url.Values{"partNumber": {"1"}})
+		if err != nil {
+			fmt.Fprintf(p.outStream, "skip verification of ETag because the part size is unknown: %s\n", err)
+			return nil
+		}
+		resp.Body.Close()
+
+		actual, err = multipartETag(fp, resp.ContentLength)
+		if err != nil {
+			return err
+		}
+
+		if expected, computed := etagParts(etag), etagParts(actual); expected != computed {
+			fmt.Fprintf(p.outStream, "skip verification of ETag because the parts are not of the same size: %d parts expected, %d computed\n", expected, computed)
+			return nil
+		}
+	} else {
+		h := md5.New()
+		_, err = io.Copy(h, fp)
+		if err != nil {
+			return err
+		}
+		actual = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if !strings.EqualFold(actual, etag) {
+		return fmt.Errorf("ETag mismatch: expected: %s actual: %s", etag, actual)
+	}
+
+	fmt.Fprintf(p.outStream, "verified: ETag %s\n", etag)
+
+	return nil
+}
+
+// etagParts returns the number of the parts of the multipart ETag such as "<hex>-3", or 0 if it is invalid.
+func etagParts(etag string) int {
+	n, err := strconv.Atoi(etag[strings.LastIndex(etag, "-")+1:])
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// multipartETag returns the ETag of the content of r uploaded in the parts of partSize bytes, such as "<hex>-3".
+func multipartETag(r io.Reader, partSize int64) (string, error) {
+	if partSize < 1 {
+		return "", fmt.Errorf("invalid part size: %d", partSize)
+	}
+
+	var sums []byte
+	n := 0
+	for {
+		h := md5.New()
+		written, err := io.CopyN(h, r, partSize)
+		if written > 0 {
+			sums = append(sums, h.Sum(nil)...)
+			n++
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sum := md5.Sum(sums)
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), n), nil
+}
+
+// do sends the signed request for the object of u with rangeHeader and query,
+// and returns the response if it is successful.
+func (p *s3Protocol) do(ctx context.Context, method string, u *url.URL, rangeHeader string, query url.Values) (*http.Response, error) {
+	objectURL, err := p.objectURL(u)
+	if err != nil {
+		return nil, err
+	}
+	objectURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, objectURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	expectedStatusCode := http.StatusOK
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+		expectedStatusCode = http.StatusPartialContent
+	}
+
+	p.credsOnce.Do(func() {
+		p.creds, p.credsErr = loadCredentials(p.getenv)
+	})
+	if p.credsErr != nil {
+		return nil, p.credsErr
+	}
+
+	// Public objects are requested anonymously without credentials.
+	if p.creds != nil {
+		signV4(req, p.creds, p.regionName(), "s3", time.Now())
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != expectedStatusCode {
+		resp.Body.Close()
+		return nil, newStatusError(resp)
+	}
+
+	return resp, nil
+}
+
+// objectURL returns the HTTP URL of the object of u.
+// The key is encoded as in the canonical request of Signature Version 4.
+func (p *s3Protocol) objectURL(u *url.URL) (*url.URL, error) {
+	bucket := u.Host
+	key := strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 URL, which must be s3://bucket/key: %s", u)
+	}
+
+	endpoint := p.endpoint
+	if endpoint == "" {
+		endpoint = p.getenv("AWS_ENDPOINT_URL_S3")
+	}
+	if endpoint == "" {
+		endpoint = p.getenv("AWS_ENDPOINT_URL")
+	}
+
+	if endpoint != "" {
+		e, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		objectPath := strings.TrimSuffix(e.Path, "/") + "/" + bucket + "/" + key
+		return &url.URL{Scheme: e.Scheme, Host: e.Host, Path: objectPath, RawPath: uriEncode(objectPath, false)}, nil
+	}
+
+	host := "s3." + p.regionName() + ".amazonaws.com"
+	objectPath := "/" + key
+
+	// The wildcard certificate does not match the virtual-hosted-style host of a bucket name with dots.
+	if strings.Contains(bucket, ".") {
+		objectPath = "/" + bucket + objectPath
+	} else {
+		host = bucket + "." + host
+	}
+
+	return &url.URL{Scheme: "https", Host: host, Path: objectPath, RawPath: uriEncode(objectPath, false)}, nil
+}
+
+// regionName returns the region to sign the requests for.
+func (p *s3Protocol) regionName() string {
+	for _, region := range []string{p.region, p.getenv("AWS_REGION"), p.getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			return region
+		}
+	}
+	return defaultS3Region
+}
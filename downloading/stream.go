@@ -0,0 +1,198 @@
+package downloading
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// defaultMaxBuffer is the size of the buffer used by Stream when maxBuffer is not specified.
+const defaultMaxBuffer = 64 << 20
+
+// Stream performs parallel download and writes the content to w in byte order.
+// The checksum is verified after the whole content is written, but the hashes of pieces are not used.
+//
+// The content is split into chunks small enough that the chunks being downloaded or waiting to be written never exceed maxBuffer bytes in total.
+// Workers wait for the buffer to be released before requesting the next chunk, so a slow w applies backpressure to them.
+func (d *Downloader) Stream(ctx context.Context, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	contentLength, err := d.getContentLength(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = d.verifyMirrors(ctx, contentLength)
+	if err != nil {
+		return err
+	}
+
+	chunks := d.toStreamChunks(contentLength)
+
+	var h hash.Hash
+	if d.checksum != nil {
+		h, err = newHash(d.checksum.Type)
+		if err != nil {
+			return err
+		}
+		w = io.MultiWriter(w, h)
+	}
+
+	maxBuffer := int64(d.streamMaxBuffer())
+	sem := semaphore.NewWeighted(maxBuffer)
+	weight := func(c chunk) int64 {
+		// A chunk larger than the buffer is allowed alone, otherwise Acquire never succeeds.
+		if int64(c.length()) > maxBuffer {
+			return maxBuffer
+		}
+		return int64(c.length())
+	}
+
+	bufChs := make([]chan []byte, len(chunks))
+	for i := range bufChs {
+		bufChs[i] = make(chan []byte, 1)
+	}
+
+	jobCh := make(chan int)
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	// Chunks are dispatched in byte order, so the chunk the writer waits for has always acquired the buffer.
+	eg.Go(func() error {
+		defer close(jobCh)
+		for i, c := range chunks {
+			err := sem.Acquire(ctx, weight(c))
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case jobCh <- i:
+			}
+		}
+		return nil
+	})
+
+	for n := 0; n < d.streamParallelism(len(chunks)); n++ {
+		eg.Go(func() error {
+			for i := range jobCh {
+				b, err := d.partialRead(ctx, chunks[i])
+				if err != nil {
+					return err
+				}
+				bufChs[i] <- b
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		for i, c := range chunks {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case b := <-bufChs[i]:
+				_, err := w.Write(b)
+				sem.Release(weight(c))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+
+	// The content has already been written, but the mismatch is still reported.
+	if h != nil {
+		err = d.compareChecksum(h)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(d.outStream, "completed: %d bytes streamed\n", contentLength)
+
+	return nil
+}
+
+// toStreamChunks splits the content so that the chunks for all workers fit in maxBuffer.
+func (d *Downloader) toStreamChunks(contentLength int) []chunk {
+	parallelism := d.streamParallelism(contentLength)
+
+	chunkLength := d.streamMaxBuffer() / parallelism
+	if chunkLength < 1 {
+		chunkLength = 1
+	}
+
+	n := (contentLength + chunkLength - 1) / chunkLength
+	if n < parallelism {
+		n = parallelism
+	}
+
+	return splitContent(contentLength, n)
+}
+
+// streamMaxBuffer returns maxBuffer, or defaultMaxBuffer if it is not specified.
+func (d *Downloader) streamMaxBuffer() int {
+	if d.maxBuffer < 1 {
+		return defaultMaxBuffer
+	}
+	return d.maxBuffer
+}
+
+// streamParallelism returns the number of workers for n chunks, which satisfies 1 <= parallelism <= n.
+func (d *Downloader) streamParallelism(n int) int {
+	parallelism := d.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if n < parallelism {
+		parallelism = n
+	}
+	return parallelism
+}
+
+// partialRead sends a partial request for c and returns the response body read into memory.
+// If mirrors are specified, the request is sent to one of them.
+func (d *Downloader) partialRead(ctx context.Context, c chunk) ([]byte, error) {
+	var b []byte
+
+	_, err := d.failover(ctx, nil, func(ctx context.Context, u *url.URL) error {
+		body, err := d.requestRange(ctx, u, c.rangeHeader())
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		b, err = ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		if len(b) != c.length() {
+			return fmt.Errorf("unexpected length of %q: expected: %d actual: %d", c.rangeHeader(), c.length(), len(b))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(d.outStream, "received: %q\n", c.rangeHeader())
+
+	return b, nil
+}
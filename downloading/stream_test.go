@@ -0,0 +1,119 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestDownloading_Stream_Success(t *testing.T) {
+	cases := map[string]struct {
+		parallelism         int
+		maxBuffer           int
+		currentTestdataName string
+	}{
+		"normal":                      {parallelism: 3, maxBuffer: 10000, currentTestdataName: "foo.png"},
+		"buffer smaller than a chunk": {parallelism: 8, maxBuffer: 4, currentTestdataName: "a.txt"},
+		"default buffer":              {parallelism: 3, maxBuffer: 0, currentTestdataName: "foo.png"},
+		"parallelism < 1":             {parallelism: 0, maxBuffer: 10000, currentTestdataName: "a.txt"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = c.currentTestdataName
+
+			ts, clean := newTestServer(t, normalHandler)
+			defer clean()
+
+			d := newDownloader(t, "-", ts, c.parallelism)
+			d.maxBuffer = c.maxBuffer
+
+			buf := &bytes.Buffer{}
+			err := d.Stream(context.Background(), buf)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if buf.String() != registeredTestdatum[c.currentTestdataName] {
+				t.Errorf("unexpected content")
+			}
+		})
+	}
+}
+
+func TestDownloading_Stream_BadRequest(t *testing.T) {
+	expected := "unexpected status code: 400"
+
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "100")
+		if r.Method == "GET" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	defer clean()
+
+	err := newDownloader(t, "-", ts, 2).Stream(context.Background(), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	actual := err.Error()
+	if actual != expected {
+		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+func TestDownloading_Stream_ShortBody(t *testing.T) {
+	expected := `unexpected length of "bytes=0-9": expected: 10 actual: 1`
+
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "10")
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, "a")
+	})
+	defer clean()
+
+	err := newDownloader(t, "-", ts, 1).Stream(context.Background(), &bytes.Buffer{})
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	actual := err.Error()
+	if actual != expected {
+		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+func TestDownloading_Stream_WriteError(t *testing.T) {
+	expected := errors.New("write error")
+
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, "-", ts, 3)
+	d.maxBuffer = 10000
+
+	actual := d.Stream(context.Background(), errWriter{err: expected})
+	if actual != expected {
+		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
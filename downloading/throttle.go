@@ -0,0 +1,41 @@
+package downloading
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"github.com/hioki-daichi/parallel-download/throttling"
+)
+
+// acquire waits until the throttle allows a request to the host of u,
+// and returns the function to release the request with its error.
+func (d *Downloader) acquire(ctx context.Context, u *url.URL) (func(err error), error) {
+	release, err := d.throttle.Acquire(ctx, d.outStream, u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(err error) {
+		release(outcome(ctx, err))
+	}, nil
+}
+
+// outcome returns the outcome of the request which resulted in err for the circuit breaker.
+// The host is failing if it responds 429 or 5xx, or the request fails without a response.
+func outcome(ctx context.Context, err error) throttling.Outcome {
+	if err == nil {
+		return throttling.Succeeded
+	}
+
+	// The request was canceled by the download, not by the host.
+	if ctx.Err() != nil {
+		return throttling.Aborted
+	}
+
+	if e, ok := err.(*statusError); ok && e.code != http.StatusTooManyRequests && e.code < http.StatusInternalServerError {
+		return throttling.Succeeded
+	}
+
+	return throttling.Failed
+}
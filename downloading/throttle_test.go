@@ -0,0 +1,124 @@
+package downloading
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/throttling"
+)
+
+func TestDownloading_Download_HostConnections(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := readTestdata("foo.png")
+
+	var active, max int32
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		normalHandler(t, w, r)
+	})
+	defer clean()
+
+	throttle := throttling.New(0, 2, 0, 0)
+
+	// The downloads of a batch run share the throttle.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		output, clean := createTempOutput(t)
+		defer clean()
+
+		d := newDownloader(t, output, ts, 4)
+		d.throttle = throttle
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := d.Download(context.Background())
+			if err != nil {
+				t.Errorf("err %s", err)
+				return
+			}
+
+			assertFileContent(t, output, content)
+		}()
+	}
+	wg.Wait()
+
+	if m := atomic.LoadInt32(&max); m != 2 {
+		t.Errorf("unexpected concurrent requests: expected: 2 actual: %d", m)
+	}
+}
+
+func TestDownloading_Download_CircuitBreaker(t *testing.T) {
+	currentTestdataName = "foo.png"
+	content := readTestdata("foo.png")
+
+	var down int32 = 1
+	ts, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		normalHandler(t, w, r)
+	})
+	defer clean()
+
+	cooldown := 100 * time.Millisecond
+	throttle := throttling.New(0, 0, 1, cooldown)
+	log := &lockedBuffer{}
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	d := newDownloader(t, output, ts, 4)
+	d.outStream = log
+	d.throttle = throttle
+
+	err := d.Download(context.Background())
+	if err == nil || err.Error() != "unexpected status code: 503" {
+		t.Fatalf("unexpected error: expected: %q actual: %v", "unexpected status code: 503", err)
+	}
+
+	host := mustParseRequestURI(t, ts.URL).Host
+	if expected := "pause: " + host + " after 1 consecutive failures"; !strings.Contains(log.String(), expected) {
+		t.Errorf("unexpected log: expected to contain: %q actual: %q", expected, log.String())
+	}
+
+	atomic.StoreInt32(&down, 0)
+
+	// The next download waits for the cooldown, and resumes after the probe.
+	d = newDownloader(t, output, ts, 4)
+	d.outStream = log
+	d.throttle = throttle
+
+	start := time.Now()
+	err = d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+
+	if elapsed := time.Since(start); elapsed < cooldown/2 {
+		t.Errorf("unexpected elapsed time: expected: about %s actual: %s", cooldown, elapsed)
+	}
+
+	if expected := "probe: " + host + "\nresume: " + host + "\n"; !strings.Contains(log.String(), expected) {
+		t.Errorf("unexpected log: expected to contain: %q actual: %q", expected, log.String())
+	}
+}
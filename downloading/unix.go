@@ -0,0 +1,113 @@
+package downloading
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+)
+
+// unixProtocol accesses the content over HTTP through Unix domain sockets,
+// at the URLs such as "http+unix:///var/run/app.sock:/path/file" whose path is the socket and the request path.
+type unixProtocol struct {
+	outStream     io.Writer
+	verbose       bool
+	checkRedirect func(req *http.Request, via []*http.Request) error
+	metrics       *metrics.Metrics
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// head makes a HEAD request through the socket of u.
+func (p *unixProtocol) head(ctx context.Context, u *url.URL) (*metadata, error) {
+	hp, hu, err := p.httpProtocol(u)
+	if err != nil {
+		return nil, err
+	}
+
+	md, err := hp.head(ctx, hu)
+	if err != nil {
+		return nil, err
+	}
+
+	// The location is the URL of the socket-less HTTP request, which cannot be requested instead of u.
+	md.location = nil
+
+	return md, nil
+}
+
+// get sends a GET request through the socket of u.
+func (p *unixProtocol) get(ctx context.Context, u *url.URL, rangeHeader string) (io.ReadCloser, error) {
+	hp, hu, err := p.httpProtocol(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return hp.get(ctx, hu, rangeHeader)
+}
+
+// getRanges sends a GET request of multiple ranges through the socket of u.
+func (p *unixProtocol) getRanges(ctx context.Context, u *url.URL, rangeHeader string) (http.Header, io.ReadCloser, error) {
+	hp, hu, err := p.httpProtocol(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return hp.getRanges(ctx, hu, rangeHeader)
+}
+
+// httpProtocol returns the HTTP protocol whose client connects to the socket of u, and the URL of the request.
+// The clients are kept by socket so that the connections are reused, and their requests are measured as newHTTPClient does.
+func (p *unixProtocol) httpProtocol(u *url.URL) (*httpProtocol, *url.URL, error) {
+	socket, hu, err := splitUnixURL(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.clients == nil {
+		p.clients = map[string]*http.Client{}
+	}
+
+	client, ok := p.clients[socket]
+	if !ok {
+		client = &http.Client{Transport: newUnixTransport(socket), CheckRedirect: p.checkRedirect}
+		if p.metrics != nil {
+			client.Transport = &meteredTransport{RoundTripper: client.Transport, metrics: p.metrics}
+		}
+		p.clients[socket] = client
+	}
+
+	return &httpProtocol{outStream: p.outStream, client: client, verbose: p.verbose}, hu, nil
+}
+
+// splitUnixURL splits u such as "http+unix:///var/run/app.sock:/path/file" into the socket "/var/run/app.sock"
+// and the HTTP URL "http://localhost/path/file".
+func splitUnixURL(u *url.URL) (string, *url.URL, error) {
+	i := strings.Index(u.Path, ":")
+	if i <= 0 {
+		return "", nil, fmt.Errorf("invalid URL, which must be http+unix:///path/to/socket:/path: %s", u)
+	}
+
+	return u.Path[:i], &url.URL{Scheme: "http", Host: "localhost", Path: u.Path[i+1:], RawQuery: u.RawQuery}, nil
+}
+
+// newUnixTransport returns the transport whose connections are made to the Unix domain socket regardless of the host.
+func newUnixTransport(socket string) *http.Transport {
+	var dialer net.Dialer
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+
+	return newTransport(dial, nil)
+}
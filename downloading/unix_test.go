@@ -0,0 +1,120 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_UnixSocket(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	socket := filepath.Join(dir, "app.sock")
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/foo.png" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		normalHandler(t, w, r)
+	}))
+	ts.Listener = ln
+	ts.Start()
+	defer ts.Close()
+
+	currentTestdataName = "foo.png"
+
+	cases := map[string]struct {
+		rawurl     string
+		unixSocket string
+	}{
+		"http+unix":     {rawurl: "http+unix://" + socket + ":/files/foo.png"},
+		"--unix-socket": {rawurl: "http://localhost/files/foo.png", unixSocket: socket},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			opts := &opt.Options{
+				Parallelism: 4,
+				Output:      output,
+				URL:         mustParseRequestURI(t, c.rawurl),
+				Timeout:     60 * time.Second,
+				UnixSocket:  c.unixSocket,
+				Metrics:     metrics.New(),
+			}
+
+			err := NewDownloader(ioutil.Discard, opts).Download(context.Background())
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			assertFileContent(t, output, readTestdata("foo.png"))
+
+			// The requests through the socket are measured as the others are.
+			var buf bytes.Buffer
+			_, err = opts.Metrics.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if expected := "parallel_download_request_duration_seconds_count{code=\"206\"}"; !strings.Contains(buf.String(), expected) {
+				t.Errorf("unexpected metrics: expected to contain: %q actual: %q", expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestDownloading_splitUnixURL(t *testing.T) {
+	cases := map[string]struct {
+		rawurl         string
+		expectedSocket string
+		expectedURL    string
+		expectedErr    bool
+	}{
+		"path":     {rawurl: "http+unix:///var/run/app.sock:/path/file", expectedSocket: "/var/run/app.sock", expectedURL: "http://localhost/path/file"},
+		"query":    {rawurl: "http+unix:///var/run/docker.sock:/images/get?names=alpine", expectedSocket: "/var/run/docker.sock", expectedURL: "http://localhost/images/get?names=alpine"},
+		"no colon": {rawurl: "http+unix:///var/run/app.sock", expectedErr: true},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			socket, u, err := splitUnixURL(mustParseRequestURI(t, c.rawurl))
+			if c.expectedErr {
+				if err == nil {
+					t.Fatal("Unexpectedly err was nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if socket != c.expectedSocket {
+				t.Errorf("unexpected socket: expected: %s actual: %s", c.expectedSocket, socket)
+			}
+
+			if u.String() != c.expectedURL {
+				t.Errorf("unexpected URL: expected: %s actual: %s", c.expectedURL, u)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package downloading
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+)
+
+// newHash returns hash.Hash of the specified type such as "sha-256" (as in metalink) or "sha256".
+func newHash(typ string) (hash.Hash, error) {
+	switch strings.Replace(strings.ToLower(typ), "-", "", -1) {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha224":
+		return sha256.New224(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha384":
+		return sha512.New384(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash type: %s", typ)
+	}
+}
+
+// verifyChecksum verifies the content of the file of the specified filename with checksum.
+func (d *Downloader) verifyChecksum(filename string) error {
+	if d.checksum == nil {
+		return nil
+	}
+
+	fp, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	h, err := newHash(d.checksum.Type)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(h, fp)
+	if err != nil {
+		return err
+	}
+
+	return d.compareChecksum(h)
+}
+
+// verifyContent verifies the content of the file of the specified filename with the metadata of the URL,
+// if the protocol for its scheme supports it.
+func (d *Downloader) verifyContent(ctx context.Context, filename string) error {
+	p, err := d.protocol(d.url)
+	if err != nil {
+		return err
+	}
+
+	v, ok := p.(verifier)
+	if !ok {
+		return nil
+	}
+
+	return v.verify(ctx, d.url, d.header, filename)
+}
+
+// compareChecksum compares the sum of h with checksum.
+func (d *Downloader) compareChecksum(h hash.Hash) error {
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, d.checksum.Value) {
+		d.metrics.AddChecksumFailure(metrics.Checksum)
+		return fmt.Errorf("%s checksum mismatch: expected: %s actual: %s", d.checksum.Type, d.checksum.Value, actual)
+	}
+
+	fmt.Fprintf(d.outStream, "verified: %s %s\n", d.checksum.Type, actual)
+
+	return nil
+}
+
+// numPieces returns the number of the pieces of the content of the specified length,
+// and verifies that it matches the number of the hashes of pieces.
+func (d *Downloader) numPieces(contentLength int) (int, error) {
+	if d.pieces.Length < 1 {
+		return 0, fmt.Errorf("invalid piece length: %d", d.pieces.Length)
+	}
+
+	n := (contentLength + d.pieces.Length - 1) / d.pieces.Length
+	if n != len(d.pieces.Hashes) {
+		return 0, fmt.Errorf("number of piece hashes %d does not match the %d pieces of Content-Length %d", len(d.pieces.Hashes), n, contentLength)
+	}
+
+	return n, nil
+}
+
+// repairPieces verifies the pieces in the file of the specified filename which has the content of c served by source,
+// and re-downloads only the corrupt pieces, preferably from the other sources, up to pieceRetries times.
+// c must be aligned to the pieces.
+func (d *Downloader) repairPieces(ctx context.Context, filename string, c chunk, source *url.URL) error {
+	if d.pieces == nil {
+		return nil
+	}
+
+	servedBy := map[int]*url.URL{}
+
+	for retry := 0; ; retry++ {
+		corrupt, err := d.findCorruptPieces(filename, c)
+		if err != nil {
+			return err
+		}
+
+		if len(corrupt) == 0 {
+			fmt.Fprintf(d.outStream, "verified: pieces of %q\n", c.rangeHeader())
+			return nil
+		}
+
+		for _, i := range corrupt {
+			u, ok := servedBy[i]
+			if !ok {
+				u = source
+			}
+			servedBy[i] = u
+
+			d.metrics.AddChecksumFailure(metrics.Piece)
+			fmt.Fprintf(d.outStream, "corrupt: piece %d (%s) served by %s\n", i, d.pieceChunk(c, i).rangeHeader(), u)
+		}
+
+		if retry >= d.pieceRetries {
+			return fmt.Errorf("piece %d: %s mismatch after %d retries", corrupt[0], d.pieces.Type, retry)
+		}
+
+		for _, i := range corrupt {
+			d.retry(fmt.Errorf("piece %d: %s mismatch", i, d.pieces.Type))
+
+			u, err := d.refetchPiece(ctx, filename, c, i, servedBy[i])
+			if err != nil {
+				return err
+			}
+			servedBy[i] = u
+		}
+	}
+}
+
+// findCorruptPieces returns the indexes of the pieces whose hashes do not match in the file which has the content of c.
+func (d *Downloader) findCorruptPieces(filename string, c chunk) ([]int, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var corrupt []int
+	for offset := 0; offset < c.length(); offset += d.pieces.Length {
+		i := (c.first + offset) / d.pieces.Length
+
+		h, err := newHash(d.pieces.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = io.Copy(h, io.NewSectionReader(fp, int64(offset), int64(d.pieces.Length)))
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), d.pieces.Hashes[i]) {
+			corrupt = append(corrupt, i)
+		}
+	}
+
+	return corrupt, nil
+}
+
+// refetchPiece downloads the i-th piece again, avoiding the URL which served the corrupt one,
+// and overwrites the piece in the file which has the content of c.
+// It returns the URL which served the piece.
+func (d *Downloader) refetchPiece(ctx context.Context, filename string, c chunk, i int, avoid *url.URL) (*url.URL, error) {
+	pc := d.pieceChunk(c, i)
+
+	var b []byte
+	source, err := d.failover(ctx, avoid, func(ctx context.Context, u *url.URL) error {
+		body, err := d.requestRange(ctx, u, pc.rangeHeader())
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		b, err = ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+
+		if len(b) != pc.length() {
+			return fmt.Errorf("unexpected length of %q: expected: %d actual: %d", pc.rangeHeader(), pc.length(), len(b))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fp, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	_, err = fp.WriteAt(b, int64(pc.first-c.first))
+	if err != nil {
+		return nil, err
+	}
+
+	return source, fp.Close()
+}
+
+// pieceChunk returns the byte range of the i-th piece, which is in c.
+func (d *Downloader) pieceChunk(c chunk, i int) chunk {
+	first := i * d.pieces.Length
+	last := first + d.pieces.Length - 1
+	if last > c.last {
+		last = c.last
+	}
+	return chunk{first: first, last: last}
+}
@@ -0,0 +1,247 @@
+package downloading
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/hioki-daichi/parallel-download/opt"
+)
+
+func TestDownloading_Download_Checksum(t *testing.T) {
+	cases := map[string]struct {
+		checksum *opt.Checksum
+		expected string
+	}{
+		"match":       {checksum: &opt.Checksum{Type: "sha-256", Value: sha256Hex(registeredTestdatum["foo.png"])}, expected: ""},
+		"mismatch":    {checksum: &opt.Checksum{Type: "sha-256", Value: sha256Hex("")}, expected: "sha-256 checksum mismatch"},
+		"unsupported": {checksum: &opt.Checksum{Type: "crc32", Value: ""}, expected: "unsupported hash type: crc32"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = "foo.png"
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			ts, clean := newTestServer(t, normalHandler)
+			defer clean()
+
+			d := newDownloader(t, output, ts, 3)
+			d.checksum = c.checksum
+
+			err := d.Download(context.Background())
+			assertErrorMatches(t, err, c.expected)
+		})
+	}
+}
+
+func TestDownloading_Stream_Checksum(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	d := newDownloader(t, "-", ts, 3)
+	d.checksum = &opt.Checksum{Type: "sha-256", Value: sha256Hex("")}
+
+	err := d.Stream(context.Background(), &bytes.Buffer{})
+	assertErrorMatches(t, err, "sha-256 checksum mismatch")
+}
+
+func TestDownloading_Download_Pieces(t *testing.T) {
+	content := registeredTestdatum["foo.png"]
+	pieceLength := 10000
+	hashes := pieceHashes(content, pieceLength)
+
+	corrupted := append([]string{}, hashes...)
+	corrupted[7] = sha1Hex("")
+
+	cases := map[string]struct {
+		pieces   *opt.Pieces
+		expected string
+	}{
+		"match":            {pieces: &opt.Pieces{Type: "sha-1", Length: pieceLength, Hashes: hashes}, expected: ""},
+		"mismatch":         {pieces: &opt.Pieces{Type: "sha-1", Length: pieceLength, Hashes: corrupted}, expected: "piece 7: sha-1 mismatch after 0 retries"},
+		"number of hashes": {pieces: &opt.Pieces{Type: "sha-1", Length: pieceLength, Hashes: hashes[1:]}, expected: "number of piece hashes 16 does not match the 17 pieces"},
+		"invalid length":   {pieces: &opt.Pieces{Type: "sha-1", Length: 0, Hashes: hashes}, expected: "invalid piece length: 0"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			currentTestdataName = "foo.png"
+
+			output, clean := createTempOutput(t)
+			defer clean()
+
+			ts, clean := newTestServer(t, normalHandler)
+			defer clean()
+
+			d := newDownloader(t, output, ts, 3)
+			d.pieces = c.pieces
+
+			err := d.Download(context.Background())
+			assertErrorMatches(t, err, c.expected)
+
+			if c.expected == "" {
+				assertFileContent(t, output, content)
+			}
+		})
+	}
+}
+
+func TestDownloading_toChunks_Pieces(t *testing.T) {
+	d := &Downloader{parallelism: 2, pieces: &opt.Pieces{Length: 10, Hashes: make([]string, 5)}}
+
+	actual, err := d.toChunks(45, d.parallelism)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := []chunk{{first: 0, last: 19}, {first: 20, last: 44}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected chunks: expected: %v actual: %v", expected, actual)
+	}
+}
+
+func assertErrorMatches(t *testing.T, err error, expected string) {
+	t.Helper()
+
+	if expected == "" {
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		return
+	}
+
+	if err == nil {
+		t.Fatal("unexpectedly err is nil")
+	}
+
+	if !regexp.MustCompile(regexp.QuoteMeta(expected)).MatchString(err.Error()) {
+		t.Errorf("unexpectedly not matched: %s", err.Error())
+	}
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestDownloading_Download_RepairPieces(t *testing.T) {
+	content := registeredTestdatum["foo.png"]
+	pieceLength := 10000
+	pieces := &opt.Pieces{Type: "sha-1", Length: pieceLength, Hashes: pieceHashes(content, pieceLength)}
+
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	// The mirror corrupts the first byte of every response.
+	mirror, clean := newTestServer(t, func(t *testing.T, w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		normalHandler(t, rec, r)
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		b := rec.Body.Bytes()
+		if len(b) > 0 {
+			b[0]++
+		}
+		w.Write(b)
+	})
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	log := &lockedBuffer{}
+
+	d := newDownloader(t, output, ts, 4)
+	d.outStream = log
+	d.mirrors = []*url.URL{mustParseRequestURI(t, mirror.URL)}
+	d.pieces = pieces
+	d.pieceRetries = 1
+
+	err := d.Download(context.Background())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	assertFileContent(t, output, content)
+
+	// Two of four chunks are served by the mirror, and the first piece of each is corrupt.
+	corrupt := regexp.MustCompile(`corrupt: piece \d+ \(bytes=\d+-\d+\) served by `+regexp.QuoteMeta(mirror.URL)).FindAllString(log.String(), -1)
+	if len(corrupt) != 2 {
+		t.Errorf("unexpected reports of corrupt pieces: %q", corrupt)
+	}
+}
+
+func TestDownloading_Download_RepairPieces_Exhausted(t *testing.T) {
+	currentTestdataName = "foo.png"
+
+	ts, clean := newTestServer(t, normalHandler)
+	defer clean()
+
+	output, clean := createTempOutput(t)
+	defer clean()
+
+	hashes := pieceHashes(registeredTestdatum["foo.png"], 10000)
+	hashes[3] = sha1Hex("")
+
+	d := newDownloader(t, output, ts, 4)
+	d.pieces = &opt.Pieces{Type: "sha-1", Length: 10000, Hashes: hashes}
+	d.pieceRetries = 2
+
+	err := d.Download(context.Background())
+	assertErrorMatches(t, err, "piece 3: sha-1 mismatch after 2 retries")
+}
+
+func pieceHashes(content string, pieceLength int) []string {
+	var hashes []string
+	for i := 0; i < len(content); i += pieceLength {
+		end := i + pieceLength
+		if end > len(content) {
+			end = len(content)
+		}
+		hashes = append(hashes, sha1Hex(content[i:end]))
+	}
+	return hashes
+}
+
+// lockedBuffer is bytes.Buffer which is safe for concurrent writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
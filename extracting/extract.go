@@ -0,0 +1,181 @@
+package extracting
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compression has the magic number of a compression format and the way to decompress it.
+type compression struct {
+	magic      []byte
+	extensions map[string]string
+	newReader  func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = []compression{
+	{
+		magic:      []byte{0x1f, 0x8b},
+		extensions: map[string]string{".gz": "", ".tgz": ".tar"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		magic:      []byte("BZh"),
+		extensions: map[string]string{".bz2": "", ".tbz2": ".tar", ".tbz": ".tar"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		magic:      []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		extensions: map[string]string{".xz": "", ".txz": ".tar"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(xr), nil
+		},
+	},
+	{
+		magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		extensions: map[string]string{".zst": "", ".tzst": ".tar"},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return zr.IOReadCloser(), nil
+		},
+	},
+}
+
+var (
+	tarMagic = []byte("ustar")
+	zipMagic = []byte("PK\x03\x04")
+)
+
+// Extract decompresses the content read from r and unpacks it under dir.
+//
+// gzip, bzip2, xz and zstd are decompressed, and then tar and zip archives are unpacked.
+// The formats are detected by their magic numbers, not by name.
+// Any other content is saved under dir with name, whose compression extension is trimmed.
+// A zip archive is spooled to a temporary file because its central directory is at the end.
+func Extract(ctx context.Context, w io.Writer, r io.Reader, name string, dir string) error {
+	br := bufio.NewReader(r)
+
+	for _, c := range compressions {
+		magic, _ := br.Peek(len(c.magic))
+		if !bytes.Equal(magic, c.magic) {
+			continue
+		}
+
+		fmt.Fprintf(w, "decompress: %q\n", name)
+
+		rc, err := c.newReader(br)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		br = bufio.NewReader(rc)
+		name = trimExtension(name, c.extensions)
+
+		break
+	}
+
+	e, err := newExtractor(w, dir)
+	if err != nil {
+		return err
+	}
+
+	if header, _ := br.Peek(512); len(header) == 512 && bytes.Equal(header[257:257+len(tarMagic)], tarMagic) {
+		return extractTar(ctx, e, br)
+	}
+
+	if magic, _ := br.Peek(len(zipMagic)); bytes.Equal(magic, zipMagic) {
+		return extractSpooledZip(ctx, w, br, dir)
+	}
+
+	return e.writeFile(path.Base(name), 0644, br)
+}
+
+// trimExtension trims the compression extension from name.
+// For example, "foo.tar.gz" becomes "foo.tar" and "foo.tgz" becomes "foo.tar".
+func trimExtension(name string, extensions map[string]string) string {
+	ext := path.Ext(name)
+
+	replacement, ok := extensions[strings.ToLower(ext)]
+	if !ok {
+		return name
+	}
+
+	return strings.TrimSuffix(name, ext) + replacement
+}
+
+// extractTar unpacks the tar archive read from r.
+// Entries other than directories, regular files, symlinks and hard links are skipped.
+func extractTar(ctx context.Context, e *extractor, r io.Reader) error {
+	tr := tar.NewReader(r)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(hdr.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.writeFile(hdr.Name, hdr.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = e.symlink(hdr.Name, hdr.Linkname)
+		case tar.TypeLink:
+			err = e.link(hdr.Name, hdr.Linkname)
+		default:
+			fmt.Fprintf(e.outStream, "skipped: %q\n", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// extractSpooledZip saves the zip archive read from r to a temporary file and unpacks it.
+func extractSpooledZip(ctx context.Context, w io.Writer, r io.Reader, dir string) error {
+	fp, err := ioutil.TempFile("", "parallel-download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	size, err := io.Copy(fp, r)
+	if err != nil {
+		return err
+	}
+
+	return ExtractZip(ctx, w, fp, size, dir, nil, 1)
+}
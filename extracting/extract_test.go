@@ -0,0 +1,237 @@
+package extracting
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestExtracting_Extract_Tar(t *testing.T) {
+	cases := map[string]struct {
+		compress func(t *testing.T, b []byte) []byte
+	}{
+		"tar":     {compress: func(t *testing.T, b []byte) []byte { return b }},
+		"tar.gz":  {compress: gzipBytes},
+		"tar.xz":  {compress: xzBytes},
+		"tar.zst": {compress: zstdBytes},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			r := bytes.NewReader(c.compress(t, newTestTar(t, []*tar.Header{
+				{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755},
+				{Typeflag: tar.TypeReg, Name: "a/b.txt", Mode: 0644, Size: 1},
+				{Typeflag: tar.TypeSymlink, Name: "a/c.txt", Linkname: "b.txt"},
+				{Typeflag: tar.TypeLink, Name: "a/d.txt", Linkname: "a/b.txt"},
+			})))
+
+			err := Extract(context.Background(), ioutil.Discard, r, "a."+n, dir)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			for _, name := range []string{"a/b.txt", "a/c.txt", "a/d.txt"} {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				if string(b) != "b" {
+					t.Errorf(`unexpected content of %s: expected: "b" actual: "%s"`, name, b)
+				}
+			}
+		})
+	}
+}
+
+func TestExtracting_Extract_TarBzip2(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	fp, err := os.Open("testdata/a.tar.bz2")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer fp.Close()
+
+	err = Extract(context.Background(), ioutil.Discard, fp, "a.tar.bz2", dir)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a/a.txt"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if string(b) != "a" {
+		t.Errorf(`unexpected content: expected: "a" actual: "%s"`, b)
+	}
+}
+
+func TestExtracting_Extract_Zip(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	r := newTestZip(t, map[string]string{"a.txt": "a"})
+
+	err := Extract(context.Background(), ioutil.Discard, r, "a.zip", dir)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if string(b) != "a" {
+		t.Errorf(`unexpected content: expected: "a" actual: "%s"`, b)
+	}
+}
+
+func TestExtracting_Extract_SingleFile(t *testing.T) {
+	cases := map[string]struct {
+		name     string
+		content  []byte
+		expected string
+	}{
+		"gzip":         {name: "path/to/foo.txt.gz", content: gzipBytes(t, []byte("foo")), expected: "foo.txt"},
+		"uncompressed": {name: "foo.txt", content: []byte("foo"), expected: "foo.txt"},
+		"tgz":          {name: "foo.tgz", content: gzipBytes(t, []byte("foo")), expected: "foo.tar"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			err := Extract(context.Background(), ioutil.Discard, bytes.NewReader(c.content), c.name, dir)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(dir, c.expected))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if string(b) != "foo" {
+				t.Errorf(`unexpected content: expected: "foo" actual: "%s"`, b)
+			}
+		})
+	}
+}
+
+func TestExtracting_Extract_Escape(t *testing.T) {
+	cases := map[string]struct {
+		headers  []*tar.Header
+		expected string
+	}{
+		"path traversal": {
+			headers:  []*tar.Header{{Typeflag: tar.TypeReg, Name: "../b.txt", Mode: 0644, Size: 1}},
+			expected: "path escapes the destination",
+		},
+		"symlink escape": {
+			headers:  []*tar.Header{{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "../../etc"}},
+			expected: "symlink escapes the destination",
+		},
+		"chained symlink escape": {
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "."},
+				{Typeflag: tar.TypeSymlink, Name: "a/b", Linkname: "../outside"},
+			},
+			expected: "symlink escapes the destination",
+		},
+		"hard link escape": {
+			headers:  []*tar.Header{{Typeflag: tar.TypeLink, Name: "a", Linkname: "../etc/passwd"}},
+			expected: "path escapes the destination",
+		},
+		"hard link to symlink": {
+			headers: []*tar.Header{
+				{Typeflag: tar.TypeSymlink, Name: "a", Linkname: "b"},
+				{Typeflag: tar.TypeLink, Name: "c", Linkname: "a"},
+			},
+			expected: "hard link to non-regular file",
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			err := Extract(context.Background(), ioutil.Discard, bytes.NewReader(newTestTar(t, c.headers)), "a.tar", dir)
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if !regexp.MustCompile(c.expected).MatchString(err.Error()) {
+				t.Errorf("unexpectedly not matched: %s", err.Error())
+			}
+		})
+	}
+}
+
+// newTestTar returns the tar archive which has the entries of headers.
+// The content of each regular file is "b" repeated for its size.
+func newTestTar(t *testing.T, headers []*tar.Header) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range headers {
+		hdr.Format = tar.FormatUSTAR
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("err %s", err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(bytes.Repeat([]byte("b"), int(hdr.Size)))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, b []byte) []byte {
+	return compressBytes(t, b, func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil })
+}
+
+func xzBytes(t *testing.T, b []byte) []byte {
+	return compressBytes(t, b, func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) })
+}
+
+func zstdBytes(t *testing.T, b []byte) []byte {
+	return compressBytes(t, b, func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) })
+}
+
+func compressBytes(t *testing.T, b []byte, newWriter func(w io.Writer) (io.WriteCloser, error)) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	w, err := newWriter(buf)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return buf.Bytes()
+}
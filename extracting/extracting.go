@@ -0,0 +1,226 @@
+/*
+Package extracting provides extraction of archives.
+*/
+package extracting
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// extractor writes the entries of an archive under dir,
+// protecting against path traversal and symlink escapes.
+type extractor struct {
+	outStream io.Writer
+	dir       string
+}
+
+// newExtractor creates dir if missing and returns extractor which writes under dir.
+func newExtractor(w io.Writer, dir string) (*extractor, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the symlinks of dir itself, otherwise the resolved paths of the entries never have dir as their prefix.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &extractor{outStream: w, dir: dir}, nil
+}
+
+// writeFile writes the content read from r to the file of the specified name.
+func (e *extractor) writeFile(name string, mode os.FileMode, r io.Reader) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	err = e.mkdirAll(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	// Do not write through an existing symlink.
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	fp, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = io.Copy(fp, r)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.outStream, "extracted: %q\n", p)
+
+	return fp.Close()
+}
+
+// mkdir creates the directory of the specified name.
+func (e *extractor) mkdir(name string) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	return e.mkdirAll(p)
+}
+
+// symlink creates the symlink of the specified name which points to target.
+// target must stay under dir, even if the symlinks in the parent of the symlink are resolved.
+func (e *extractor) symlink(name string, target string) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	if filepath.IsAbs(target) || !e.contains(filepath.Join(filepath.Dir(p), target)) {
+		return fmt.Errorf("symlink escapes the destination: %s -> %s", name, target)
+	}
+
+	err = e.mkdirAll(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	// The parent may be reached through the symlinks extracted before, such as "a -> ." for "a/b -> ../outside".
+	parent, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	if !e.contains(filepath.Join(parent, target)) {
+		return fmt.Errorf("symlink escapes the destination: %s -> %s", name, target)
+	}
+
+	if _, err := os.Lstat(p); err == nil {
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Symlink(target, p)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.outStream, "extracted: %q -> %q\n", p, target)
+
+	return nil
+}
+
+// link creates the hard link of the specified name to the entry of target, which is also a name in the archive.
+func (e *extractor) link(name string, target string) error {
+	p, err := e.path(name)
+	if err != nil {
+		return err
+	}
+
+	t, err := e.path(target)
+	if err != nil {
+		return err
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Dir(t))
+	if err != nil {
+		return err
+	}
+	if !e.contains(resolved) {
+		return fmt.Errorf("path escapes the destination: %s", target)
+	}
+
+	// The target must not be a symlink, otherwise the link may refer to the file it points to.
+	fi, err := os.Lstat(t)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("hard link to non-regular file: %s -> %s", name, target)
+	}
+
+	err = e.mkdirAll(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(p); err == nil {
+		err = os.Remove(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Link(t, p)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.outStream, "extracted: %q => %q\n", p, t)
+
+	return nil
+}
+
+// mkdirAll creates the directory p and its parents,
+// after verifying that the nearest existing ancestor of p is under dir even if symlinks are resolved.
+func (e *extractor) mkdirAll(p string) error {
+	existing := p
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+
+	if !e.contains(resolved) {
+		return fmt.Errorf("path escapes the destination: %s", p)
+	}
+
+	return os.MkdirAll(p, 0755)
+}
+
+// path returns the path of the entry of the specified name under dir.
+// Absolute names and names including ".." elements are rejected.
+func (e *extractor) path(name string) (string, error) {
+	name = filepath.FromSlash(strings.Replace(name, `\`, "/", -1))
+
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("absolute path in archive: %s", name)
+	}
+
+	p := filepath.Join(e.dir, name)
+	if !e.contains(p) {
+		return "", fmt.Errorf("path escapes the destination: %s", name)
+	}
+
+	return p, nil
+}
+
+// contains reports whether p is dir or under dir lexically.
+func (e *extractor) contains(p string) bool {
+	p = filepath.Clean(p)
+	return p == e.dir || strings.HasPrefix(p, e.dir+string(filepath.Separator))
+}
@@ -0,0 +1,160 @@
+package extracting
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestExtracting_extractor_writeFile(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	e := newTestExtractor(t, dir)
+
+	err := e.writeFile("a/b/c.txt", 0644, strings.NewReader("c"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a/b/c.txt"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if string(b) != "c" {
+		t.Errorf(`unexpected content: expected: "c" actual: "%s"`, b)
+	}
+}
+
+func TestExtracting_extractor_PathTraversal(t *testing.T) {
+	cases := map[string]struct {
+		name     string
+		expected string
+	}{
+		"parent":       {name: "../a.txt", expected: "path escapes the destination"},
+		"nested":       {name: "a/../../a.txt", expected: "path escapes the destination"},
+		"absolute":     {name: "/etc/passwd", expected: "absolute path in archive"},
+		"backslashes":  {name: `..\a.txt`, expected: "path escapes the destination"},
+		"through link": {name: "link/a.txt", expected: "path escapes the destination"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			outside, clean := createTempDir(t)
+			defer clean()
+
+			// A symlink which already exists in the destination must not be followed.
+			err := os.Symlink(outside, filepath.Join(dir, "link"))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			err = newTestExtractor(t, dir).writeFile(c.name, 0644, strings.NewReader(""))
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if !regexp.MustCompile(c.expected).MatchString(err.Error()) {
+				t.Errorf("unexpectedly not matched: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestExtracting_extractor_symlink(t *testing.T) {
+	cases := map[string]struct {
+		name     string
+		target   string
+		expected string
+	}{
+		"inside":   {name: "a/link", target: "../b", expected: ""},
+		"parent":   {name: "a/link", target: "../../b", expected: "symlink escapes the destination"},
+		"absolute": {name: "link", target: "/etc", expected: "symlink escapes the destination"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			err := newTestExtractor(t, dir).symlink(c.name, c.target)
+
+			if c.expected == "" {
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if !regexp.MustCompile(c.expected).MatchString(err.Error()) {
+				t.Errorf("unexpectedly not matched: %s", err.Error())
+			}
+		})
+	}
+}
+
+func TestExtracting_extractor_writeFile_ReplacesSymlink(t *testing.T) {
+	dir, clean := createTempDir(t)
+	defer clean()
+
+	e := newTestExtractor(t, dir)
+
+	err := e.writeFile("b", 0644, strings.NewReader("b"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	err = e.symlink("a", "b")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	err = e.writeFile("a", 0644, strings.NewReader("a"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if string(b) != "b" {
+		t.Errorf("the target of the symlink is unexpectedly overwritten")
+	}
+}
+
+func newTestExtractor(t *testing.T, dir string) *extractor {
+	t.Helper()
+
+	e, err := newExtractor(ioutil.Discard, dir)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return e
+}
+
+func createTempDir(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "parallel-download")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
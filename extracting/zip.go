@@ -0,0 +1,137 @@
+package extracting
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ListZip writes the size, the modification time and the name of each entry of the zip archive read from r.
+func ListZip(w io.Writer, r io.ReaderAt, size int64) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range zr.File {
+		fmt.Fprintf(w, "%12d  %s  %s\n", f.UncompressedSize64, f.Modified.Format("2006-01-02 15:04"), f.Name)
+	}
+
+	return nil
+}
+
+// ExtractZip extracts the entries of the zip archive read from r under dir in parallel.
+// If patterns are specified, only the entries whose names match any of them are extracted.
+// The patterns are interpreted by path.Match.
+func ExtractZip(ctx context.Context, w io.Writer, r io.ReaderAt, size int64, dir string, patterns []string, parallelism int) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+
+	var files []*zip.File
+	for _, f := range zr.File {
+		matched, err := matchAny(patterns, f.Name)
+		if err != nil {
+			return err
+		}
+		if matched {
+			files = append(files, f)
+		}
+	}
+
+	if len(files) == 0 {
+		return fmt.Errorf("no entries match: %q", patterns)
+	}
+
+	e, err := newExtractor(w, dir)
+	if err != nil {
+		return err
+	}
+
+	// Directories and symlinks are created in the order of the archive before the files are written in parallel.
+	var regularFiles []*zip.File
+	for _, f := range files {
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			err = e.mkdir(f.Name)
+		case mode&os.ModeSymlink != 0:
+			err = extractZipSymlink(e, f)
+		default:
+			regularFiles = append(regularFiles, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, f := range regularFiles {
+		f := f
+		eg.Go(func() error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case sem <- struct{}{}:
+			}
+			defer func() { <-sem }()
+
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			return e.writeFile(f.Name, f.Mode(), rc)
+		})
+	}
+
+	return eg.Wait()
+}
+
+// extractZipSymlink creates the symlink of f, whose content is the target.
+func extractZipSymlink(e *extractor, f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	target, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+
+	return e.symlink(f.Name, string(target))
+}
+
+// matchAny reports whether name matches any of patterns. It always reports true if no patterns are specified.
+func matchAny(patterns []string, name string) (bool, error) {
+	if len(patterns) == 0 {
+		return true, nil
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,137 @@
+package extracting
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtracting_ListZip(t *testing.T) {
+	r := newTestZip(t, map[string]string{"a.txt": "a", "b/c.txt": "cc"})
+
+	buf := &bytes.Buffer{}
+	err := ListZip(buf, r, r.Size())
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := "           1  2018-10-01 12:00  a.txt\n           2  2018-10-01 12:00  b/c.txt\n"
+	actual := buf.String()
+	if actual != expected {
+		t.Errorf(`unexpected listing: expected: "%s" actual: "%s"`, expected, actual)
+	}
+}
+
+func TestExtracting_ExtractZip(t *testing.T) {
+	cases := map[string]struct {
+		patterns []string
+		expected []string
+	}{
+		"all":      {patterns: nil, expected: []string{"a.txt", "b/c.txt", "b/d.bin"}},
+		"patterns": {patterns: []string{"b/*.txt", "a.txt"}, expected: []string{"a.txt", "b/c.txt"}},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			contents := map[string]string{"a.txt": "a", "b/c.txt": "cc", "b/d.bin": "ddd"}
+			r := newTestZip(t, contents)
+
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			err := ExtractZip(context.Background(), ioutil.Discard, r, r.Size(), dir, c.patterns, 2)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			var actual []string
+			filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+				if !info.IsDir() {
+					rel, _ := filepath.Rel(dir, p)
+					actual = append(actual, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+
+			if strings.Join(actual, ",") != strings.Join(c.expected, ",") {
+				t.Fatalf("unexpected files: expected: %q actual: %q", c.expected, actual)
+			}
+
+			for _, name := range actual {
+				b, err := ioutil.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatalf("err %s", err)
+				}
+				if string(b) != contents[name] {
+					t.Errorf("unexpected content of %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestExtracting_ExtractZip_Error(t *testing.T) {
+	cases := map[string]struct {
+		contents map[string]string
+		patterns []string
+		expected string
+	}{
+		"no match":       {contents: map[string]string{"a.txt": "a"}, patterns: []string{"b.txt"}, expected: "no entries match"},
+		"bad pattern":    {contents: map[string]string{"a.txt": "a"}, patterns: []string{"["}, expected: "syntax error in pattern"},
+		"path traversal": {contents: map[string]string{"../a.txt": "a"}, patterns: nil, expected: "path escapes the destination"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			r := newTestZip(t, c.contents)
+
+			dir, clean := createTempDir(t)
+			defer clean()
+
+			err := ExtractZip(context.Background(), ioutil.Discard, r, r.Size(), dir, c.patterns, 2)
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if !regexp.MustCompile(c.expected).MatchString(err.Error()) {
+				t.Errorf("unexpectedly not matched: %s", err.Error())
+			}
+		})
+	}
+}
+
+// newTestZip returns the zip archive which has the entries of contents in the order of their names.
+func newTestZip(t *testing.T, contents map[string]string) *bytes.Reader {
+	t.Helper()
+
+	var names []string
+	for name := range contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)})
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		w.Write([]byte(contents[name]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return bytes.NewReader(buf.Bytes())
+}
@@ -1,8 +1,12 @@
 module github.com/hioki-daichi/parallel-download
 
-go 1.12
+go 1.18
 
 require (
-	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f
+	github.com/klauspost/compress v1.9.8
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/net v0.21.0
+	golang.org/x/sync v0.1.0
 )
+
+require golang.org/x/text v0.14.0 // indirect
@@ -2,32 +2,466 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
 
+	"github.com/hioki-daichi/parallel-download/crawling"
+	"github.com/hioki-daichi/parallel-download/daemon"
 	"github.com/hioki-daichi/parallel-download/downloading"
+	"github.com/hioki-daichi/parallel-download/extracting"
+	"github.com/hioki-daichi/parallel-download/metalink"
 	"github.com/hioki-daichi/parallel-download/opt"
 	"github.com/hioki-daichi/parallel-download/termination"
+	"golang.org/x/sync/errgroup"
 )
 
 func main() {
-	err := execute(os.Stdout, os.Args[1:])
+	err := execute(os.Stdout, os.Stderr, os.Args[1:])
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func execute(w io.Writer, args []string) error {
-	ctx := context.Background()
+func execute(w io.Writer, errW io.Writer, args []string) error {
+	if len(args) > 0 && args[0] == "zip" {
+		return executeZip(w, errW, args[1:])
+	}
 
-	ctx, clean := termination.Listen(ctx, w)
-	defer clean()
+	if len(args) > 0 && args[0] == "mirror" {
+		return executeMirror(w, args[1:])
+	}
+
+	if len(args) > 0 && args[0] == "daemon" {
+		return executeDaemon(w, args[1:])
+	}
+
+	if len(args) > 0 && clientCommands[args[0]] {
+		return executeClient(w, args[0], args[1:])
+	}
 
 	opts, err := opt.Parse(args...)
 	if err != nil {
 		return err
 	}
 
+	// The downloaded file occupies w, so the progress is written to errW.
+	if opts.Output == "-" {
+		ctx, clean := termination.Listen(context.Background(), errW)
+		defer clean()
+
+		err := serveMetrics(ctx, errW, opts)
+		if err != nil {
+			return err
+		}
+
+		return downloading.NewDownloader(errW, opts).Stream(ctx, w)
+	}
+
+	ctx, clean := termination.Listen(context.Background(), w)
+	defer clean()
+
+	err = serveMetrics(ctx, w, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range opts.URLs {
+		o := *opts
+		o.URL = u
+
+		err := download(ctx, w, &o)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, location := range opts.Metalinks {
+		err := downloadMetalink(ctx, w, opts, location)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// download saves or extracts the download according to opts.
+func download(ctx context.Context, w io.Writer, opts *opt.Options) error {
+	if downloading.IsMedia(opts.URL) {
+		return downloading.NewDownloader(w, opts).DownloadMedia(ctx)
+	}
+	if opts.Extract != "" {
+		return extract(ctx, w, opts)
+	}
 	return downloading.NewDownloader(w, opts).Download(ctx)
 }
+
+// downloadMetalink downloads the files described in the metalink at location.
+// The URLs of each file are used as mirrors in order of priority, and the size and the hashes are verified.
+// The names with directories are saved in the subdirectories of the directory to save, which are created.
+func downloadMetalink(ctx context.Context, w io.Writer, opts *opt.Options, location string) error {
+	fmt.Fprintf(w, "load metalink: %q\n", location)
+
+	m, err := metalink.Load(ctx, downloading.NewHTTPClient(opts), location)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range m.Files {
+		o := *opts
+
+		var urls []*url.URL
+		for _, mu := range f.URLs {
+			u, err := url.ParseRequestURI(mu.Value)
+			if err != nil || !downloading.IsSupported(u) {
+				fmt.Fprintf(w, "skip unsupported URL: %q\n", mu.Value)
+				continue
+			}
+			fmt.Fprintf(w, "source: %s (location: %q, priority: %d)\n", u, mu.Location, mu.Priority)
+			urls = append(urls, u)
+		}
+
+		if len(urls) == 0 {
+			return fmt.Errorf("%s: no supported URL", f.Name)
+		}
+
+		// The sources beyond the parallelism are the fallbacks of the failed ones.
+		o.URL = urls[0]
+		o.Mirrors = urls[1:]
+		o.Size = f.Size
+
+		if o.OutputTemplate == "" {
+			output, err := downloading.JoinInDir(o.Dir, f.Name)
+			if err != nil {
+				return err
+			}
+
+			err = os.MkdirAll(filepath.Dir(output), 0755)
+			if err != nil {
+				return err
+			}
+
+			o.Output = filepath.FromSlash(f.Name)
+		}
+
+		if h := f.Hash(); h != nil {
+			o.Checksum = &opt.Checksum{Type: h.Type, Value: h.Value}
+		}
+
+		if f.Pieces != nil {
+			o.Pieces = &opt.Pieces{Type: f.Pieces.Type, Length: int(f.Pieces.Length), Hashes: f.Pieces.Hashes}
+		}
+
+		err := download(ctx, w, &o)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extract streams the download into extracting.Extract without saving the file.
+func extract(ctx context.Context, w io.Writer, opts *opt.Options) error {
+	name := opts.Output
+	if name == "" {
+		name = path.Base(opts.URL.Path)
+	}
+
+	pr, pw := io.Pipe()
+
+	errCh := make(chan error, 1)
+	go func() {
+		err := downloading.NewDownloader(w, opts).Stream(ctx, pw)
+		pw.CloseWithError(err)
+		errCh <- err
+	}()
+
+	err := extracting.Extract(ctx, w, pr, name, opts.Extract)
+	if err == nil {
+		// Consume the rest such as the padding after the end of a tar archive so that the download completes.
+		_, err = io.Copy(ioutil.Discard, pr)
+	}
+	if err != nil {
+		pr.CloseWithError(err)
+		<-errCh
+		return err
+	}
+
+	return <-errCh
+}
+
+// executeZip lists or extracts the entries of the remote zip archive.
+// Only the byte ranges of the central directory and the entries to be extracted are requested.
+func executeZip(w io.Writer, errW io.Writer, args []string) error {
+	opts, err := opt.ParseZip(args...)
+	if err != nil {
+		return err
+	}
+
+	ctx, clean := termination.Listen(context.Background(), errW)
+	defer clean()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	// The listing occupies w, so the progress of requests is written to errW.
+	f, err := downloading.NewDownloader(errW, &opts.Options).Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if opts.List {
+		return extracting.ListZip(w, f, f.Size())
+	}
+
+	return extracting.ExtractZip(ctx, w, f, f.Size(), opts.Dir, opts.Entries, opts.Parallelism)
+}
+
+// executeMirror downloads the files linked from the HTML directory listing recursively, preserving the directory structure.
+// The files are downloaded at the same time up to the number of jobs, and each of them is downloaded in parallel ranges.
+func executeMirror(w io.Writer, args []string) error {
+	opts, err := opt.ParseMirror(args...)
+	if err != nil {
+		return err
+	}
+
+	ctx, clean := termination.Listen(context.Background(), w)
+	defer clean()
+
+	err = serveMetrics(ctx, w, &opts.Options)
+	if err != nil {
+		return err
+	}
+
+	crawlCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	files, err := crawling.NewCrawler(w, downloading.NewHTTPClient(&opts.Options), opts.Includes, opts.Excludes, opts.Depth).Crawl(crawlCtx, opts.URL)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "found %d files\n", len(files))
+
+	eg, ctx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, opts.Jobs)
+
+	for _, f := range files {
+		o := opts.Options
+		o.URL = f.URL
+		o.URLs = []*url.URL{f.URL}
+		o.Output = filepath.FromSlash(f.Path)
+
+		select {
+		case <-ctx.Done():
+			return eg.Wait()
+		case sem <- struct{}{}:
+		}
+
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			return downloading.NewDownloader(w, &o).Download(ctx)
+		})
+	}
+
+	return eg.Wait()
+}
+
+// executeDaemon runs the queue of downloads, and serves the JSON API to control it until terminated.
+// The JSON-RPC interface of aria2 is also served if its address is specified.
+func executeDaemon(w io.Writer, args []string) error {
+	opts, err := opt.ParseDaemon(args...)
+	if err != nil {
+		return err
+	}
+
+	q, err := daemon.NewQueue(w, opts)
+	if err != nil {
+		return err
+	}
+
+	l, err := daemon.Listen(opts.Listen)
+	if err != nil {
+		return err
+	}
+
+	var rpcListener net.Listener
+	if opts.RPCListen != "" {
+		rpcListener, err = daemon.Listen(opts.RPCListen)
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	ctx, clean := termination.Listen(context.Background(), w)
+	defer clean()
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	serveFn, err := listenMetrics(ctx, w, &opts.Options)
+	if err != nil {
+		l.Close()
+		if rpcListener != nil {
+			rpcListener.Close()
+		}
+		return err
+	}
+	if serveFn != nil {
+		eg.Go(serveFn)
+	}
+
+	eg.Go(func() error {
+		return q.Run(ctx)
+	})
+
+	fmt.Fprintf(w, "listen: %s\n", opts.Listen)
+	eg.Go(func() error {
+		return serve(ctx, l, daemon.NewHandler(q, opts.Secret))
+	})
+
+	if rpcListener != nil {
+		fmt.Fprintf(w, "listen JSON-RPC: %s\n", opts.RPCListen)
+		eg.Go(func() error {
+			return serve(ctx, rpcListener, daemon.NewRPCHandler(q, opts.RPCSecret))
+		})
+	}
+
+	return eg.Wait()
+}
+
+// serve serves h on l until ctx is done.
+func serve(ctx context.Context, l net.Listener, h http.Handler) error {
+	srv := &http.Server{Handler: h}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	err := srv.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// serveMetrics serves the metrics of the downloads at /metrics on the address of opts in the background until ctx is done,
+// unless it is empty. The error of the server is only reported, since the downloads do not depend on it.
+func serveMetrics(ctx context.Context, w io.Writer, opts *opt.Options) error {
+	serveFn, err := listenMetrics(ctx, w, opts)
+	if err != nil || serveFn == nil {
+		return err
+	}
+
+	go func() {
+		err := serveFn()
+		if err != nil {
+			fmt.Fprintf(w, "failed to serve metrics: %s\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// listenMetrics listens on the address of the metrics of opts,
+// and returns the function which serves them at /metrics until ctx is done, or nil if the address is empty.
+func listenMetrics(ctx context.Context, w io.Writer, opts *opt.Options) (func() error, error) {
+	if opts.MetricsAddr == "" {
+		return nil, nil
+	}
+
+	l, err := net.Listen("tcp", opts.MetricsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", opts.Metrics)
+
+	fmt.Fprintf(w, "listen metrics: %s\n", l.Addr())
+
+	return func() error { return serve(ctx, l, mux) }, nil
+}
+
+// clientCommands are the subcommands which control the daemon.
+var clientCommands = map[string]bool{"add": true, "ls": true, "pause": true, "resume": true, "rm": true}
+
+// executeClient controls the daemon by the subcommand of the specified name.
+func executeClient(w io.Writer, name string, args []string) error {
+	opts, err := opt.ParseClient(name, args...)
+	if err != nil {
+		return err
+	}
+
+	c := daemon.NewClient(opts.Daemon, opts.Secret)
+	ctx := context.Background()
+
+	if name == "add" {
+		for _, rawurl := range opts.Args {
+			j, err := c.Add(ctx, &daemon.Job{URL: rawurl, Output: opts.Output, Dir: opts.Dir, Parallelism: opts.Parallelism, Priority: opts.Priority})
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "added: %d: %s\n", j.ID, j.URL)
+		}
+		return nil
+	}
+
+	if name == "ls" {
+		jobs, err := c.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPRIORITY\tSTATE\tPROGRESS\tURL\tERROR")
+		for _, j := range jobs {
+			progress := "-"
+			if j.Length > 0 {
+				progress = fmt.Sprintf("%d%%", j.Received*100/j.Length)
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\n", j.ID, j.Priority, j.State, progress, j.URL, j.Error)
+		}
+		return tw.Flush()
+	}
+
+	for _, arg := range opts.Args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid ID: %q", arg)
+		}
+
+		var done string
+		switch name {
+		case "pause":
+			_, err = c.Pause(ctx, id)
+			done = "paused"
+		case "resume":
+			_, err = c.Resume(ctx, id)
+			done = "resumed"
+		case "rm":
+			err = c.Remove(ctx, id)
+			done = "removed"
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s: %d\n", done, id)
+	}
+
+	return nil
+}
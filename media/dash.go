@@ -0,0 +1,476 @@
+package media
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	errDynamicMPD  = errors.New("dynamic MPD of a live stream is not supported")
+	errNoPeriods   = errors.New("MPD has no period")
+	errPeriodStart = errors.New("period starts after the next one or the end of the presentation")
+)
+
+type mpd struct {
+	Type                      string    `xml:"type,attr"`
+	MediaPresentationDuration string    `xml:"mediaPresentationDuration,attr"`
+	BaseURL                   string    `xml:"BaseURL"`
+	Periods                   []*period `xml:"Period"`
+}
+
+type period struct {
+	Start          string           `xml:"start,attr"`
+	Duration       string           `xml:"duration,attr"`
+	BaseURL        string           `xml:"BaseURL"`
+	AdaptationSets []*adaptationSet `xml:"AdaptationSet"`
+}
+
+type adaptationSet struct {
+	MimeType        string            `xml:"mimeType,attr"`
+	ContentType     string            `xml:"contentType,attr"`
+	BaseURL         string            `xml:"BaseURL"`
+	SegmentTemplate *segmentTemplate  `xml:"SegmentTemplate"`
+	SegmentList     *segmentList      `xml:"SegmentList"`
+	Representations []*representation `xml:"Representation"`
+}
+
+type representation struct {
+	ID              string           `xml:"id,attr"`
+	Bandwidth       int              `xml:"bandwidth,attr"`
+	Width           int              `xml:"width,attr"`
+	Height          int              `xml:"height,attr"`
+	MimeType        string           `xml:"mimeType,attr"`
+	BaseURL         string           `xml:"BaseURL"`
+	SegmentTemplate *segmentTemplate `xml:"SegmentTemplate"`
+	SegmentList     *segmentList     `xml:"SegmentList"`
+}
+
+type segmentTemplate struct {
+	Media          string           `xml:"media,attr"`
+	Initialization string           `xml:"initialization,attr"`
+	StartNumber    *int64           `xml:"startNumber,attr"`
+	Timescale      int64            `xml:"timescale,attr"`
+	Duration       int64            `xml:"duration,attr"`
+	Timeline       *segmentTimeline `xml:"SegmentTimeline"`
+}
+
+type segmentTimeline struct {
+	S []struct {
+		T *int64 `xml:"t,attr"`
+		D int64  `xml:"d,attr"`
+		R int64  `xml:"r,attr"`
+	} `xml:"S"`
+}
+
+type segmentList struct {
+	Initialization *struct {
+		SourceURL string `xml:"sourceURL,attr"`
+		Range     string `xml:"range,attr"`
+	} `xml:"Initialization"`
+	SegmentURLs []struct {
+		Media      string `xml:"media,attr"`
+		MediaRange string `xml:"mediaRange,attr"`
+	} `xml:"SegmentURL"`
+}
+
+// ParseDASH parses the static DASH manifest read from r, whose URLs are resolved against base.
+//
+// The representations of the first video adaptation set, or of the first adaptation set if there is no video,
+// result in Variants with their segments. The segments of the same representation in the following periods are appended.
+// The other adaptation sets of the first period, such as audio, are not downloaded, and their content types result in Skipped.
+// Segments are described by SegmentTemplate with or without SegmentTimeline, by SegmentList,
+// or by BaseURL alone for a representation in a single file.
+func ParseDASH(base *url.URL, r io.Reader) (*Playlist, error) {
+	m := &mpd{}
+	err := xml.NewDecoder(r).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Type == "dynamic" {
+		return nil, errDynamicMPD
+	}
+
+	if len(m.Periods) == 0 {
+		return nil, errNoPeriods
+	}
+
+	base, err = resolveBaseURL(base, m.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	durations, err := periodDurations(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []*Variant
+
+	for i, p := range m.Periods {
+		seconds := durations[i]
+
+		periodBase, err := resolveBaseURL(base, p.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		as := selectAdaptationSet(p.AdaptationSets)
+		if as == nil {
+			return nil, fmt.Errorf("period %d has no adaptation set", i)
+		}
+
+		asBase, err := resolveBaseURL(periodBase, as.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+
+		for j, rep := range as.Representations {
+			segments, err := rep.segments(asBase, as, seconds)
+			if err != nil {
+				return nil, fmt.Errorf("representation %q: %s", rep.ID, err)
+			}
+
+			if i == 0 {
+				variants = append(variants, &Variant{Bandwidth: rep.Bandwidth, Width: rep.Width, Height: rep.Height, Segments: segments})
+				continue
+			}
+
+			v := findVariant(variants, m.Periods[0], rep.ID, j)
+			if v == nil {
+				return nil, fmt.Errorf("period %d: representation %q is not in the first period", i, rep.ID)
+			}
+			v.Segments = append(v.Segments, segments...)
+		}
+	}
+
+	var skipped []string
+	selected := selectAdaptationSet(m.Periods[0].AdaptationSets)
+	for _, as := range m.Periods[0].AdaptationSets {
+		if as != selected {
+			skipped = append(skipped, as.contentType())
+		}
+	}
+
+	return &Playlist{Variants: variants, Skipped: skipped}, nil
+}
+
+// periodDurations returns the duration of each period of m in seconds, which is Period@duration,
+// or else the time until Period@start of the next period, or until the end of the presentation for the last period.
+// A period without Period@start starts at the end of the previous one, or at 0 if it is the first.
+// The duration which cannot be determined is 0, as that of a manifest without mediaPresentationDuration is,
+// since it only matters to SegmentTemplate@duration.
+func periodDurations(m *mpd) ([]float64, error) {
+	n := len(m.Periods)
+	starts := make([]float64, n)
+	durations := make([]float64, n)
+	hasStarts := make([]bool, n)
+	hasDurations := make([]bool, n)
+
+	for i, p := range m.Periods {
+		var err error
+		if p.Start != "" {
+			starts[i], err = parseDuration(p.Start)
+			if err != nil {
+				return nil, err
+			}
+			hasStarts[i] = true
+		}
+		if p.Duration != "" {
+			durations[i], err = parseDuration(p.Duration)
+			if err != nil {
+				return nil, err
+			}
+			hasDurations[i] = true
+		}
+	}
+
+	for i := range starts {
+		if hasStarts[i] {
+			continue
+		}
+		if i == 0 {
+			hasStarts[i] = true
+		} else if hasStarts[i-1] && hasDurations[i-1] {
+			starts[i] = starts[i-1] + durations[i-1]
+			hasStarts[i] = true
+		}
+	}
+
+	total, err := parseDuration(m.MediaPresentationDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range durations {
+		if hasDurations[i] {
+			continue
+		}
+		switch {
+		case !hasStarts[i]:
+			continue
+		case i+1 < n && hasStarts[i+1]:
+			durations[i] = starts[i+1] - starts[i]
+		case i+1 == n && m.MediaPresentationDuration != "":
+			durations[i] = total - starts[i]
+		}
+		if durations[i] < 0 {
+			return nil, fmt.Errorf("period %d: %s", i, errPeriodStart)
+		}
+	}
+
+	return durations, nil
+}
+
+// contentType returns the content type of as such as "video" and "audio", or its MIME type if it has no content type.
+func (as *adaptationSet) contentType() string {
+	if as.ContentType != "" {
+		return as.ContentType
+	}
+
+	mimeType := as.MimeType
+	if mimeType == "" && len(as.Representations) > 0 {
+		mimeType = as.Representations[0].MimeType
+	}
+
+	return strings.SplitN(mimeType, "/", 2)[0]
+}
+
+// selectAdaptationSet returns the first video adaptation set, or the first one if there is no video.
+func selectAdaptationSet(sets []*adaptationSet) *adaptationSet {
+	for _, as := range sets {
+		if as.contentType() == "video" {
+			return as
+		}
+	}
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	return sets[0]
+}
+
+// findVariant returns the variant of the representation of id in the first period,
+// or of the same index if the representations have no id.
+func findVariant(variants []*Variant, first *period, id string, index int) *Variant {
+	as := selectAdaptationSet(first.AdaptationSets)
+
+	for k, rep := range as.Representations {
+		if (id != "" && rep.ID == id) || (id == "" && k == index) {
+			return variants[k]
+		}
+	}
+
+	return nil
+}
+
+// segments returns the segments of rep, inheriting SegmentTemplate and SegmentList from as.
+// seconds is the duration of the period, which determines the number of segments of SegmentTemplate@duration.
+func (rep *representation) segments(base *url.URL, as *adaptationSet, seconds float64) ([]*Segment, error) {
+	base, err := resolveBaseURL(base, rep.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := rep.SegmentTemplate
+	if tmpl == nil {
+		tmpl = as.SegmentTemplate
+	}
+	if tmpl != nil {
+		return rep.templateSegments(base, tmpl, seconds)
+	}
+
+	list := rep.SegmentList
+	if list == nil {
+		list = as.SegmentList
+	}
+	if list != nil {
+		return listSegments(base, list)
+	}
+
+	return []*Segment{{URL: base}}, nil
+}
+
+// templateSegments returns the segments described by SegmentTemplate.
+func (rep *representation) templateSegments(base *url.URL, tmpl *segmentTemplate, seconds float64) ([]*Segment, error) {
+	var segments []*Segment
+
+	add := func(s string, number int64, time int64) error {
+		u, err := base.Parse(rep.expandTemplate(s, number, time))
+		if err != nil {
+			return err
+		}
+		segments = append(segments, &Segment{URL: u})
+		return nil
+	}
+
+	if tmpl.Initialization != "" {
+		err := add(tmpl.Initialization, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	number := int64(1)
+	if tmpl.StartNumber != nil {
+		number = *tmpl.StartNumber
+	}
+
+	if tmpl.Timeline != nil {
+		var t int64
+		for _, s := range tmpl.Timeline.S {
+			if s.T != nil {
+				t = *s.T
+			}
+			// A negative repeat count to the end of the period is not supported in static MPDs.
+			for r := int64(0); r <= s.R; r++ {
+				err := add(tmpl.Media, number, t)
+				if err != nil {
+					return nil, err
+				}
+				number++
+				t += s.D
+			}
+		}
+		return segments, nil
+	}
+
+	if tmpl.Duration <= 0 {
+		return nil, errors.New("SegmentTemplate has neither SegmentTimeline nor duration")
+	}
+
+	timescale := tmpl.Timescale
+	if timescale <= 0 {
+		timescale = 1
+	}
+
+	count := int64(math.Ceil(seconds * float64(timescale) / float64(tmpl.Duration)))
+	if count < 1 {
+		return nil, errors.New("the number of segments is unknown without the duration of the period")
+	}
+
+	for k := int64(0); k < count; k++ {
+		err := add(tmpl.Media, number+k, k*tmpl.Duration)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return segments, nil
+}
+
+// templateIdentifier matches the identifiers of SegmentTemplate such as $Number%05d$.
+var templateIdentifier = regexp.MustCompile(`\$(RepresentationID|Number|Bandwidth|Time)(%0\d+d)?\$|\$\$`)
+
+// expandTemplate substitutes the identifiers of SegmentTemplate in s.
+func (rep *representation) expandTemplate(s string, number int64, time int64) string {
+	return templateIdentifier.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+
+		sub := templateIdentifier.FindStringSubmatch(match)
+
+		format := "%d"
+		if sub[2] != "" {
+			format = sub[2]
+		}
+
+		switch sub[1] {
+		case "RepresentationID":
+			return rep.ID
+		case "Number":
+			return fmt.Sprintf(format, number)
+		case "Bandwidth":
+			return fmt.Sprintf(format, rep.Bandwidth)
+		default:
+			return fmt.Sprintf(format, time)
+		}
+	})
+}
+
+// listSegments returns the segments described by SegmentList.
+func listSegments(base *url.URL, list *segmentList) ([]*Segment, error) {
+	var segments []*Segment
+
+	add := func(media string, mediaRange string) error {
+		u := base
+		if media != "" {
+			var err error
+			u, err = base.Parse(media)
+			if err != nil {
+				return err
+			}
+		}
+
+		s := &Segment{URL: u}
+		if mediaRange != "" {
+			s.Range = "bytes=" + mediaRange
+		}
+
+		segments = append(segments, s)
+		return nil
+	}
+
+	if list.Initialization != nil {
+		err := add(list.Initialization.SourceURL, list.Initialization.Range)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, su := range list.SegmentURLs {
+		err := add(su.Media, su.MediaRange)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return segments, nil
+}
+
+// resolveBaseURL resolves the BaseURL element against base.
+func resolveBaseURL(base *url.URL, baseURL string) (*url.URL, error) {
+	baseURL = strings.TrimSpace(baseURL)
+	if baseURL == "" {
+		return base, nil
+	}
+	return base.Parse(baseURL)
+}
+
+// isoDuration matches the duration of ISO 8601 such as PT1H2M3.5S, except years and months.
+var isoDuration = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseDuration parses the duration of ISO 8601 and returns it in seconds. An empty duration results in 0.
+func parseDuration(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	sub := isoDuration.FindStringSubmatch(strings.TrimSpace(s))
+	if sub == nil {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+
+	var seconds float64
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if sub[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(sub[i+1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		seconds += v * unit
+	}
+
+	return seconds, nil
+}
@@ -0,0 +1,174 @@
+package media
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMedia_ParseDASH_Template(t *testing.T) {
+	p := parseFile(t, "template.mpd", "http://example.com/vod/manifest.mpd", ParseDASH)
+
+	if len(p.Variants) != 2 {
+		t.Fatalf("unexpected number of variants: expected: %d actual: %d", 2, len(p.Variants))
+	}
+
+	if !reflect.DeepEqual(p.Skipped, []string{"audio"}) {
+		t.Errorf("unexpected skipped adaptation sets: expected: %q actual: %q", []string{"audio"}, p.Skipped)
+	}
+
+	cases := map[string]struct {
+		variant    *Variant
+		resolution string
+		expected   []string
+	}{
+		"duration": {
+			variant:    p.Variants[0],
+			resolution: "640x360",
+			expected: []string{
+				"http://example.com/vod/video/low/init.mp4",
+				"http://example.com/vod/video/low/seg-000.m4s",
+				"http://example.com/vod/video/low/seg-001.m4s",
+				"http://example.com/vod/video/low/seg-002.m4s",
+			},
+		},
+		"timeline": {
+			variant:    p.Variants[1],
+			resolution: "1280x720",
+			expected: []string{
+				"http://example.com/vod/video/high/init.mp4",
+				"http://example.com/vod/video/high/0.m4s",
+				"http://example.com/vod/video/high/180000.m4s",
+				"http://example.com/vod/video/high/360000.m4s",
+			},
+		},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			if c.variant.Resolution() != c.resolution {
+				t.Errorf("unexpected resolution: expected: %s actual: %s", c.resolution, c.variant.Resolution())
+			}
+
+			actual := describeSegments(c.variant.Segments)
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("unexpected segments: expected: %q actual: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMedia_ParseDASH_List(t *testing.T) {
+	p := parseFile(t, "list.mpd", "http://example.com/vod/manifest.mpd", ParseDASH)
+
+	if len(p.Variants) != 1 {
+		t.Fatalf("unexpected number of variants: expected: %d actual: %d", 1, len(p.Variants))
+	}
+
+	expected := []string{
+		"http://cdn.example.com/media/video.mp4 bytes=0-99",
+		"http://cdn.example.com/media/video.mp4 bytes=100-599",
+		"http://cdn.example.com/media/video.mp4 bytes=600-999",
+		"http://cdn.example.com/media/part2.mp4",
+	}
+
+	actual := describeSegments(p.Variants[0].Segments)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected segments: expected: %q actual: %q", expected, actual)
+	}
+}
+
+func TestMedia_ParseDASH_Periods(t *testing.T) {
+	p := parseFile(t, "periods.mpd", "http://example.com/vod/manifest.mpd", ParseDASH)
+
+	if len(p.Variants) != 1 {
+		t.Fatalf("unexpected number of variants: expected: %d actual: %d", 1, len(p.Variants))
+	}
+
+	// The first period lasts until the second one starts at 6s, and the second one until the end at 10s.
+	expected := []string{
+		"http://example.com/vod/main/init.mp4",
+		"http://example.com/vod/main/0.m4s",
+		"http://example.com/vod/main/1.m4s",
+		"http://example.com/vod/main/2.m4s",
+		"http://example.com/vod/credits/init.mp4",
+		"http://example.com/vod/credits/0.m4s",
+		"http://example.com/vod/credits/1.m4s",
+	}
+
+	actual := describeSegments(p.Variants[0].Segments)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected segments: expected: %q actual: %q", expected, actual)
+	}
+}
+
+func TestMedia_periodDurations(t *testing.T) {
+	cases := map[string]struct {
+		total    string
+		periods  []*period
+		expected []float64
+		err      error
+	}{
+		"single":           {total: "PT10S", periods: []*period{{}}, expected: []float64{10}},
+		"duration":         {total: "PT10S", periods: []*period{{Duration: "PT4S"}, {}}, expected: []float64{4, 6}},
+		"next start":       {total: "PT10S", periods: []*period{{}, {Start: "PT6S"}}, expected: []float64{6, 4}},
+		"starts":           {total: "PT10S", periods: []*period{{Start: "PT0S"}, {Start: "PT3S"}, {Start: "PT7S"}}, expected: []float64{3, 4, 3}},
+		"no total":         {periods: []*period{{}, {Start: "PT6S"}}, expected: []float64{6, 0}},
+		"start after next": {total: "PT10S", periods: []*period{{Start: "PT6S"}, {Start: "PT3S"}}, err: errPeriodStart},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			actual, err := periodDurations(&mpd{MediaPresentationDuration: c.total, Periods: c.periods})
+			if c.err != nil {
+				if err == nil || !strings.HasSuffix(err.Error(), c.err.Error()) {
+					t.Errorf("unexpected error: expected: %v actual: %v", c.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("unexpected durations: expected: %v actual: %v", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMedia_ParseDASH_Dynamic(t *testing.T) {
+	base, _ := url.Parse("http://example.com/live/manifest.mpd")
+
+	_, err := ParseDASH(base, strings.NewReader(`<MPD type="dynamic"><Period/></MPD>`))
+	if err != errDynamicMPD {
+		t.Errorf("unexpected error: expected: %v actual: %v", errDynamicMPD, err)
+	}
+}
+
+func TestMedia_parseDuration(t *testing.T) {
+	cases := map[string]float64{
+		"PT9.5S":   9.5,
+		"PT1H2M3S": 3723,
+		"P1DT1M":   86460,
+		"PT0S":     0,
+		"":         0,
+	}
+
+	for s, expected := range cases {
+		actual, err := parseDuration(s)
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		if actual != expected {
+			t.Errorf("unexpected duration of %q: expected: %f actual: %f", s, expected, actual)
+		}
+	}
+
+	_, err := parseDuration("P1Y")
+	if err == nil {
+		t.Errorf("unexpectedly no error for P1Y")
+	}
+}
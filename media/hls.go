@@ -0,0 +1,258 @@
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var errNotM3U8 = errors.New("not an M3U8 playlist: #EXTM3U is missing")
+
+// ParseHLS parses the HLS playlist read from r, whose URIs are resolved against base.
+// A master playlist results in Variants, and a media playlist results in Segments.
+func ParseHLS(base *url.URL, r io.Reader) (*Playlist, error) {
+	sc := bufio.NewScanner(r)
+
+	if !sc.Scan() || strings.TrimSpace(sc.Text()) != "#EXTM3U" {
+		return nil, errNotM3U8
+	}
+
+	p := &Playlist{}
+
+	var (
+		sequence   int64
+		key        *hlsKey
+		rangeValue string
+		nextOffset = map[string]int64{}
+		variant    *Variant
+	)
+
+	for lineNo := 2; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+
+		tag, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			tag, value = line[:i], line[i+1:]
+		}
+
+		var err error
+
+		switch {
+		case tag == "#EXT-X-STREAM-INF":
+			variant, err = parseStreamInf(value)
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			sequence, err = strconv.ParseInt(value, 10, 64)
+		case tag == "#EXT-X-KEY":
+			key, err = parseKey(base, value)
+		case tag == "#EXT-X-BYTERANGE":
+			rangeValue = value
+		case tag == "#EXT-X-MAP":
+			var s *Segment
+			s, err = parseMap(base, value, nextOffset)
+			if err == nil {
+				p.Segments = append(p.Segments, s)
+			}
+		case strings.HasPrefix(line, "#"):
+			// Comments and the tags which do not affect the segments to download.
+		default:
+			var u *url.URL
+			u, err = base.Parse(line)
+			if err != nil {
+				break
+			}
+
+			if variant != nil {
+				variant.URL = u
+				p.Variants = append(p.Variants, variant)
+				variant = nil
+				break
+			}
+
+			s := &Segment{URL: u}
+
+			if rangeValue != "" {
+				s.Range, err = parseByteRange(rangeValue, u, nextOffset)
+				rangeValue = ""
+				if err != nil {
+					break
+				}
+			}
+
+			if key != nil {
+				s.Key = key.forSequence(sequence)
+			}
+
+			p.Segments = append(p.Segments, s)
+			sequence++
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// hlsKey is the key specified by #EXT-X-KEY.
+type hlsKey struct {
+	url *url.URL
+	iv  []byte
+}
+
+// forSequence returns the key of the segment of the media sequence number.
+// Without the IV attribute, the sequence number is used as the IV.
+func (k *hlsKey) forSequence(sequence int64) *Key {
+	iv := k.iv
+	if iv == nil {
+		iv = make([]byte, 16)
+		binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	}
+	return &Key{URL: k.url, IV: iv}
+}
+
+// parseKey parses the attributes of #EXT-X-KEY. METHOD=NONE results in nil.
+func parseKey(base *url.URL, value string) (*hlsKey, error) {
+	attrs := parseAttributes(value)
+
+	switch attrs["METHOD"] {
+	case "NONE":
+		return nil, nil
+	case "AES-128":
+	default:
+		return nil, fmt.Errorf("unsupported encryption method: %q", attrs["METHOD"])
+	}
+
+	u, err := base.Parse(attrs["URI"])
+	if err != nil {
+		return nil, err
+	}
+
+	k := &hlsKey{url: u}
+
+	if iv, ok := attrs["IV"]; ok {
+		iv = strings.TrimPrefix(strings.TrimPrefix(iv, "0x"), "0X")
+		k.iv, err = hex.DecodeString(iv)
+		if err != nil || len(k.iv) != 16 {
+			return nil, fmt.Errorf("invalid IV: %q", attrs["IV"])
+		}
+	}
+
+	return k, nil
+}
+
+// parseStreamInf parses the attributes of #EXT-X-STREAM-INF.
+func parseStreamInf(value string) (*Variant, error) {
+	attrs := parseAttributes(value)
+
+	v := &Variant{}
+
+	var err error
+	v.Bandwidth, err = strconv.Atoi(attrs["BANDWIDTH"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid BANDWIDTH: %q", attrs["BANDWIDTH"])
+	}
+
+	if resolution, ok := attrs["RESOLUTION"]; ok {
+		_, err = fmt.Sscanf(resolution, "%dx%d", &v.Width, &v.Height)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESOLUTION: %q", resolution)
+		}
+	}
+
+	return v, nil
+}
+
+// parseMap parses the attributes of #EXT-X-MAP, which specifies the initialization section.
+func parseMap(base *url.URL, value string, nextOffset map[string]int64) (*Segment, error) {
+	attrs := parseAttributes(value)
+
+	u, err := base.Parse(attrs["URI"])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Segment{URL: u}
+
+	if rangeValue, ok := attrs["BYTERANGE"]; ok {
+		s.Range, err = parseByteRange(rangeValue, u, nextOffset)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// parseByteRange parses <n>[@<o>] of #EXT-X-BYTERANGE and returns the value of Range header.
+// Without the offset, the range follows the previous range of the same URI, or starts at 0 if there is none.
+func parseByteRange(value string, u *url.URL, nextOffset map[string]int64) (string, error) {
+	lengthStr, offsetStr := value, ""
+	if i := strings.Index(value, "@"); i >= 0 {
+		lengthStr, offsetStr = value[:i], value[i+1:]
+	}
+
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil || length < 1 {
+		return "", fmt.Errorf("invalid byte range: %q", value)
+	}
+
+	offset := nextOffset[u.String()]
+	if offsetStr != "" {
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid byte range: %q", value)
+		}
+	}
+
+	nextOffset[u.String()] = offset + length
+
+	return byteRange(offset, length), nil
+}
+
+// parseAttributes parses the attribute list such as `BANDWIDTH=1280000,CODECS="avc1.4d401f,mp4a.40.2"`.
+// The quotes of quoted strings are removed.
+func parseAttributes(value string) map[string]string {
+	attrs := map[string]string{}
+
+	for value != "" {
+		eq := strings.Index(value, "=")
+		if eq < 0 {
+			break
+		}
+		name := strings.TrimSpace(value[:eq])
+		value = value[eq+1:]
+
+		var v string
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				v, value = value[1:], ""
+			} else {
+				v, value = value[1:end+1], value[end+2:]
+			}
+			value = strings.TrimPrefix(value, ",")
+		} else if comma := strings.Index(value, ","); comma >= 0 {
+			v, value = value[:comma], value[comma+1:]
+		} else {
+			v, value = value, ""
+		}
+
+		attrs[name] = v
+	}
+
+	return attrs
+}
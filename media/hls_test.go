@@ -0,0 +1,80 @@
+package media
+
+import (
+	"io"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMedia_ParseHLS_Master(t *testing.T) {
+	p := parseFile(t, "master.m3u8", "http://example.com/live/master.m3u8", ParseHLS)
+
+	if len(p.Segments) != 0 {
+		t.Errorf("unexpected segments: %v", describeSegments(p.Segments))
+	}
+
+	var actual []string
+	for _, v := range p.Variants {
+		actual = append(actual, v.URL.String()+" "+v.Resolution())
+	}
+
+	expected := []string{
+		"http://example.com/live/360p/index.m3u8 640x360",
+		"http://example.com/live/720p/index.m3u8 1280x720",
+		"http://cdn.example.com/1080p/index.m3u8 1920x1080",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected variants: expected: %q actual: %q", expected, actual)
+	}
+
+	if p.Variants[1].Bandwidth != 2800000 {
+		t.Errorf("unexpected bandwidth: expected: %d actual: %d", 2800000, p.Variants[1].Bandwidth)
+	}
+}
+
+func TestMedia_ParseHLS_Media(t *testing.T) {
+	p := parseFile(t, "media.m3u8", "http://example.com/live/720p/index.m3u8", ParseHLS)
+
+	expected := []string{
+		"http://example.com/live/720p/init.mp4 bytes=0-719",
+		"http://example.com/live/720p/seg0.ts",
+		// The IV is the media sequence number without the IV attribute.
+		"http://example.com/live/720p/seg1.ts http://example.com/live/key.bin 00000000000000000000000000000008",
+		"http://example.com/live/720p/all.ts bytes=0-999 http://example.com/live/key.bin 000102030405060708090a0b0c0d0e0f",
+		"http://example.com/live/720p/all.ts bytes=1000-1499 http://example.com/live/key.bin 000102030405060708090a0b0c0d0e0f",
+		"http://example.com/live/720p/seg4.ts",
+	}
+
+	actual := describeSegments(p.Segments)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected segments: expected: %q actual: %q", expected, actual)
+	}
+}
+
+func TestMedia_ParseHLS_Error(t *testing.T) {
+	cases := map[string]struct {
+		playlist string
+		expected string
+	}{
+		"not M3U8":           {playlist: "<html></html>", expected: errNotM3U8.Error()},
+		"SAMPLE-AES":         {playlist: "#EXTM3U\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"k\"\n", expected: `line 2: unsupported encryption method: "SAMPLE-AES"`},
+		"invalid IV":         {playlist: "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\",IV=0x01\n", expected: `line 2: invalid IV: "0x01"`},
+		"invalid byte range": {playlist: "#EXTM3U\n#EXT-X-BYTERANGE:x\nseg.ts\n", expected: `line 3: invalid byte range: "x"`},
+	}
+
+	base, _ := url.Parse("http://example.com/index.m3u8")
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			var r io.Reader = strings.NewReader(c.playlist)
+
+			_, err := ParseHLS(base, r)
+			if err == nil || err.Error() != c.expected {
+				t.Errorf("unexpected error: expected: %q actual: %v", c.expected, err)
+			}
+		})
+	}
+}
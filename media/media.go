@@ -0,0 +1,112 @@
+/*
+Package media deals with HLS playlists (RFC 8216) and DASH manifests (ISO/IEC 23009-1) of segmented media.
+*/
+package media
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var errNoVariants = errors.New("no variants")
+
+// Playlist is either a list of variants to select from or a list of the segments of one variant.
+type Playlist struct {
+	Variants []*Variant
+	Segments []*Segment
+
+	// Skipped are the content types of the DASH adaptation sets which are not downloaded, such as "audio".
+	Skipped []string
+}
+
+// Variant is one of the alternative encodings of the same content.
+type Variant struct {
+	Bandwidth int
+	Width     int
+	Height    int
+
+	// URL is the URL of the media playlist of an HLS variant.
+	URL *url.URL
+	// Segments are the segments of a DASH representation, which are resolved along with the manifest.
+	Segments []*Segment
+}
+
+// Resolution returns the resolution of v such as "1280x720", or empty if unknown.
+func (v *Variant) Resolution() string {
+	if v.Width == 0 || v.Height == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d", v.Width, v.Height)
+}
+
+// Segment is a segment of the media, which is concatenated in order with the others.
+type Segment struct {
+	URL *url.URL
+	// Range is the value of Range header to request a part of URL, or empty to request the whole.
+	Range string
+	// Key is the key to decrypt the segment, or nil if the segment is not encrypted.
+	Key *Key
+}
+
+// Key is the AES-128 key to decrypt a segment in CBC mode with PKCS#7 padding.
+type Key struct {
+	URL *url.URL
+	IV  []byte
+}
+
+// IsHLS reports whether u is an HLS playlist, judging from its extension.
+func IsHLS(u *url.URL) bool {
+	return strings.ToLower(path.Ext(u.Path)) == ".m3u8"
+}
+
+// IsDASH reports whether u is a DASH manifest, judging from its extension.
+func IsDASH(u *url.URL) bool {
+	return strings.ToLower(path.Ext(u.Path)) == ".mpd"
+}
+
+// SelectVariant selects the variant with the highest bandwidth.
+// If resolution such as "1280x720" is specified, only the variants of the resolution are selected from.
+// If maxBandwidth is positive, the variants whose bandwidth exceeds it are not selected unless all of them do,
+// in which case the variant with the lowest bandwidth is selected.
+func SelectVariant(variants []*Variant, maxBandwidth int, resolution string) (*Variant, error) {
+	if len(variants) == 0 {
+		return nil, errNoVariants
+	}
+
+	var candidates []*Variant
+	for _, v := range variants {
+		if resolution == "" || v.Resolution() == resolution {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no variants of resolution %s", resolution)
+	}
+
+	var selected, lowest *Variant
+	for _, v := range candidates {
+		if lowest == nil || v.Bandwidth < lowest.Bandwidth {
+			lowest = v
+		}
+		if maxBandwidth > 0 && v.Bandwidth > maxBandwidth {
+			continue
+		}
+		if selected == nil || v.Bandwidth > selected.Bandwidth {
+			selected = v
+		}
+	}
+
+	if selected == nil {
+		return lowest, nil
+	}
+
+	return selected, nil
+}
+
+// byteRange returns the value of Range header of length bytes from offset.
+func byteRange(offset int64, length int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
@@ -0,0 +1,107 @@
+package media
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"testing"
+)
+
+// parseFile parses the playlist in testdata as if it were served at rawurl.
+func parseFile(t *testing.T, filename string, rawurl string, parse func(*url.URL, io.Reader) (*Playlist, error)) *Playlist {
+	t.Helper()
+
+	fp, err := os.Open("testdata/" + filename)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer fp.Close()
+
+	base, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	p, err := parse(base, fp)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	return p
+}
+
+// describeSegments describes each segment as "URL Range Key.URL Key.IV" for comparison.
+func describeSegments(segments []*Segment) []string {
+	var ss []string
+	for _, s := range segments {
+		desc := s.URL.String()
+		if s.Range != "" {
+			desc += " " + s.Range
+		}
+		if s.Key != nil {
+			desc += fmt.Sprintf(" %s %x", s.Key.URL, s.Key.IV)
+		}
+		ss = append(ss, desc)
+	}
+	return ss
+}
+
+func TestMedia_SelectVariant(t *testing.T) {
+	variants := []*Variant{
+		{Bandwidth: 800000, Width: 640, Height: 360},
+		{Bandwidth: 2800000, Width: 1280, Height: 720},
+		{Bandwidth: 1400000, Width: 1280, Height: 720},
+		{Bandwidth: 5000000, Width: 1920, Height: 1080},
+	}
+
+	cases := map[string]struct {
+		maxBandwidth int
+		resolution   string
+		expected     int
+	}{
+		"highest":                      {expected: 5000000},
+		"max bandwidth":                {maxBandwidth: 3000000, expected: 2800000},
+		"max bandwidth below all":      {maxBandwidth: 100000, expected: 800000},
+		"resolution":                   {resolution: "1280x720", expected: 2800000},
+		"resolution and max bandwidth": {maxBandwidth: 2000000, resolution: "1280x720", expected: 1400000},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			v, err := SelectVariant(variants, c.maxBandwidth, c.resolution)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if v.Bandwidth != c.expected {
+				t.Errorf("unexpected bandwidth: expected: %d actual: %d", c.expected, v.Bandwidth)
+			}
+		})
+	}
+
+	_, err := SelectVariant(variants, 0, "3840x2160")
+	if err == nil || err.Error() != "no variants of resolution 3840x2160" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMedia_IsHLS_IsDASH(t *testing.T) {
+	cases := map[string]struct {
+		hls  bool
+		dash bool
+	}{
+		"http://example.com/a/master.m3u8":    {hls: true},
+		"http://example.com/a/INDEX.M3U8?x=1": {hls: true},
+		"http://example.com/a/manifest.mpd":   {dash: true},
+		"http://example.com/a/video.mp4":      {},
+	}
+
+	for rawurl, c := range cases {
+		u, _ := url.Parse(rawurl)
+		if IsHLS(u) != c.hls || IsDASH(u) != c.dash {
+			t.Errorf("unexpected result for %s: IsHLS: %t IsDASH: %t", rawurl, IsHLS(u), IsDASH(u))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Package metalink deals with Metalink Download Description Format (RFC 5854).
+*/
+package metalink
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// lowestPriority is the priority of URLs without the priority attribute.
+const lowestPriority = 999999
+
+var (
+	errNoFiles   = errors.New("metalink has no file")
+	errEmptyName = errors.New("file has no name")
+)
+
+// hashTypes are the hash types in order of preference.
+var hashTypes = []string{"sha-512", "sha-384", "sha-256", "sha-224", "sha-1", "md5"}
+
+// Metalink is the metalink element.
+type Metalink struct {
+	Files []*File `xml:"file"`
+}
+
+// File is the file element, which describes one file to download.
+type File struct {
+	Name   string  `xml:"name,attr"`
+	Size   int64   `xml:"size"`
+	Hashes []*Hash `xml:"hash"`
+	Pieces *Pieces `xml:"pieces"`
+	URLs   []*URL  `xml:"url"`
+}
+
+// Hash is the hash element of the whole file.
+type Hash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Pieces is the pieces element, which has the hashes of the pieces of the specified length.
+type Pieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+// URL is the url element. The lower Priority is, the more preferred the URL is.
+type URL struct {
+	Location string `xml:"location,attr"`
+	Priority int    `xml:"priority,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// Load loads the metalink from location, which is a local path or an http(s) URL.
+// The URL is requested by client, or http.DefaultClient if it is nil.
+func Load(ctx context.Context, client *http.Client, location string) (*Metalink, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	u, err := url.Parse(location)
+	if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		req, err := http.NewRequest("GET", location, nil)
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+
+		return Parse(resp.Body)
+	}
+
+	fp, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return Parse(fp)
+}
+
+// Parse parses the metalink read from r.
+func Parse(r io.Reader) (*Metalink, error) {
+	m := &Metalink{}
+
+	err := xml.NewDecoder(r).Decode(m)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Files) == 0 {
+		return nil, errNoFiles
+	}
+
+	for _, f := range m.Files {
+		f.Name = cleanName(f.Name)
+		if f.Name == "" {
+			return nil, errEmptyName
+		}
+
+		for _, h := range f.Hashes {
+			h.Type = strings.ToLower(strings.TrimSpace(h.Type))
+			h.Value = strings.ToLower(strings.TrimSpace(h.Value))
+		}
+
+		if f.Pieces != nil {
+			f.Pieces.Type = strings.ToLower(strings.TrimSpace(f.Pieces.Type))
+			for i, h := range f.Pieces.Hashes {
+				f.Pieces.Hashes[i] = strings.ToLower(strings.TrimSpace(h))
+			}
+		}
+
+		for _, u := range f.URLs {
+			u.Value = strings.TrimSpace(u.Value)
+			if u.Priority < 1 {
+				u.Priority = lowestPriority
+			}
+		}
+
+		// The order of URLs with the same priority is kept as in the metalink.
+		sort.SliceStable(f.URLs, func(i, j int) bool { return f.URLs[i].Priority < f.URLs[j].Priority })
+	}
+
+	return m, nil
+}
+
+// Hash returns the hash of the most preferred type, or nil if no hash is available.
+func (f *File) Hash() *Hash {
+	for _, typ := range hashTypes {
+		for _, h := range f.Hashes {
+			if h.Type == typ {
+				return h
+			}
+		}
+	}
+	return nil
+}
+
+// cleanName removes the leading slashes and ".." elements from name, which must be relative to the directory to save.
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.TrimSpace(name)), "/")
+}
@@ -0,0 +1,141 @@
+package metalink
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetalink_Load(t *testing.T) {
+	m, err := Load(context.Background(), nil, "testdata/example.meta4")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if len(m.Files) != 1 {
+		t.Fatalf("unexpected number of files: expected: %d actual: %d", 1, len(m.Files))
+	}
+
+	f := m.Files[0]
+
+	if f.Name != "example.ext" {
+		t.Errorf(`unexpected name: expected: "example.ext" actual: "%s"`, f.Name)
+	}
+
+	if f.Size != 14471447 {
+		t.Errorf("unexpected size: expected: %d actual: %d", 14471447, f.Size)
+	}
+
+	expectedURLs := []*URL{
+		{Location: "de", Priority: 1, Value: "ftp://ftp.example.com/example.ext"},
+		{Location: "us", Priority: 2, Value: "http://example.com/example.ext"},
+		{Location: "", Priority: lowestPriority, Value: "http://example.org/example.ext"},
+	}
+	if !reflect.DeepEqual(f.URLs, expectedURLs) {
+		t.Errorf("unexpected URLs: expected: %v actual: %v", expectedURLs, f.URLs)
+	}
+
+	expectedHash := &Hash{Type: "sha-256", Value: "f0ad929cd259957e160ea442eb80986b5f01"}
+	if !reflect.DeepEqual(f.Hash(), expectedHash) {
+		t.Errorf("unexpected hash: expected: %v actual: %v", expectedHash, f.Hash())
+	}
+
+	expectedPieces := &Pieces{Length: 262144, Type: "sha-1", Hashes: []string{"aaa", "bbb"}}
+	if !reflect.DeepEqual(f.Pieces, expectedPieces) {
+		t.Errorf("unexpected pieces: expected: %v actual: %v", expectedPieces, f.Pieces)
+	}
+}
+
+func TestMetalink_Load_URL(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/example.meta4")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/example.meta4" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer ts.Close()
+
+	m, err := Load(context.Background(), nil, ts.URL+"/example.meta4")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if m.Files[0].Name != "example.ext" {
+		t.Errorf(`unexpected name: expected: "example.ext" actual: "%s"`, m.Files[0].Name)
+	}
+
+	_, err = Load(context.Background(), nil, ts.URL+"/missing.meta4")
+	if err == nil || err.Error() != "unexpected status code: 404" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMetalink_Parse_Name(t *testing.T) {
+	cases := map[string]struct {
+		name     string
+		expected string
+	}{
+		"plain":          {name: "a.txt", expected: "a.txt"},
+		"subdirectory":   {name: "a/b.txt", expected: "a/b.txt"},
+		"absolute":       {name: "/etc/passwd", expected: "etc/passwd"},
+		"path traversal": {name: "../../a.txt", expected: "a.txt"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			m, err := Parse(strings.NewReader(fmt.Sprintf(`<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="%s"/></metalink>`, c.name)))
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			actual := m.Files[0].Name
+			if actual != c.expected {
+				t.Errorf(`unexpected name: expected: "%s" actual: "%s"`, c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMetalink_Parse_Error(t *testing.T) {
+	cases := map[string]struct {
+		input    string
+		expected string
+	}{
+		"no files":    {input: `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`, expected: errNoFiles.Error()},
+		"empty name":  {input: `<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name=""/></metalink>`, expected: errEmptyName.Error()},
+		"invalid XML": {input: `<metalink`, expected: "XML syntax error on line 1: unexpected EOF"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(c.input))
+			if err == nil {
+				t.Fatal("unexpectedly err is nil")
+			}
+
+			if err.Error() != c.expected {
+				t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, c.expected, err.Error())
+			}
+		})
+	}
+}
+
+func TestMetalink_File_Hash_None(t *testing.T) {
+	f := &File{Hashes: []*Hash{{Type: "unknown", Value: "a"}}}
+	if h := f.Hash(); h != nil {
+		t.Errorf("unexpected hash: %v", h)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Package metrics collects the metrics of the downloads, and exposes them in the Prometheus text format.
+*/
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the buckets of the request durations, which are the defaults of Prometheus.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The kinds of the checksum failures.
+const (
+	// Checksum is the kind of the mismatch of the checksum of the whole content.
+	Checksum = "checksum"
+	// Piece is the kind of the mismatch of the hash of a piece, which is downloaded again.
+	Piece = "piece"
+)
+
+// Metrics collects the metrics of the downloads which share it.
+// The methods of a nil Metrics do nothing, so the downloads are not instrumented unless it is enabled.
+type Metrics struct {
+	mu               sync.Mutex
+	receivedBytes    map[string]float64
+	activeRanges     map[string]float64
+	requestDurations map[string]*histogram
+	retries          float64
+	checksumFailures map[string]float64
+}
+
+// histogram is the cumulative counts of the observations in the buckets, with their sum and count.
+type histogram struct {
+	counts []float64
+	sum    float64
+	count  float64
+}
+
+// New returns Metrics with no observations.
+func New() *Metrics {
+	return &Metrics{
+		receivedBytes:    map[string]float64{},
+		activeRanges:     map[string]float64{},
+		requestDurations: map[string]*histogram{},
+		checksumFailures: map[string]float64{Checksum: 0, Piece: 0},
+	}
+}
+
+// AddReceived counts n bytes received from the host.
+func (m *Metrics) AddReceived(host string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.receivedBytes[host] += float64(n)
+}
+
+// AddActiveRanges adds delta to the number of the ranges being received from the host.
+func (m *Metrics) AddActiveRanges(host string, delta int) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.activeRanges[host] += float64(delta)
+}
+
+// ObserveRequest records the duration of an HTTP request until its response header by the status code,
+// which is "error" if no response is received, or "canceled" if the request is canceled before it.
+func (m *Metrics) ObserveRequest(code string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.requestDurations[code]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(durationBuckets))}
+		m.requestDurations[code] = h
+	}
+
+	s := d.Seconds()
+	for i, le := range durationBuckets {
+		if s <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// AddRetry counts a request made again after an error, or to another mirror after one failed.
+func (m *Metrics) AddRetry() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.retries++
+}
+
+// AddChecksumFailure counts a checksum failure of the kind, which is Checksum or Piece.
+func (m *Metrics) AddChecksumFailure(kind string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.checksumFailures[kind]++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, in order of the names and the labels.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+
+	writeFamily(&b, "parallel_download_received_bytes_total", "counter", "Bytes received from each host.", "host", m.receivedBytes)
+	writeFamily(&b, "parallel_download_active_ranges", "gauge", "Ranges being received from each host.", "host", m.activeRanges)
+
+	b.WriteString("# HELP parallel_download_request_duration_seconds Durations of the HTTP requests until their response headers by status code.\n")
+	b.WriteString("# TYPE parallel_download_request_duration_seconds histogram\n")
+	for _, code := range sortedKeys(m.requestDurations) {
+		h := m.requestDurations[code]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(&b, "parallel_download_request_duration_seconds_bucket{code=%s,le=\"%s\"} %s\n", quote(code), formatFloat(le), formatFloat(h.counts[i]))
+		}
+		fmt.Fprintf(&b, "parallel_download_request_duration_seconds_bucket{code=%s,le=\"+Inf\"} %s\n", quote(code), formatFloat(h.count))
+		fmt.Fprintf(&b, "parallel_download_request_duration_seconds_sum{code=%s} %s\n", quote(code), formatFloat(h.sum))
+		fmt.Fprintf(&b, "parallel_download_request_duration_seconds_count{code=%s} %s\n", quote(code), formatFloat(h.count))
+	}
+
+	b.WriteString("# HELP parallel_download_retries_total Requests made again after errors or to another mirror.\n")
+	b.WriteString("# TYPE parallel_download_retries_total counter\n")
+	fmt.Fprintf(&b, "parallel_download_retries_total %s\n", formatFloat(m.retries))
+
+	writeFamily(&b, "parallel_download_checksum_failures_total", "counter", "Mismatches of the checksums of the contents and the hashes of the pieces.", "kind", m.checksumFailures)
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeFamily writes the metric family of the name whose values are by the label.
+func writeFamily(b *strings.Builder, name string, typ string, help string, label string, values map[string]float64) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+	for _, k := range sortedKeys(values) {
+		fmt.Fprintf(b, "%s{%s=%s} %s\n", name, label, quote(k), formatFloat(values[k]))
+	}
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// quote returns the label value quoted and escaped for the text format.
+func quote(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+// formatFloat formats v for the text format, such as "3000000" and "0.005".
+// The counts of bytes are formatted without exponents so that they are readable.
+func formatFloat(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
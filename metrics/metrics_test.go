@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+
+	m.AddReceived("example.com", 1)
+	m.AddActiveRanges("example.com", 1)
+	m.ObserveRequest("200", time.Second)
+	m.AddRetry()
+	m.AddChecksumFailure(Checksum)
+}
+
+func TestMetrics_WriteTo(t *testing.T) {
+	m := New()
+
+	m.AddReceived("b.example.com", 100)
+	m.AddReceived("a.example.com", 10)
+	m.AddReceived("a.example.com", 20)
+	m.AddActiveRanges("a.example.com", 2)
+	m.AddActiveRanges("a.example.com", -1)
+	m.ObserveRequest("206", 30*time.Millisecond)
+	m.ObserveRequest("206", 2*time.Second)
+	m.ObserveRequest("error", 20*time.Second)
+	m.AddRetry()
+	m.AddChecksumFailure(Piece)
+	m.AddChecksumFailure(Piece)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	actual := buf.String()
+
+	cases := map[string]struct {
+		expected string
+	}{
+		"received":          {expected: "parallel_download_received_bytes_total{host=\"a.example.com\"} 30\nparallel_download_received_bytes_total{host=\"b.example.com\"} 100\n"},
+		"active ranges":     {expected: "parallel_download_active_ranges{host=\"a.example.com\"} 1\n"},
+		"bucket":            {expected: "parallel_download_request_duration_seconds_bucket{code=\"206\",le=\"0.025\"} 0\nparallel_download_request_duration_seconds_bucket{code=\"206\",le=\"0.05\"} 1\n"},
+		"inf bucket":        {expected: "parallel_download_request_duration_seconds_bucket{code=\"206\",le=\"+Inf\"} 2\n"},
+		"sum":               {expected: "parallel_download_request_duration_seconds_sum{code=\"206\"} 2.03\n"},
+		"error count":       {expected: "parallel_download_request_duration_seconds_count{code=\"error\"} 1\n"},
+		"error bucket":      {expected: "parallel_download_request_duration_seconds_bucket{code=\"error\",le=\"10\"} 0\n"},
+		"retries":           {expected: "parallel_download_retries_total 1\n"},
+		"checksum":          {expected: "parallel_download_checksum_failures_total{kind=\"checksum\"} 0\n"},
+		"piece":             {expected: "parallel_download_checksum_failures_total{kind=\"piece\"} 2\n"},
+		"type of counter":   {expected: "# TYPE parallel_download_received_bytes_total counter\n"},
+		"type of gauge":     {expected: "# TYPE parallel_download_active_ranges gauge\n"},
+		"type of histogram": {expected: "# TYPE parallel_download_request_duration_seconds histogram\n"},
+	}
+
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			if !strings.Contains(actual, c.expected) {
+				t.Errorf("unexpected metrics: expected: %q actual: %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMetrics_quote(t *testing.T) {
+	expected := `"a\\b\"c\nd"`
+	actual := quote("a\\b\"c\nd")
+	if actual != expected {
+		t.Errorf("unexpected label value: expected: %s actual: %s", expected, actual)
+	}
+}
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := New()
+	m.AddRetry()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	expected := "text/plain; version=0.0.4; charset=utf-8"
+	if actual := rec.Header().Get("Content-Type"); actual != expected {
+		t.Errorf("unexpected content type: expected: %s actual: %s", expected, actual)
+	}
+
+	if !strings.Contains(rec.Body.String(), "parallel_download_retries_total 1\n") {
+		t.Errorf("unexpected body: %q", rec.Body.String())
+	}
+}
+
+func TestMetrics_formatFloat(t *testing.T) {
+	cases := map[string]struct {
+		value    float64
+		expected string
+	}{
+		"integer":  {value: 3000000, expected: "3000000"},
+		"fraction": {value: 0.005, expected: "0.005"},
+		"huge":     {value: 1e20, expected: "1e+20"},
+	}
+
+	for name, c := range cases {
+		c := c
+		t.Run(name, func(t *testing.T) {
+			actual := formatFloat(c.value)
+			if actual != c.expected {
+				t.Errorf("unexpected value: expected: %s actual: %s", c.expected, actual)
+			}
+		})
+	}
+}
@@ -4,21 +4,248 @@ Package opt deals with CLI options.
 package opt
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/hioki-daichi/parallel-download/metrics"
+	"github.com/hioki-daichi/parallel-download/throttling"
 )
 
-var errExist = errors.New("file already exists")
+// DefaultMaxRedirects is the number of redirects followed by default, which is the same as http.Client.
+const DefaultMaxRedirects = 10
+
+var (
+	errExist                  = errors.New("file already exists")
+	errNoURL                  = errors.New("no URL specified")
+	errOutputWithMultipleURLs = errors.New("-o cannot be used with multiple URLs")
+	errOutputWithTemplate     = errors.New("-o cannot be used with --output-template")
+	errExtractWithStdout      = errors.New("-o - cannot be used with --extract")
+	errMirrorWithMultipleURLs = errors.New("--mirror cannot be used with multiple URLs")
+	errOutputWithMetalink     = errors.New("-o cannot be used with metalinks")
+	errMirrorWithMetalink     = errors.New("--mirror cannot be used with metalinks")
+	errPiecesWithMultipleURLs = errors.New("--pieces cannot be used with multiple URLs")
+	errIPv4WithIPv6           = errors.New("-4 cannot be used with -6")
+	errHTTP2WithPerRange      = errors.New("--http2 cannot be used with --connection-per-range")
+	errMultiRangeWithStream   = errors.New("--multi-range cannot be used with -o - or --extract")
+	errAdaptiveWithStream     = errors.New("--adaptive cannot be used with -o - or --extract")
+	errAdaptiveWithMultiRange = errors.New("--adaptive cannot be used with --multi-range")
+	errNoQueueState           = errors.New("no state file of the queue specified")
+	errNoID                   = errors.New("no ID specified")
+	errNoDaemonAddr           = errors.New("no address of the daemon specified")
+	errNoSecret               = errors.New("--secret is required to serve the JSON API on TCP")
+	errNoRPCSecret            = errors.New("--rpc-secret is required to serve the JSON-RPC interface of aria2 on TCP")
+)
 
 // Options has the options required for parallel-download.
 type Options struct {
-	Parallelism int
-	Output      string
-	URL         *url.URL
-	Timeout     time.Duration
+	Parallelism    int
+	Output         string
+	Dir            string
+	OutputTemplate string
+	URL            *url.URL
+	URLs           []*url.URL
+	Timeout        time.Duration
+	MaxBuffer      int
+	Extract        string
+	Mirrors        []*url.URL
+	StallTimeout   time.Duration
+	Checksum       *Checksum
+	Pieces         *Pieces
+	PieceRetries   int
+	Metalinks      []string
+	Bandwidth      int
+	Resolution     string
+	S3Endpoint     string
+	S3Region       string
+	UnixSocket     string
+	Resolves       []*Resolve
+	ConnectTos     []*ConnectTo
+	BindAddresses  []net.IP
+
+	HTTP2              bool
+	HTTP2Connections   int
+	ConnectionPerRange bool
+	Verbose            bool
+	MultiRange         int
+
+	// MaxRedirects is the number of redirects followed, which is DefaultMaxRedirects if it is 0,
+	// and none if it is negative or NoFollow is set.
+	MaxRedirects int
+	NoFollow     bool
+
+	Adaptive bool
+
+	// HostCache is the path of the file which remembers the best parallelism of each host found by Adaptive, or empty.
+	HostCache string
+
+	// Throttle limits the requests to each host across the downloads which share it, or nil.
+	Throttle *throttling.Throttle
+
+	// MetricsAddr is the address to serve Metrics on, which is disabled if empty.
+	MetricsAddr string
+
+	// Metrics collects the metrics of the downloads which share it, or nil.
+	Metrics *metrics.Metrics
+
+	// Size is the size of the content known in advance such as from a metalink, which Content-Length must match, or 0 if unknown.
+	Size int64
+
+	// WorkDir is the directory which keeps the downloaded ranges until the file is completed,
+	// so that the download run again only requests the missing ranges. Empty uses a temporary directory.
+	WorkDir string
+
+	// Network is "tcp4" or "tcp6" to force the address family, or empty.
+	Network string
+}
+
+// Checksum is the expected hash of the whole content.
+type Checksum struct {
+	// Type is the type of the hash such as "sha-256".
+	Type string
+	// Value is the hex-encoded hash.
+	Value string
+}
+
+// Pieces is the expected hashes of the pieces of the content.
+// Every piece has Length bytes except the last one.
+// It is also the format of the JSON manifest specified by --pieces.
+type Pieces struct {
+	Type   string   `json:"type"`
+	Length int      `json:"length"`
+	Hashes []string `json:"hashes"`
+}
+
+// Resolve pins the host and the port to the address, as --resolve of curl does.
+type Resolve struct {
+	Host string
+	Port string
+	Addr string
+}
+
+// ConnectTo redirects the connections to the host and the port to ToHost and ToPort, as --connect-to of curl does.
+// An empty Host or Port matches any, and an empty ToHost or ToPort keeps the original.
+type ConnectTo struct {
+	Host   string
+	Port   string
+	ToHost string
+	ToPort string
+}
+
+// mediaExtensions maps the extensions of HLS playlists and DASH manifests to those of the downloaded media.
+var mediaExtensions = map[string]string{
+	".m3u8": ".ts",
+	".mpd":  ".mp4",
+}
+
+// urlsValue is a flag.Value which accumulates the URLs of a repeatable flag.
+type urlsValue []*url.URL
+
+func (v *urlsValue) String() string {
+	var ss []string
+	for _, u := range *v {
+		ss = append(ss, u.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func (v *urlsValue) Set(s string) error {
+	u, err := parseSource(s)
+	if err != nil {
+		return err
+	}
+	*v = append(*v, u)
+	return nil
+}
+
+// resolvesValue is a flag.Value which accumulates the values of --resolve such as "example.com:443:127.0.0.1".
+type resolvesValue []*Resolve
+
+func (v *resolvesValue) String() string {
+	var ss []string
+	for _, r := range *v {
+		ss = append(ss, r.Host+":"+r.Port+":"+r.Addr)
+	}
+	return strings.Join(ss, ",")
+}
+
+func (v *resolvesValue) Set(s string) error {
+	fields := strings.SplitN(s, ":", 3)
+	if len(fields) != 3 || fields[0] == "" {
+		return fmt.Errorf("invalid value, which must be host:port:addr: %q", s)
+	}
+
+	if _, err := strconv.ParseUint(fields[1], 10, 16); err != nil {
+		return fmt.Errorf("invalid port: %q", s)
+	}
+
+	addr := strings.TrimSuffix(strings.TrimPrefix(fields[2], "["), "]")
+	if net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid address: %q", s)
+	}
+
+	*v = append(*v, &Resolve{Host: fields[0], Port: fields[1], Addr: addr})
+	return nil
+}
+
+// connectTosValue is a flag.Value which accumulates the values of --connect-to such as "example.com:443:cdn.example.net:8443".
+type connectTosValue []*ConnectTo
+
+func (v *connectTosValue) String() string {
+	var ss []string
+	for _, c := range *v {
+		ss = append(ss, c.Host+":"+c.Port+":"+c.ToHost+":"+c.ToPort)
+	}
+	return strings.Join(ss, ",")
+}
+
+func (v *connectTosValue) Set(s string) error {
+	fields := strings.SplitN(s, ":", 3)
+	i := -1
+	if len(fields) == 3 {
+		i = strings.LastIndex(fields[2], ":")
+	}
+	if i < 0 {
+		return fmt.Errorf("invalid value, which must be host1:port1:host2:port2: %q", s)
+	}
+
+	c := &ConnectTo{
+		Host:   fields[0],
+		Port:   fields[1],
+		ToHost: strings.TrimSuffix(strings.TrimPrefix(fields[2][:i], "["), "]"),
+		ToPort: fields[2][i+1:],
+	}
+
+	for _, port := range []string{c.Port, c.ToPort} {
+		if _, err := strconv.ParseUint(port, 10, 16); port != "" && err != nil {
+			return fmt.Errorf("invalid port: %q", s)
+		}
+	}
+
+	*v = append(*v, c)
+	return nil
+}
+
+// stringsValue is a flag.Value which accumulates the values of a repeatable flag.
+type stringsValue []string
+
+func (v *stringsValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *stringsValue) Set(s string) error {
+	*v = append(*v, s)
+	return nil
 }
 
 // Parse parses args and returns Options.
@@ -29,28 +256,643 @@ func Parse(args ...string) (*Options, error) {
 	output := flg.String("o", "", "Save the downloaded file in the specified path. (Overwrite if duplicates.)")
 	timeout := flg.Duration("t", 30*time.Second, "Terminate when the specified value has elapsed since download started.")
 
+	var dir string
+	flg.StringVar(&dir, "d", "", "Save the downloaded files under the specified directory. (Created if missing.)")
+	flg.StringVar(&dir, "dir", "", "Same as -d.")
+
+	maxBuffer := flg.Int("max-buffer", 64<<20, "Maximum bytes of out-of-order ranges buffered in memory when streaming to stdout with -o -.")
+
+	extract := flg.String("extract", "", "Decompress gzip/bzip2/xz/zstd and unpack tar/zip under the specified directory while downloading, instead of saving the file.")
+
+	var mirrors urlsValue
+	flg.Var(&mirrors, "mirror", "Download ranges also from the specified URL which serves the same file. (Repeatable)")
+
+	stallTimeout := flg.Duration("stall-timeout", 0, "Give up a range request when no data is received for the specified duration, and reassign it to another mirror. (0 disables it)")
+
+	piecesPath := flg.String("pieces", "", `Verify each piece of the content with the JSON manifest such as {"type": "sha-256", "length": 1048576, "hashes": ["..."]}.`)
+	pieceRetries := flg.Int("piece-retries", 3, "Re-download only the corrupt pieces up to the specified number of times.")
+
+	bandwidth := flg.Int("bandwidth", 0, "Select the variant of HLS or DASH with the highest bandwidth not exceeding the specified bits per second. (0 selects the highest)")
+	resolution := flg.String("resolution", "", "Select the variant of HLS or DASH of the specified resolution such as 1280x720.")
+
+	s3Endpoint := flg.String("s3-endpoint", "", "Request the objects of s3:// URLs from the specified endpoint such as http://localhost:9000 with path-style URLs. (default AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, or AWS)")
+	s3Region := flg.String("s3-region", "", "Sign the requests for s3:// URLs for the specified region. (default AWS_REGION or AWS_DEFAULT_REGION, or us-east-1)")
+	unixSocket := flg.String("unix-socket", "", "Connect to the specified Unix domain socket instead of the host of HTTP(S) URLs.")
+
+	var resolves resolvesValue
+	flg.Var(&resolves, "resolve", "Connect to the specified address instead of the host and the port such as example.com:443:127.0.0.1. (Repeatable)")
+	var connectTos connectTosValue
+	flg.Var(&connectTos, "connect-to", "Connect to the second host and port instead of the first ones such as example.com:443:cdn.example.net:8443, where an empty field matches any or keeps the original. (Repeatable)")
+	var bindAddresses stringsValue
+	flg.Var(&bindAddresses, "bind-address", "Distribute the range requests across the specified local IP addresses or interfaces. (Repeatable)")
+	http2 := flg.Bool("http2", false, "Use HTTP/2, negotiated by ALPN for https URLs or with prior knowledge (h2c) for http URLs.")
+	http2Connections := flg.Int("http2-connections", 1, "Multiplex the range requests over the specified number of connections with --http2.")
+	connectionPerRange := flg.Bool("connection-per-range", false, "Make each range request over its own connection with HTTP/1.1, for the servers which throttle each connection.")
+	multiRange := flg.Int("multi-range", 0, "Request the ranges of -p by the specified number of requests, each of which asks for multiple ranges as multipart/byteranges. (0 disables it)")
+	maxRedirects := flg.Int("max-redirects", DefaultMaxRedirects, "Follow up to the specified number of redirects. (0 follows none)")
+	noFollow := flg.Bool("no-follow", false, "Do not follow redirects.")
+	adaptive := flg.Bool("adaptive", false, "Start with low parallelism and increase it up to -p while the throughput improves, and decrease it on 429, 503 or reset connections.")
+	hostCache := flg.String("host-cache", defaultHostCache(), "Remember the best parallelism of each host found by --adaptive in the specified file, and start with it next time. (empty disables it)")
+	throttle := throttleFlags(flg)
+	metricsAddr := flg.String("metrics-addr", "", metricsAddrUsage)
+	verbose := flg.Bool("v", false, "Report the details of each request such as the negotiated protocol.")
+
+	ipv4 := flg.Bool("4", false, "Connect only to IPv4 addresses.")
+	ipv6 := flg.Bool("6", false, "Connect only to IPv6 addresses.")
+
+	outputTemplate := flg.String("output-template", "", "Save the downloaded files in the path generated from the specified template. (Placeholders: {host}, {path}, {basename}, {ext}, {date}, {etag})")
+
 	flg.Parse(args)
 
-	u, err := url.ParseRequestURI(flg.Arg(0))
-	if err != nil {
-		return nil, err
+	if flg.NArg() == 0 {
+		return nil, errNoURL
+	}
+
+	// --max-redirects=0 follows none, while 0 of Options is DefaultMaxRedirects for the library callers.
+	if *maxRedirects == 0 {
+		*maxRedirects = -1
+	}
+
+	var urls []*url.URL
+	var metalinks []string
+	for _, arg := range flg.Args() {
+		if isMetalink(arg) {
+			metalinks = append(metalinks, arg)
+			continue
+		}
+
+		u, err := parseSource(arg)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	if *output != "" && len(metalinks) > 0 {
+		return nil, errOutputWithMetalink
+	}
+
+	if len(mirrors) > 0 && len(metalinks) > 0 {
+		return nil, errMirrorWithMetalink
+	}
+
+	if *output != "" && len(urls) > 1 {
+		return nil, errOutputWithMultipleURLs
+	}
+
+	if *output != "" && *outputTemplate != "" {
+		return nil, errOutputWithTemplate
+	}
+
+	if len(mirrors) > 0 && len(urls) > 1 {
+		return nil, errMirrorWithMultipleURLs
+	}
+
+	if *output == "-" && *extract != "" {
+		return nil, errExtractWithStdout
+	}
+
+	if *ipv4 && *ipv6 {
+		return nil, errIPv4WithIPv6
+	}
+
+	if *http2 && *connectionPerRange {
+		return nil, errHTTP2WithPerRange
+	}
+
+	if *multiRange > 0 && (*output == "-" || *extract != "") {
+		return nil, errMultiRangeWithStream
+	}
+
+	if *adaptive && (*output == "-" || *extract != "") {
+		return nil, errAdaptiveWithStream
+	}
+
+	if *adaptive && *multiRange > 0 {
+		return nil, errAdaptiveWithMultiRange
 	}
 
-	if *output == "" {
-		_, filename := path.Split(u.Path)
+	network := ""
+	if *ipv4 {
+		network = "tcp4"
+	}
+	if *ipv6 {
+		network = "tcp6"
+	}
+
+	var ips []net.IP
+	for _, addr := range bindAddresses {
+		ip, err := resolveBindAddress(addr, network)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, ip)
+	}
+
+	if *output == "" && *outputTemplate == "" && len(urls) == 1 && len(metalinks) == 0 {
+		_, filename := path.Split(urls[0].Path)
 
 		// Inspired by the --default-page option of wget
 		if filename == "" {
 			filename = "index.html"
 		}
 
+		// The segments of HLS and DASH are saved instead of the playlist.
+		ext := path.Ext(filename)
+		if mediaExt, ok := mediaExtensions[strings.ToLower(ext)]; ok {
+			filename = strings.TrimSuffix(filename, ext) + mediaExt
+		}
+
 		*output = filename
 	}
 
+	var pieces *Pieces
+	if *piecesPath != "" {
+		if len(urls)+len(metalinks) > 1 {
+			return nil, errPiecesWithMultipleURLs
+		}
+
+		var err error
+		pieces, err = loadPieces(*piecesPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var u *url.URL
+	if len(urls) > 0 {
+		u = urls[0]
+	}
+
 	return &Options{
-		Parallelism: *parallelism,
-		Output:      *output,
-		URL:         u,
-		Timeout:     *timeout,
+		Parallelism:    *parallelism,
+		Output:         *output,
+		Dir:            dir,
+		OutputTemplate: *outputTemplate,
+		URL:            u,
+		URLs:           urls,
+		Timeout:        *timeout,
+		MaxBuffer:      *maxBuffer,
+		Extract:        *extract,
+		Mirrors:        mirrors,
+		StallTimeout:   *stallTimeout,
+		Pieces:         pieces,
+		PieceRetries:   *pieceRetries,
+		Metalinks:      metalinks,
+		Bandwidth:      *bandwidth,
+		Resolution:     *resolution,
+		S3Endpoint:     *s3Endpoint,
+		S3Region:       *s3Region,
+		UnixSocket:     *unixSocket,
+		Resolves:       resolves,
+		ConnectTos:     connectTos,
+		Network:        network,
+		BindAddresses:  ips,
+
+		HTTP2:              *http2,
+		HTTP2Connections:   *http2Connections,
+		ConnectionPerRange: *connectionPerRange,
+		Verbose:            *verbose,
+		MultiRange:         *multiRange,
+		MaxRedirects:       *maxRedirects,
+		NoFollow:           *noFollow,
+		Adaptive:           *adaptive,
+		HostCache:          *hostCache,
+		Throttle:           throttle(),
+		MetricsAddr:        *metricsAddr,
+		Metrics:            newMetrics(*metricsAddr),
+	}, nil
+}
+
+// metricsAddrUsage is the usage of --metrics-addr, which is shared by the subcommands.
+const metricsAddrUsage = "Serve the metrics of the downloads in the Prometheus text format at /metrics on the specified address such as :9100. (empty disables it)"
+
+// newMetrics returns Metrics if they are served on addr, or nil.
+func newMetrics(addr string) *metrics.Metrics {
+	if addr == "" {
+		return nil
+	}
+	return metrics.New()
+}
+
+// throttleFlags defines the flags to limit the requests to each host,
+// and returns the function to make the throttle from them after parsing.
+func throttleFlags(flg *flag.FlagSet) func() *throttling.Throttle {
+	rate := flg.Float64("host-rate", 0, "Send up to the specified number of requests per second to each host. (0 disables it)")
+	connections := flg.Int("host-connections", 0, "Make up to the specified number of concurrent requests to each host. (0 disables it)")
+	failures := flg.Int("breaker-failures", 0, "Pause the requests to a host after the specified number of consecutive failures, and probe it before resuming. (0 disables it)")
+	cooldown := flg.Duration("breaker-cooldown", 30*time.Second, "Probe the paused host after the specified duration, and again after each failed probe.")
+
+	return func() *throttling.Throttle {
+		return throttling.New(*rate, *connections, *failures, *cooldown)
+	}
+}
+
+// loadPieces loads the JSON manifest of the hashes of pieces.
+func loadPieces(filename string) (*Pieces, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pieces := &Pieces{}
+	err = json.Unmarshal(b, pieces)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return pieces, nil
+}
+
+// resolveBindAddress returns the IP address of addr, which is an IP address or the name of an interface.
+// The first IPv4 address of the interface is used, or the first IPv6 address if there is none or network is "tcp6".
+func resolveBindAddress(addr string, network string) (net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address, which must be an IP address or an interface: %q", addr)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ipv4, ipv6 net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if ipv4 == nil {
+				ipv4 = ipNet.IP
+			}
+		} else if ipv6 == nil {
+			ipv6 = ipNet.IP
+		}
+	}
+
+	switch {
+	case ipv4 != nil && network != "tcp6":
+		return ipv4, nil
+	case ipv6 != nil && network != "tcp4":
+		return ipv6, nil
+	}
+
+	return nil, fmt.Errorf("interface %q has no usable address", addr)
+}
+
+// defaultHostCache returns the path of the host cache under the user cache directory, or empty if it is unknown.
+func defaultHostCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "parallel-download", "hosts.json")
+}
+
+// parseSource parses arg as a URL, or as the path of a local file which results in a file URL.
+// A single letter scheme is a drive letter of Windows such as "C:/foo", so arg is the path of a local file.
+func parseSource(arg string) (*url.URL, error) {
+	u, err := url.ParseRequestURI(arg)
+	if err == nil && len(u.Scheme) > 1 {
+		return u, nil
+	}
+
+	_, statErr := os.Stat(arg)
+	if err == nil && statErr != nil {
+		return nil, statErr
+	}
+
+	if statErr == nil {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+
+		p := filepath.ToSlash(abs)
+		// The path of a Windows drive letter such as "C:/foo" is "/C:/foo" in a file URL.
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+
+		return &url.URL{Scheme: "file", Path: p}, nil
+	}
+
+	return u, err
+}
+
+// isMetalink reports whether arg is the local path or the URL of a metalink, judging from its extension.
+func isMetalink(arg string) bool {
+	p := arg
+	if u, err := url.Parse(arg); err == nil {
+		p = u.Path
+	}
+
+	ext := strings.ToLower(path.Ext(p))
+
+	return ext == ".meta4" || ext == ".metalink"
+}
+
+// ZipOptions has the options required for the zip subcommand.
+type ZipOptions struct {
+	Options
+	List    bool
+	Entries []string
+}
+
+// ParseZip parses args of the zip subcommand and returns ZipOptions.
+func ParseZip(args ...string) (*ZipOptions, error) {
+	flg := flag.NewFlagSet("parallel-download zip", flag.ExitOnError)
+
+	parallelism := flg.Int("p", 8, "Download entries in parallel according to the specified number.")
+	timeout := flg.Duration("t", 30*time.Second, "Terminate when the specified value has elapsed since download started.")
+	list := flg.Bool("l", false, "List the entries instead of extracting them.")
+
+	var dir string
+	flg.StringVar(&dir, "d", ".", "Extract the entries under the specified directory. (Created if missing.)")
+	flg.StringVar(&dir, "dir", ".", "Same as -d.")
+
+	flg.Parse(args)
+
+	if flg.NArg() == 0 {
+		return nil, errNoURL
+	}
+
+	u, err := url.ParseRequestURI(flg.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZipOptions{
+		Options: Options{
+			Parallelism: *parallelism,
+			Dir:         dir,
+			URL:         u,
+			URLs:        []*url.URL{u},
+			Timeout:     *timeout,
+
+			MaxRedirects: DefaultMaxRedirects,
+		},
+		List:    *list,
+		Entries: flg.Args()[1:],
+	}, nil
+}
+
+// MirrorOptions has the options required for the mirror subcommand.
+type MirrorOptions struct {
+	Options
+	Jobs     int
+	Depth    int
+	Includes []string
+	Excludes []string
+}
+
+// ParseMirror parses args of the mirror subcommand and returns MirrorOptions.
+func ParseMirror(args ...string) (*MirrorOptions, error) {
+	flg := flag.NewFlagSet("parallel-download mirror", flag.ExitOnError)
+
+	parallelism := flg.Int("p", 8, "Download each file in parallel according to the specified number.")
+	jobs := flg.Int("j", 4, "Download the specified number of files at the same time.")
+	timeout := flg.Duration("t", 30*time.Second, "Terminate when the specified value has elapsed since download of each file started.")
+	depth := flg.Int("depth", 5, "Follow subdirectories up to the specified depth. (-1 means no limit)")
+
+	var dir string
+	flg.StringVar(&dir, "d", ".", "Save the files under the specified directory, preserving the directory structure. (Created if missing.)")
+	flg.StringVar(&dir, "dir", ".", "Same as -d.")
+
+	var includes, excludes stringsValue
+	flg.Var(&includes, "include", "Download only the files which match the specified glob. (Repeatable)")
+	flg.Var(&excludes, "exclude", "Skip the files and directories which match the specified glob. (Repeatable)")
+
+	throttle := throttleFlags(flg)
+	metricsAddr := flg.String("metrics-addr", "", metricsAddrUsage)
+
+	flg.Parse(args)
+
+	if flg.NArg() == 0 {
+		return nil, errNoURL
+	}
+
+	u, err := url.ParseRequestURI(flg.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	return &MirrorOptions{
+		Options: Options{
+			Parallelism: *parallelism,
+			Dir:         dir,
+			URL:         u,
+			URLs:        []*url.URL{u},
+			Timeout:     *timeout,
+
+			MaxRedirects: DefaultMaxRedirects,
+			Throttle:     throttle(),
+			MetricsAddr:  *metricsAddr,
+			Metrics:      newMetrics(*metricsAddr),
+		},
+		Jobs:     *jobs,
+		Depth:    *depth,
+		Includes: includes,
+		Excludes: excludes,
+	}, nil
+}
+
+// DaemonOptions has the options required for the daemon subcommand.
+// Options has the defaults of the downloads in the queue.
+type DaemonOptions struct {
+	Options
+	Listen string
+	State  string
+	Jobs   int
+
+	// Secret is the token which the JSON API requires unless it is empty.
+	Secret string
+
+	// AllowLocalFiles allows the downloads of file URLs and those saved outside Dir.
+	AllowLocalFiles bool
+
+	// RPCListen is the address to serve the JSON-RPC interface of aria2 on, which is disabled if empty.
+	RPCListen string
+	RPCSecret string
+}
+
+// ParseDaemon parses args of the daemon subcommand and returns DaemonOptions.
+func ParseDaemon(args ...string) (*DaemonOptions, error) {
+	flg := flag.NewFlagSet("parallel-download daemon", flag.ExitOnError)
+
+	listen := flg.String("listen", defaultDaemonAddr(), "Serve the JSON API on the Unix domain socket such as unix:/run/parallel-download.sock, or on the specified address of localhost such as 127.0.0.1:7800 with --secret.")
+	secret := flg.String("secret", "", "Require the specified secret token of the JSON API.")
+	allowLocalFiles := flg.Bool("allow-local-files", false, "Allow the downloads of file URLs and those saved outside -d.")
+	state := flg.String("state", defaultQueueState(), "Save the queue in the specified file, and restore it on start.")
+	rpcListen := flg.String("rpc-listen", "", "Serve the JSON-RPC interface of aria2 on the Unix domain socket, or on the specified address of localhost such as 127.0.0.1:6800 with --rpc-secret.")
+	rpcSecret := flg.String("rpc-secret", "", "Require the specified secret token of the JSON-RPC interface of aria2.")
+	jobs := flg.Int("j", 2, "Download the specified number of files at the same time.")
+	parallelism := flg.Int("p", 8, "Download each file in parallel according to the specified number by default.")
+	timeout := flg.Duration("t", 24*time.Hour, "Terminate each download when the specified value has elapsed since it started.")
+
+	var dir string
+	flg.StringVar(&dir, "d", ".", "Save the files under the specified directory by default. (Created if missing.)")
+	flg.StringVar(&dir, "dir", ".", "Same as -d.")
+
+	throttle := throttleFlags(flg)
+	metricsAddr := flg.String("metrics-addr", "", metricsAddrUsage)
+
+	flg.Parse(args)
+
+	if *state == "" {
+		return nil, errNoQueueState
+	}
+
+	if *listen == "" {
+		return nil, errNoDaemonAddr
+	}
+
+	// Any user of the host can connect to localhost, while the Unix domain socket is accessible only by the user.
+	if !isUnixAddr(*listen) && *secret == "" {
+		return nil, errNoSecret
+	}
+	if *rpcListen != "" && !isUnixAddr(*rpcListen) && *rpcSecret == "" {
+		return nil, errNoRPCSecret
+	}
+
+	if *jobs < 1 {
+		*jobs = 1
+	}
+
+	return &DaemonOptions{
+		Options: Options{
+			Parallelism: *parallelism,
+			Dir:         dir,
+			Timeout:     *timeout,
+
+			MaxRedirects: DefaultMaxRedirects,
+			Throttle:     throttle(),
+			MetricsAddr:  *metricsAddr,
+			Metrics:      newMetrics(*metricsAddr),
+		},
+		Listen:          *listen,
+		State:           *state,
+		Jobs:            *jobs,
+		Secret:          *secret,
+		AllowLocalFiles: *allowLocalFiles,
+		RPCListen:       *rpcListen,
+		RPCSecret:       *rpcSecret,
+	}, nil
+}
+
+// defaultDaemonAddr returns the Unix domain socket of the daemon under the user cache directory, or empty if it is unknown.
+func defaultDaemonAddr() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return "unix:" + filepath.Join(dir, "parallel-download", "daemon.sock")
+}
+
+// isUnixAddr reports whether addr is a Unix domain socket prefixed by "unix:".
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// defaultQueueState returns the path of the queue of the daemon under the user cache directory, or empty if it is unknown.
+func defaultQueueState() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "parallel-download", "queue.json")
+}
+
+// ClientOptions has the options required for the subcommands which control the daemon, that is add, ls, pause, resume and rm.
+type ClientOptions struct {
+	Daemon string
+	Secret string
+
+	// Output, Dir, Parallelism and Priority are those of the downloads to add.
+	Output      string
+	Dir         string
+	Parallelism int
+	Priority    int
+
+	// Args are the URLs to add, or the IDs of the downloads to pause, resume or remove.
+	Args []string
+}
+
+// ParseClient parses args of the subcommand of the specified name which controls the daemon, and returns ClientOptions.
+// The paths are made absolute, and the local files to add are made file URLs, since the daemon runs in another directory.
+func ParseClient(name string, args ...string) (*ClientOptions, error) {
+	flg := flag.NewFlagSet("parallel-download "+name, flag.ExitOnError)
+
+	daemon := flg.String("daemon", defaultDaemonAddr(), "Connect to the daemon on the Unix domain socket such as unix:/run/parallel-download.sock, or at the specified address.")
+	secret := flg.String("secret", "", "Send the specified secret token to the daemon.")
+
+	var output, dir string
+	var parallelism, priority int
+	if name == "add" {
+		flg.StringVar(&output, "o", "", "Save the downloaded file in the specified path. (Only with a URL)")
+		flg.StringVar(&dir, "d", "", "Save the downloaded files under the specified directory. (default -d of the daemon)")
+		flg.StringVar(&dir, "dir", "", "Same as -d.")
+		flg.IntVar(&parallelism, "p", 0, "Download each file in parallel according to the specified number. (default -p of the daemon)")
+		flg.IntVar(&priority, "priority", 0, "Download the files before those of lower priority.")
+	}
+
+	flg.Parse(args)
+
+	if *daemon == "" {
+		return nil, errNoDaemonAddr
+	}
+
+	if name != "ls" && flg.NArg() == 0 {
+		if name == "add" {
+			return nil, errNoURL
+		}
+		return nil, errNoID
+	}
+
+	if output != "" && flg.NArg() > 1 {
+		return nil, errOutputWithMultipleURLs
+	}
+
+	for _, p := range []*string{&output, &dir} {
+		if *p == "" {
+			continue
+		}
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return nil, err
+		}
+		*p = abs
+	}
+
+	cliArgs := flg.Args()
+	if name == "add" {
+		cliArgs = nil
+		for _, arg := range flg.Args() {
+			u, err := parseSource(arg)
+			if err != nil {
+				return nil, err
+			}
+			cliArgs = append(cliArgs, u.String())
+		}
+	}
+
+	return &ClientOptions{
+		Daemon:      *daemon,
+		Secret:      *secret,
+		Output:      output,
+		Dir:         dir,
+		Parallelism: parallelism,
+		Priority:    priority,
+		Args:        cliArgs,
 	}, nil
 }
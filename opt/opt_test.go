@@ -1,9 +1,15 @@
 package opt
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMain_parse(t *testing.T) {
@@ -69,3 +75,659 @@ func TestMain_parse_InvalidURL(t *testing.T) {
 		t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, expected, actual)
 	}
 }
+
+func TestMain_parse_Dir(t *testing.T) {
+	cases := map[string]struct {
+		args        []string
+		expectedDir string
+	}{
+		"-d":    {args: []string{"-d=out", "http://example.com/foo.png"}, expectedDir: "out"},
+		"--dir": {args: []string{"--dir=out", "http://example.com/foo.png"}, expectedDir: "out"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			opts, err := Parse(c.args...)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if opts.Dir != c.expectedDir {
+				t.Errorf(`unexpected dir: expected: "%s" actual: "%s"`, c.expectedDir, opts.Dir)
+			}
+		})
+	}
+}
+
+func TestMain_parse_OutputTemplate(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--output-template={host}/{path}", "http://example.com/a.png", "http://example.com/b.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.OutputTemplate != "{host}/{path}" {
+		t.Errorf(`unexpected output template: expected: "%s" actual: "%s"`, "{host}/{path}", opts.OutputTemplate)
+	}
+
+	if opts.Output != "" {
+		t.Errorf(`unexpected output: expected: "" actual: "%s"`, opts.Output)
+	}
+
+	if len(opts.URLs) != 2 {
+		t.Fatalf("unexpected number of URLs: expected: %d actual: %d", 2, len(opts.URLs))
+	}
+
+	if opts.URL != opts.URLs[0] {
+		t.Errorf(`unexpected URL: expected: "%s" actual: "%s"`, opts.URLs[0], opts.URL)
+	}
+}
+
+func TestMain_parse_Error(t *testing.T) {
+	cases := map[string]struct {
+		args     []string
+		expected error
+	}{
+		"no URL":                    {args: []string{"-p=2"}, expected: errNoURL},
+		"-o with multiple URLs":     {args: []string{"-o=a.png", "http://example.com/a.png", "http://example.com/b.png"}, expected: errOutputWithMultipleURLs},
+		"-o with output template":   {args: []string{"-o=a.png", "--output-template={basename}", "http://example.com/a.png"}, expected: errOutputWithTemplate},
+		"-o - with extract":         {args: []string{"-o=-", "--extract=out", "http://example.com/a.tar.gz"}, expected: errExtractWithStdout},
+		"-o with metalink":          {args: []string{"-o=a.png", "a.meta4"}, expected: errOutputWithMetalink},
+		"mirror with metalink":      {args: []string{"--mirror=http://example.org/a.png", "a.meta4"}, expected: errMirrorWithMetalink},
+		"pieces with multiple URLs": {args: []string{"--pieces=a.json", "http://example.com/a.png", "http://example.com/b.png"}, expected: errPiecesWithMultipleURLs},
+		"mirror with multiple URLs": {args: []string{"--mirror=http://example.org/a.png", "http://example.com/a.png", "http://example.com/b.png"}, expected: errMirrorWithMultipleURLs},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, actual := Parse(c.args...)
+			if actual != c.expected {
+				t.Errorf(`unexpected error: expected: "%s" actual: "%s"`, c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMain_parse_MaxBuffer(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"-o=-", "-max-buffer=1024", "http://example.com/foo.tar"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Output != "-" {
+		t.Errorf(`unexpected output: expected: "-" actual: "%s"`, opts.Output)
+	}
+
+	if opts.MaxBuffer != 1024 {
+		t.Errorf("unexpected max buffer: expected: %d actual: %d", 1024, opts.MaxBuffer)
+	}
+}
+
+func TestMain_parseZip(t *testing.T) {
+	t.Parallel()
+
+	opts, err := ParseZip([]string{"-l", "-d=out", "http://example.com/foo.zip", "a.txt", "b/*"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if !opts.List {
+		t.Errorf("unexpectedly list is false")
+	}
+
+	if opts.Dir != "out" {
+		t.Errorf(`unexpected dir: expected: "out" actual: "%s"`, opts.Dir)
+	}
+
+	if opts.URL.String() != "http://example.com/foo.zip" {
+		t.Errorf(`unexpected URL: expected: "http://example.com/foo.zip" actual: "%s"`, opts.URL)
+	}
+
+	if !reflect.DeepEqual(opts.Entries, []string{"a.txt", "b/*"}) {
+		t.Errorf(`unexpected entries: expected: %q actual: %q`, []string{"a.txt", "b/*"}, opts.Entries)
+	}
+}
+
+func TestMain_parse_Mirrors(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--mirror=http://a.example.com/foo.png", "--mirror=http://b.example.com/foo.png", "--stall-timeout=5s", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := []string{"http://a.example.com/foo.png", "http://b.example.com/foo.png"}
+
+	var actual []string
+	for _, u := range opts.Mirrors {
+		actual = append(actual, u.String())
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected mirrors: expected: %q actual: %q", expected, actual)
+	}
+
+	if opts.StallTimeout != 5*time.Second {
+		t.Errorf("unexpected stall timeout: expected: %s actual: %s", 5*time.Second, opts.StallTimeout)
+	}
+}
+
+func TestMain_parse_Metalinks(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"http://example.com/foo.png", "path/to/a.meta4", "http://example.com/b.metalink?x=1"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := []string{"path/to/a.meta4", "http://example.com/b.metalink?x=1"}
+	if !reflect.DeepEqual(opts.Metalinks, expected) {
+		t.Errorf("unexpected metalinks: expected: %q actual: %q", expected, opts.Metalinks)
+	}
+
+	if len(opts.URLs) != 1 || opts.URL.String() != "http://example.com/foo.png" {
+		t.Errorf("unexpected URLs: %v", opts.URLs)
+	}
+
+	if opts.Output != "" {
+		t.Errorf(`unexpected output: expected: "" actual: "%s"`, opts.Output)
+	}
+}
+
+func TestMain_parse_Pieces(t *testing.T) {
+	t.Parallel()
+
+	fp, err := ioutil.TempFile("", "parallel-download")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer os.Remove(fp.Name())
+
+	fmt.Fprint(fp, `{"type": "sha-256", "length": 1024, "hashes": ["a", "b"]}`)
+	fp.Close()
+
+	opts, err := Parse([]string{"--pieces=" + fp.Name(), "--piece-retries=5", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := &Pieces{Type: "sha-256", Length: 1024, Hashes: []string{"a", "b"}}
+	if !reflect.DeepEqual(opts.Pieces, expected) {
+		t.Errorf("unexpected pieces: expected: %v actual: %v", expected, opts.Pieces)
+	}
+
+	if opts.PieceRetries != 5 {
+		t.Errorf("unexpected piece retries: expected: %d actual: %d", 5, opts.PieceRetries)
+	}
+}
+
+func TestMain_parseMirror(t *testing.T) {
+	t.Parallel()
+
+	opts, err := ParseMirror([]string{"-j=2", "--depth=1", "--include=*.iso", "--include=*.sig", "--exclude=old", "-d=out", "http://example.com/pub/"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Jobs != 2 {
+		t.Errorf("unexpected jobs: expected: %d actual: %d", 2, opts.Jobs)
+	}
+
+	if opts.Depth != 1 {
+		t.Errorf("unexpected depth: expected: %d actual: %d", 1, opts.Depth)
+	}
+
+	if !reflect.DeepEqual(opts.Includes, []string{"*.iso", "*.sig"}) {
+		t.Errorf("unexpected includes: expected: %q actual: %q", []string{"*.iso", "*.sig"}, opts.Includes)
+	}
+
+	if !reflect.DeepEqual(opts.Excludes, []string{"old"}) {
+		t.Errorf("unexpected excludes: expected: %q actual: %q", []string{"old"}, opts.Excludes)
+	}
+
+	if opts.Dir != "out" {
+		t.Errorf(`unexpected dir: expected: "out" actual: "%s"`, opts.Dir)
+	}
+
+	if opts.URL.String() != "http://example.com/pub/" {
+		t.Errorf(`unexpected URL: expected: "http://example.com/pub/" actual: "%s"`, opts.URL)
+	}
+}
+
+func TestMain_parse_Media(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		url      string
+		expected string
+	}{
+		"HLS":  {url: "http://example.com/live/index.m3u8", expected: "index.ts"},
+		"DASH": {url: "http://example.com/vod/Manifest.MPD", expected: "Manifest.mp4"},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			opts, err := Parse([]string{"--bandwidth=3000000", "--resolution=1280x720", c.url}...)
+			if err != nil {
+				t.Fatalf("err %s", err)
+			}
+
+			if opts.Output != c.expected {
+				t.Errorf(`unexpected output: expected: "%s" actual: "%s"`, c.expected, opts.Output)
+			}
+
+			if opts.Bandwidth != 3000000 {
+				t.Errorf("unexpected bandwidth: expected: %d actual: %d", 3000000, opts.Bandwidth)
+			}
+
+			if opts.Resolution != "1280x720" {
+				t.Errorf(`unexpected resolution: expected: "1280x720" actual: "%s"`, opts.Resolution)
+			}
+		})
+	}
+}
+
+func TestMain_parse_S3(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--s3-endpoint=http://localhost:9000", "--s3-region=eu-west-1", "s3://bucket/dir/foo.iso"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.S3Endpoint != "http://localhost:9000" {
+		t.Errorf(`unexpected endpoint: expected: "http://localhost:9000" actual: "%s"`, opts.S3Endpoint)
+	}
+
+	if opts.S3Region != "eu-west-1" {
+		t.Errorf(`unexpected region: expected: "eu-west-1" actual: "%s"`, opts.S3Region)
+	}
+
+	if opts.Output != "foo.iso" {
+		t.Errorf(`unexpected output: expected: "foo.iso" actual: "%s"`, opts.Output)
+	}
+}
+
+func TestMain_parse_LocalPath(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "parallel-download")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	opts, err := Parse([]string{f.Name()}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.URL.Scheme != "file" {
+		t.Errorf(`unexpected scheme: expected: "file" actual: "%s"`, opts.URL.Scheme)
+	}
+
+	if opts.URL.Path != f.Name() {
+		t.Errorf(`unexpected path: expected: "%s" actual: "%s"`, f.Name(), opts.URL.Path)
+	}
+}
+
+func TestMain_parseSource_DriveLetter(t *testing.T) {
+	// "c:" is a directory on Unix, which stands for a drive of Windows.
+	err := os.Mkdir("c:", 0755)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer os.RemoveAll("c:")
+
+	err = ioutil.WriteFile("c:/foo.txt", nil, 0644)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	u, err := parseSource("c:/foo.txt")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if u.Scheme != "file" || !strings.HasSuffix(u.Path, "/c:/foo.txt") {
+		t.Errorf(`unexpected URL: expected: "file:///.../c:/foo.txt" actual: "%s"`, u)
+	}
+
+	_, err = parseSource("c:/bar.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error: expected: no such file actual: %v", err)
+	}
+}
+
+func TestMain_parse_UnixSocket(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--unix-socket=/var/run/docker.sock", "http://localhost/images/alpine/get"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.UnixSocket != "/var/run/docker.sock" {
+		t.Errorf(`unexpected unix socket: expected: "/var/run/docker.sock" actual: "%s"`, opts.UnixSocket)
+	}
+}
+
+func TestMain_parse_Dialer(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--resolve=example.com:443:[::1]", "--connect-to=:80:cdn.example.net:", "-6", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expectedResolves := []*Resolve{{Host: "example.com", Port: "443", Addr: "::1"}}
+	if !reflect.DeepEqual(opts.Resolves, expectedResolves) {
+		t.Errorf("unexpected resolves: expected: %+v actual: %+v", expectedResolves[0], opts.Resolves)
+	}
+
+	expectedConnectTos := []*ConnectTo{{Port: "80", ToHost: "cdn.example.net"}}
+	if !reflect.DeepEqual(opts.ConnectTos, expectedConnectTos) {
+		t.Errorf("unexpected connect-tos: expected: %+v actual: %+v", expectedConnectTos[0], opts.ConnectTos)
+	}
+
+	if opts.Network != "tcp6" {
+		t.Errorf(`unexpected network: expected: "tcp6" actual: "%s"`, opts.Network)
+	}
+
+	_, err = Parse([]string{"-4", "-6", "http://example.com/foo.png"}...)
+	if err != errIPv4WithIPv6 {
+		t.Errorf("unexpected error: expected: %s actual: %v", errIPv4WithIPv6, err)
+	}
+}
+
+func TestMain_parse_BindAddresses(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--bind-address=192.0.2.1", "--bind-address=lo", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Skipf("loopback interface is not named lo: %s", err)
+	}
+
+	expected := []string{"192.0.2.1", "127.0.0.1"}
+	var actual []string
+	for _, ip := range opts.BindAddresses {
+		actual = append(actual, ip.String())
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("unexpected bind addresses: expected: %v actual: %v", expected, actual)
+	}
+}
+
+func TestMain_parse_HTTP2(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--http2", "--http2-connections=4", "-v", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if !opts.HTTP2 || opts.HTTP2Connections != 4 || !opts.Verbose {
+		t.Errorf("unexpected options: http2: %t http2 connections: %d verbose: %t", opts.HTTP2, opts.HTTP2Connections, opts.Verbose)
+	}
+
+	_, err = Parse([]string{"--http2", "--connection-per-range", "http://example.com/foo.png"}...)
+	if err != errHTTP2WithPerRange {
+		t.Errorf("unexpected error: expected: %s actual: %v", errHTTP2WithPerRange, err)
+	}
+}
+
+func TestMain_parse_MultiRange(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--multi-range=2", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MultiRange != 2 {
+		t.Errorf("unexpected multi-range: expected: 2 actual: %d", opts.MultiRange)
+	}
+
+	_, err = Parse([]string{"--multi-range=2", "-o", "-", "http://example.com/foo.png"}...)
+	if err != errMultiRangeWithStream {
+		t.Errorf("unexpected error: expected: %s actual: %v", errMultiRangeWithStream, err)
+	}
+}
+
+func TestMain_parse_Redirects(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MaxRedirects != DefaultMaxRedirects || opts.NoFollow {
+		t.Errorf("unexpected defaults: max redirects: %d no follow: %t", opts.MaxRedirects, opts.NoFollow)
+	}
+
+	opts, err = Parse([]string{"--max-redirects=3", "--no-follow", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MaxRedirects != 3 || !opts.NoFollow {
+		t.Errorf("unexpected options: max redirects: %d no follow: %t", opts.MaxRedirects, opts.NoFollow)
+	}
+
+	opts, err = Parse([]string{"--max-redirects=0", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MaxRedirects >= 0 {
+		t.Errorf("unexpected max redirects: expected: negative actual: %d", opts.MaxRedirects)
+	}
+}
+
+func TestMain_parse_Adaptive(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"--adaptive", "--host-cache=/tmp/hosts.json", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if !opts.Adaptive || opts.HostCache != "/tmp/hosts.json" {
+		t.Errorf("unexpected options: adaptive: %t host cache: %q", opts.Adaptive, opts.HostCache)
+	}
+
+	cases := map[string]struct {
+		args     []string
+		expected error
+	}{
+		"stdout":      {args: []string{"--adaptive", "-o", "-", "http://example.com/foo.png"}, expected: errAdaptiveWithStream},
+		"extract":     {args: []string{"--adaptive", "--extract=/tmp", "http://example.com/foo.tar.gz"}, expected: errAdaptiveWithStream},
+		"multi-range": {args: []string{"--adaptive", "--multi-range=2", "http://example.com/foo.png"}, expected: errAdaptiveWithMultiRange},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, err := Parse(c.args...)
+			if err != c.expected {
+				t.Errorf("unexpected error: expected: %s actual: %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestMain_parse_Throttle(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Throttle != nil {
+		t.Errorf("unexpected throttle: expected: nil actual: %v", opts.Throttle)
+	}
+
+	opts, err = Parse([]string{"--host-rate=2.5", "--host-connections=4", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Throttle == nil {
+		t.Error("unexpected throttle: expected: non-nil actual: nil")
+	}
+
+	mirrorOpts, err := ParseMirror([]string{"--breaker-failures=3", "--breaker-cooldown=1m", "http://example.com/"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if mirrorOpts.Throttle == nil {
+		t.Error("unexpected throttle of mirror: expected: non-nil actual: nil")
+	}
+}
+
+func TestMain_parse_Metrics(t *testing.T) {
+	t.Parallel()
+
+	opts, err := Parse([]string{"http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MetricsAddr != "" || opts.Metrics != nil {
+		t.Errorf("unexpected metrics: expected: disabled actual: %q %v", opts.MetricsAddr, opts.Metrics)
+	}
+
+	opts, err = Parse([]string{"--metrics-addr=:9100", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.MetricsAddr != ":9100" || opts.Metrics == nil {
+		t.Errorf("unexpected metrics: expected: \":9100\" non-nil actual: %q %v", opts.MetricsAddr, opts.Metrics)
+	}
+
+	mirrorOpts, err := ParseMirror([]string{"--metrics-addr=:9100", "http://example.com/"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if mirrorOpts.Metrics == nil {
+		t.Error("unexpected metrics of mirror: expected: non-nil actual: nil")
+	}
+
+	daemonOpts, err := ParseDaemon([]string{"--metrics-addr=:9100", "--state=/tmp/queue.json"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if daemonOpts.Metrics == nil {
+		t.Error("unexpected metrics of daemon: expected: non-nil actual: nil")
+	}
+}
+
+func TestMain_parseDaemon(t *testing.T) {
+	t.Parallel()
+
+	opts, err := ParseDaemon([]string{"--listen=unix:/tmp/pd.sock", "--state=/tmp/queue.json", "-j=3", "-p=4", "-d=out", "--allow-local-files", "--rpc-listen=127.0.0.1:6800", "--rpc-secret=secret"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Listen != "unix:/tmp/pd.sock" || opts.State != "/tmp/queue.json" || opts.Jobs != 3 {
+		t.Errorf("unexpected options: listen: %q state: %q jobs: %d", opts.Listen, opts.State, opts.Jobs)
+	}
+
+	if opts.Secret != "" || !opts.AllowLocalFiles {
+		t.Errorf("unexpected API options: secret: %q allow local files: %t", opts.Secret, opts.AllowLocalFiles)
+	}
+
+	if opts.RPCListen != "127.0.0.1:6800" || opts.RPCSecret != "secret" {
+		t.Errorf("unexpected RPC options: listen: %q secret: %q", opts.RPCListen, opts.RPCSecret)
+	}
+
+	if opts.Parallelism != 4 || opts.Dir != "out" || opts.MaxRedirects != DefaultMaxRedirects {
+		t.Errorf("unexpected defaults of downloads: parallelism: %d dir: %q max redirects: %d", opts.Parallelism, opts.Dir, opts.MaxRedirects)
+	}
+
+	cases := map[string]struct {
+		args     []string
+		expected error
+	}{
+		"no state":               {args: []string{"--state="}, expected: errNoQueueState},
+		"no listen":              {args: []string{"--state=/tmp/queue.json", "--listen="}, expected: errNoDaemonAddr},
+		"TCP without secret":     {args: []string{"--state=/tmp/queue.json", "--listen=127.0.0.1:7800"}, expected: errNoSecret},
+		"TCP with secret":        {args: []string{"--state=/tmp/queue.json", "--listen=127.0.0.1:7800", "--secret=secret"}},
+		"RPC without secret":     {args: []string{"--state=/tmp/queue.json", "--rpc-listen=127.0.0.1:6800"}, expected: errNoRPCSecret},
+		"RPC on the Unix socket": {args: []string{"--state=/tmp/queue.json", "--rpc-listen=unix:/tmp/rpc.sock"}},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, err := ParseDaemon(c.args...)
+			if err != c.expected {
+				t.Errorf("unexpected error: expected: %v actual: %v", c.expected, err)
+			}
+		})
+	}
+}
+
+func TestMain_parseClient(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	opts, err := ParseClient("add", []string{"--daemon=unix:/tmp/pd.sock", "--secret=secret", "-o=foo.png", "-p=2", "--priority=5", "http://example.com/foo.png"}...)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if opts.Daemon != "unix:/tmp/pd.sock" || opts.Secret != "secret" || opts.Parallelism != 2 || opts.Priority != 5 {
+		t.Errorf("unexpected options: daemon: %q secret: %q parallelism: %d priority: %d", opts.Daemon, opts.Secret, opts.Parallelism, opts.Priority)
+	}
+
+	// The paths are resolved in the directory of the client.
+	if expected := filepath.Join(wd, "foo.png"); opts.Output != expected {
+		t.Errorf("unexpected output: expected: %q actual: %q", expected, opts.Output)
+	}
+
+	if !reflect.DeepEqual(opts.Args, []string{"http://example.com/foo.png"}) {
+		t.Errorf("unexpected URLs: %q", opts.Args)
+	}
+
+	cases := map[string]struct {
+		name     string
+		args     []string
+		expected error
+	}{
+		"add without URL":     {name: "add", expected: errNoURL},
+		"pause without ID":    {name: "pause", expected: errNoID},
+		"multiple with -o":    {name: "add", args: []string{"-o=foo", "http://example.com/a", "http://example.com/b"}, expected: errOutputWithMultipleURLs},
+		"ls without args":     {name: "ls"},
+		"rm with multiple ID": {name: "rm", args: []string{"1", "2"}},
+	}
+
+	for n, c := range cases {
+		c := c
+		t.Run(n, func(t *testing.T) {
+			_, err := ParseClient(c.name, c.args...)
+			if err != c.expected {
+				t.Errorf("unexpected error: expected: %v actual: %v", c.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Package persisting saves the state kept across runs, such as the queue of the daemon and the host cache.
+*/
+package persisting
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteJSON writes v in JSON to filename, creating its parent directories.
+// The file is replaced by renaming a temporary file so that the other processes never read it half-written.
+func WriteJSON(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	fp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.Write(b)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return err
+	}
+
+	return os.Rename(fp.Name(), filename)
+}
@@ -0,0 +1,43 @@
+package persisting
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPersisting_WriteJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persisting")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "sub", "state.json")
+
+	for _, v := range []map[string]int{{"a": 1}, {"b": 2}} {
+		err = WriteJSON(filename, v)
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expected := "{\n  \"b\": 2\n}"
+	if actual := string(b); actual != expected {
+		t.Errorf("unexpected content: expected: %q actual: %q", expected, actual)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	if len(files) != 1 {
+		t.Errorf("unexpected files: expected: 1 actual: %d", len(files))
+	}
+}
@@ -9,10 +9,16 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
-var cleanFns []func()
+var (
+	// cleanFns are the registered clean functions by their IDs, which are removed when they are deregistered.
+	cleanFns  = map[int]func(){}
+	cleanNext int
+	cleanMu   sync.Mutex
+)
 
 // for testing
 var osExit = os.Exit
@@ -27,16 +33,31 @@ func Listen(ctx context.Context, w io.Writer) (context.Context, func()) {
 		<-ch
 		fmt.Fprintln(w, "\rCtrl+C pressed in Terminal")
 		cancel()
+		cleanMu.Lock()
 		for _, f := range cleanFns {
 			f()
 		}
+		cleanMu.Unlock()
 		osExit(0)
 	}()
 
 	return ctx, cancel
 }
 
-// CleanFunc registers clean function.
-func CleanFunc(f func()) {
-	cleanFns = append(cleanFns, f)
+// CleanFunc registers clean function, and returns the function to deregister it,
+// which should be called when it is no longer needed so that the long-lived processes do not accumulate them.
+// It is safe to call from the downloads running concurrently.
+func CleanFunc(f func()) func() {
+	cleanMu.Lock()
+	defer cleanMu.Unlock()
+
+	id := cleanNext
+	cleanNext++
+	cleanFns[id] = f
+
+	return func() {
+		cleanMu.Lock()
+		defer cleanMu.Unlock()
+		delete(cleanFns, id)
+	}
 }
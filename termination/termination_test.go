@@ -34,3 +34,20 @@ func TestTermination_Listen(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestTermination_CleanFunc(t *testing.T) {
+	deregister := CleanFunc(func() {})
+
+	cleanMu.Lock()
+	n := len(cleanFns)
+	cleanMu.Unlock()
+
+	deregister()
+
+	cleanMu.Lock()
+	defer cleanMu.Unlock()
+
+	if len(cleanFns) != n-1 {
+		t.Errorf("unexpected clean functions: expected: %d actual: %d", n-1, len(cleanFns))
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Package throttling limits the requests to each host, which is shared by the downloads of a batch run.
+*/
+package throttling
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Outcome is the result of a request, which drives the circuit breaker.
+type Outcome int
+
+const (
+	// Aborted is the outcome of a request canceled before it succeeded or failed, which is not counted.
+	Aborted Outcome = iota
+	// Succeeded is the outcome of a request which the host responded to.
+	Succeeded
+	// Failed is the outcome of a request which tells that the host is struggling or down.
+	Failed
+)
+
+// Throttle limits the rate and the number of concurrent requests to each host,
+// and pauses the requests to a host after consecutive failures until a probe request succeeds.
+// A nil Throttle does not limit anything.
+type Throttle struct {
+	interval    time.Duration
+	connections int
+	failures    int
+	cooldown    time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*host
+
+	// for testing
+	now func() time.Time
+}
+
+// host is the state of the requests to a host.
+type host struct {
+	// next is the earliest time to send the next request by the rate.
+	next   time.Time
+	active int
+
+	failures int
+	// openUntil is the time until which the requests are paused, or zero if they are not.
+	openUntil time.Time
+	probing   bool
+
+	// changed is closed when a request is released, so that the waiting requests look at the state again.
+	changed chan struct{}
+}
+
+// New returns Throttle which sends up to rate requests per second and up to connections concurrent requests to each host,
+// and pauses the requests to a host for cooldown after the specified number of consecutive failures.
+// Zero disables each of them, and New returns nil if all of them are disabled.
+func New(rate float64, connections int, failures int, cooldown time.Duration) *Throttle {
+	if rate <= 0 && connections <= 0 && failures <= 0 {
+		return nil
+	}
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+
+	return &Throttle{
+		interval:    interval,
+		connections: connections,
+		failures:    failures,
+		cooldown:    cooldown,
+		hosts:       map[string]*host{},
+		now:         time.Now,
+	}
+}
+
+// Acquire waits until a request can be sent to the host, and returns the function to release it with its outcome.
+// The pause of the host and its recovery are reported to w.
+func (t *Throttle) Acquire(ctx context.Context, w io.Writer, hostname string) (func(Outcome), error) {
+	if t == nil {
+		return func(Outcome) {}, nil
+	}
+
+	for {
+		t.mu.Lock()
+
+		h, ok := t.hosts[hostname]
+		if !ok {
+			h = &host{changed: make(chan struct{})}
+			t.hosts[hostname] = h
+		}
+
+		now := t.now()
+		wait, probe, admitted := t.admit(h, now)
+
+		if admitted {
+			h.active++
+			if probe {
+				h.probing = true
+				fmt.Fprintf(w, "probe: %s\n", hostname)
+			}
+
+			start := now
+			if t.interval > 0 {
+				if h.next.After(start) {
+					start = h.next
+				}
+				h.next = start.Add(t.interval)
+			}
+
+			t.mu.Unlock()
+
+			release := t.releaseFunc(w, hostname, h, probe)
+
+			if delay := start.Sub(now); delay > 0 {
+				select {
+				case <-ctx.Done():
+					release(Aborted)
+					return nil, ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+
+			return release, nil
+		}
+
+		changed := h.changed
+		t.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timeout = time.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		case <-timeout:
+		}
+	}
+}
+
+// admit reports whether a request can be sent to h now, and whether it is the probe of the paused host.
+// Otherwise, it returns the duration to wait, or 0 to wait for the release of another request.
+func (t *Throttle) admit(h *host, now time.Time) (time.Duration, bool, bool) {
+	probe := false
+
+	if !h.openUntil.IsZero() {
+		if now.Before(h.openUntil) {
+			return h.openUntil.Sub(now), false, false
+		}
+		// Only one request probes the host at a time.
+		if h.probing {
+			return 0, false, false
+		}
+		probe = true
+	}
+
+	if t.connections > 0 && h.active >= t.connections {
+		return 0, false, false
+	}
+
+	return 0, probe, true
+}
+
+// releaseFunc returns the function to release a request to h with its outcome, which can be called only once.
+func (t *Throttle) releaseFunc(w io.Writer, hostname string, h *host, probe bool) func(Outcome) {
+	var once sync.Once
+
+	return func(outcome Outcome) {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			h.active--
+			if probe {
+				h.probing = false
+			}
+
+			switch outcome {
+			case Succeeded:
+				h.failures = 0
+				if !h.openUntil.IsZero() {
+					h.openUntil = time.Time{}
+					fmt.Fprintf(w, "resume: %s\n", hostname)
+				}
+			case Failed:
+				h.failures++
+				if t.failures > 0 && (probe || h.openUntil.IsZero() && h.failures >= t.failures) {
+					h.openUntil = t.now().Add(t.cooldown)
+					fmt.Fprintf(w, "pause: %s after %d consecutive failures, probe in %s\n", hostname, h.failures, t.cooldown)
+				}
+			}
+
+			close(h.changed)
+			h.changed = make(chan struct{})
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package throttling
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestThrottling_New_Disabled(t *testing.T) {
+	th := New(0, 0, 0, time.Second)
+	if th != nil {
+		t.Fatalf("unexpected throttle: expected: nil actual: %v", th)
+	}
+
+	release, err := th.Acquire(context.Background(), ioutil.Discard, "example.com")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	release(Failed)
+}
+
+func TestThrottling_Acquire_Connections(t *testing.T) {
+	th := New(0, 2, 0, 0)
+
+	var mu sync.Mutex
+	active := map[string]int{}
+	max := map[string]int{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		hostname := []string{"a.example.com", "b.example.com"}[i%2]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			release, err := th.Acquire(context.Background(), ioutil.Discard, hostname)
+			if err != nil {
+				t.Errorf("err %s", err)
+				return
+			}
+			defer release(Succeeded)
+
+			mu.Lock()
+			active[hostname]++
+			if active[hostname] > max[hostname] {
+				max[hostname] = active[hostname]
+			}
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+
+			mu.Lock()
+			active[hostname]--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	for _, hostname := range []string{"a.example.com", "b.example.com"} {
+		if max[hostname] != 2 {
+			t.Errorf("unexpected concurrent requests to %s: expected: 2 actual: %d", hostname, max[hostname])
+		}
+	}
+}
+
+func TestThrottling_Acquire_Rate(t *testing.T) {
+	th := New(50, 0, 0, 0)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		release, err := th.Acquire(context.Background(), ioutil.Discard, "example.com")
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		release(Succeeded)
+	}
+
+	// The first request is sent immediately, and the others every 20ms.
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("unexpected elapsed time: expected: >= %s actual: %s", 80*time.Millisecond, elapsed)
+	}
+
+	// The other hosts are not affected.
+	start = time.Now()
+	release, err := th.Acquire(context.Background(), ioutil.Discard, "other.example.com")
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+	release(Succeeded)
+
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("unexpected elapsed time: expected: < %s actual: %s", 10*time.Millisecond, elapsed)
+	}
+}
+
+func TestThrottling_Acquire_Breaker(t *testing.T) {
+	cooldown := 50 * time.Millisecond
+	th := New(0, 0, 2, cooldown)
+
+	log := &bytes.Buffer{}
+
+	acquire := func() func(Outcome) {
+		t.Helper()
+		release, err := th.Acquire(context.Background(), log, "example.com")
+		if err != nil {
+			t.Fatalf("err %s", err)
+		}
+		return release
+	}
+
+	// A success resets the consecutive failures.
+	acquire()(Failed)
+	acquire()(Succeeded)
+	acquire()(Failed)
+	if strings.Contains(log.String(), "pause") {
+		t.Fatalf("unexpected pause: %q", log.String())
+	}
+
+	acquire()(Failed)
+	if expected := "pause: example.com after 2 consecutive failures, probe in 50ms\n"; log.String() != expected {
+		t.Fatalf("unexpected log: expected: %q actual: %q", expected, log.String())
+	}
+
+	// The request waits for the cooldown, and probes the host.
+	start := time.Now()
+	probe := acquire()
+	if elapsed := time.Since(start); elapsed < cooldown {
+		t.Errorf("unexpected elapsed time: expected: >= %s actual: %s", cooldown, elapsed)
+	}
+
+	// The other requests wait for the probe.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := th.Acquire(ctx, log, "example.com")
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: expected: %s actual: %v", context.DeadlineExceeded, err)
+	}
+
+	// A failed probe pauses the host again.
+	probe(Failed)
+	if !strings.HasSuffix(log.String(), "pause: example.com after 3 consecutive failures, probe in 50ms\n") {
+		t.Errorf("unexpected log: %q", log.String())
+	}
+
+	acquire()(Succeeded)
+	if !strings.HasSuffix(log.String(), "probe: example.com\nresume: example.com\n") {
+		t.Errorf("unexpected log: %q", log.String())
+	}
+
+	// The requests are sent immediately after the host is resumed.
+	start = time.Now()
+	acquire()(Succeeded)
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("unexpected elapsed time: expected: < %s actual: %s", 10*time.Millisecond, elapsed)
+	}
+}